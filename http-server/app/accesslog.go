@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	logFormatCommon   = "common"
+	logFormatCombined = "combined"
+	logFormatJSON     = "json"
+
+	clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLog writes one line per request to a file or to stdout, the file is opened again on
+// reopen so it can be rotated by moving it away and sending SIGHUP
+type accessLog struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	w      io.Writer
+	file   *os.File
+}
+
+// accessEntry is what is known of a request once its response is finished
+type accessEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	RequestID  string  `json:"request_id"`
+	User       string  `json:"user,omitempty"`
+}
+
+// newAccessLog opens the log, the path - writes to stdout
+func newAccessLog(path string, format string) (*accessLog, error) {
+	switch format {
+	case logFormatCommon, logFormatCombined, logFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %s", format)
+	}
+
+	l := &accessLog{path: path, format: format}
+
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// reopen closes the log file and opens it again at its path, lines written meanwhile wait for it
+func (l *accessLog) reopen() error {
+	if l.path == "-" {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	previous := l.file
+	l.file = file
+	l.w = file
+	l.mu.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// reopenOnHangup reopens the log every time the process gets SIGHUP, as log rotation tools expect
+func (l *accessLog) reopenOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for range hangup {
+			if err := l.reopen(); err != nil {
+				fmt.Println("Error while reopening the access log : ", err.Error())
+			}
+		}
+	}()
+}
+
+func (l *accessLog) write(e accessEntry, start time.Time) {
+	var line string
+
+	switch l.format {
+	case logFormatJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			fmt.Println("Error while encoding the access log line : ", err.Error())
+			return
+		}
+		line = string(b)
+	default:
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.FormatInt(e.Bytes, 10)
+		}
+
+		requestLine := e.Method + " " + e.Path
+		if e.Protocol != "" {
+			requestLine += " " + e.Protocol
+		}
+
+		line = fmt.Sprintf("%s - %s [%s] %s %d %s", e.RemoteAddr, clfUser(e.User), start.Format(clfTimeLayout), strconv.Quote(requestLine), e.Status, size)
+
+		if l.format == logFormatCombined {
+			line += " " + clfQuote(e.Referer) + " " + clfQuote(e.UserAgent)
+		}
+
+		// the fields the standard formats do not have come last so their parsers still read the line
+		line += fmt.Sprintf(" %s %.3f", clfQuote(e.RequestID), e.DurationMs)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := io.WriteString(l.w, line+"\n"); err != nil {
+		fmt.Println("Error while writing the access log : ", err.Error())
+	}
+}
+
+// clfQuote quotes the value the way the log formats expect, - standing for a missing one
+func clfQuote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+// clfUser gives the authuser field, the fields are separated by spaces so none may be left in it
+func clfUser(user string) string {
+	if user == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '"' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, user)
+}
+
+// startAccessLog gives the request an id sent back in the X-Request-Id header, the id of a client
+// or a proxy in front is kept when it looks sane
+func (s *server) startAccessLog(props *reqProps, rc *responseConn) {
+	if s.accessLog == nil {
+		return
+	}
+
+	props.id = props.header("X-Request-Id")
+	if !validRequestID(props.id) {
+		props.id = newRequestID()
+	}
+
+	rc.onHead(func(status int, headers map[string]string, size int64) {
+		setHeader(headers, "X-Request-Id", props.id)
+	})
+}
+
+// logAccess writes the line of the request once its response is finished
+func (s *server) logAccess(props *reqProps, rc *responseConn, start time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+
+	remote := "-"
+	if addr := rc.RemoteAddr(); addr != nil {
+		remote = addr.String()
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+	}
+
+	path := "/" + props.request.path
+	if props.request.query != "" {
+		path += "?" + props.request.query
+	}
+	// proxied requests are logged with the host they were for
+	if props.target != "" && !strings.HasPrefix(props.target, "/") {
+		path = props.target
+	}
+
+	s.accessLog.write(accessEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		RemoteAddr: remote,
+		Method:     props.method,
+		Path:       path,
+		Protocol:   props.version,
+		Status:     rc.status,
+		Bytes:      rc.bodyBytes,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Referer:    props.header("Referer"),
+		UserAgent:  props.header("User-Agent"),
+		RequestID:  props.id,
+		User:       props.principal,
+	}, start)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~' || r == '"'
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer lets the test read the log while the server goroutines write it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// logRequest sends the raw request and reads the response until the server closes the connection,
+// which it does once the line is logged
+func logRequest(t *testing.T, addr string, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(request))
+
+	var res bytes.Buffer
+	res.ReadFrom(bufio.NewReader(conn))
+
+	return res.String()
+}
+
+func logLines(out *syncBuffer) []string {
+	return strings.Split(strings.TrimSpace(out.String()), "\n")
+}
+
+func TestAccessLog(t *testing.T) {
+
+	t.Run("Should write combined lines with the request id", func(t *testing.T) {
+		out := &syncBuffer{}
+		s := routesServer(t)
+		s.accessLog = &accessLog{format: logFormatCombined, w: out}
+		addr := listen(t, s, nil)
+
+		res := logRequest(t, addr, "GET /echo/abc?x=1 HTTP/1.1\r\nHost: localhost\r\nUser-Agent: tester/1.0\r\nX-Request-Id: abc-123\r\n\r\n")
+		if !strings.Contains(res, "X-Request-Id:abc-123") {
+			t.Logf("The request id should be sent back, got %q", res)
+			t.Fail()
+		}
+
+		logRequest(t, addr, "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+		lines := logLines(out)
+		if len(lines) != 2 {
+			t.Logf("There should be a line per request, got %q", lines)
+			t.FailNow()
+		}
+
+		combined := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /echo/abc\?x=1 HTTP/1\.1" 200 3 "-" "tester/1\.0" "abc-123" [0-9.]+$`)
+		if !combined.MatchString(lines[0]) {
+			t.Logf("Line was not in the combined format: %q", lines[0])
+			t.Fail()
+		}
+
+		missing := regexp.MustCompile(`"GET /missing HTTP/1\.1" 404 - "-" "-" "[0-9a-f]{32}" `)
+		if !missing.MatchString(lines[1]) {
+			t.Logf("Unknown routes should be logged with a generated id: %q", lines[1])
+			t.Fail()
+		}
+	})
+
+	t.Run("Should write json lines", func(t *testing.T) {
+		out := &syncBuffer{}
+		s := routesServer(t)
+		s.accessLog = &accessLog{format: logFormatJSON, w: out}
+		addr := listen(t, s, nil)
+
+		logRequest(t, addr, "GET /user-agent HTTP/1.1\r\nHost: localhost\r\nUser-Agent: \"quoted\"\r\n\r\n")
+
+		var entry accessEntry
+		if err := json.Unmarshal([]byte(logLines(out)[0]), &entry); err != nil {
+			t.Logf("Line should be json: %s", err.Error())
+			t.FailNow()
+		}
+
+		if entry.Method != "GET" || entry.Path != "/user-agent" || entry.Status != 200 || entry.Bytes != 8 || entry.UserAgent != `"quoted"` || entry.RequestID == "" {
+			t.Logf("Entry is not right: %+v", entry)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should write to the new file after a reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "access.log")
+
+		l, err := newAccessLog(path, logFormatCommon)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := routesServer(t)
+		s.accessLog = l
+		addr := listen(t, s, nil)
+
+		logRequest(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		os.Rename(path, path+".1")
+		l.reopen()
+		logRequest(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+		rotated, _ := os.ReadFile(path + ".1")
+		current, _ := os.ReadFile(path)
+
+		if !strings.Contains(string(rotated), `"GET / HTTP/1.1" 200`) || !strings.Contains(string(current), `"GET /index.html HTTP/1.1" 404`) {
+			t.Logf("Each file should have its line, got %q and %q", rotated, current)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse unknown formats", func(t *testing.T) {
+		if _, err := newAccessLog("-", "apache"); err == nil {
+			t.Log("There should be an error")
+			t.Fail()
+		}
+	})
+}
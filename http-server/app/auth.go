@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	authSchemeBasic  = "Basic"
+	authSchemeBearer = "Bearer"
+	authSchemeHMAC   = "HMAC-SHA256"
+
+	defaultAuthRealm = "restricted"
+	defaultHMACSkew  = 5 * time.Minute
+)
+
+var errBadCredentials = errors.New("the credentials are wrong")
+
+// authenticator checks the credentials of one scheme of the Authorization header, it gives the
+// principal they belong to
+type authenticator interface {
+	scheme() string
+	challenge(err error) string
+	authenticate(credentials string, props *reqProps) (string, error)
+}
+
+// protect puts the route and every route below it behind the authenticators, so a route added
+// under it later is not left open
+func (s *server) protect(path string, authenticators ...authenticator) {
+	s.useBelow(path, s.authenticate(authenticators...))
+	s.nodeFor(path).authenticated = true
+}
+
+// protected tells whether the route is behind an authentication, its own or one of a route above it
+func (n *node) protected() bool {
+	for c := n; c != nil; c = c.parent {
+		if c.authenticated {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoutes tells whether the node or one below it answers requests
+func (n *node) hasRoutes() bool {
+	if n.handler != nil || len(n.methods) > 0 || n.websocket != nil {
+		return true
+	}
+	for _, child := range n.childPaths {
+		if child.hasRoutes() {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate lets through the requests with valid credentials of one of the authenticators and
+// answers the others 401 with a challenge. The principal is set on the props for the handlers, a
+// request an earlier middleware already authenticated, like a signed url, goes through
+func (s *server) authenticate(authenticators ...authenticator) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			if props.principal != "" {
+				next(props, conn)
+				return
+			}
+
+			scheme, credentials, _ := strings.Cut(props.header("Authorization"), " ")
+
+			var challenges []string
+			for _, a := range authenticators {
+				if !strings.EqualFold(scheme, a.scheme()) {
+					challenges = append(challenges, a.challenge(nil))
+					continue
+				}
+
+				principal, err := a.authenticate(strings.TrimSpace(credentials), props)
+				if err == nil {
+					props.principal = principal
+					next(props, conn)
+					return
+				}
+
+				// the client picked this scheme, only its challenge tells what went wrong
+				challenges = []string{a.challenge(err)}
+				break
+			}
+
+			// each challenge is a WWW-Authenticate header of its own
+			s.writeResponse(401, map[string]string{
+				"WWW-Authenticate": strings.Join(challenges, "\n"),
+				"Content-Length":   "0",
+			}, "", conn)
+		}
+	}
+}
+
+// basicAuth checks user and password against the hashes of an htpasswd file, the {SHA},
+// {SHA256}, {SSHA256} and $apr1$ formats are understood
+type basicAuth struct {
+	realm  string
+	hashes map[string]string
+}
+
+func (b *basicAuth) scheme() string {
+	return authSchemeBasic
+}
+
+func (b *basicAuth) challenge(err error) string {
+	return authSchemeBasic + ` realm=` + strconv.Quote(b.realm) + `, charset="UTF-8"`
+}
+
+func (b *basicAuth) authenticate(credentials string, props *reqProps) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", errBadCredentials
+	}
+
+	user, password, found := strings.Cut(string(decoded), ":")
+	hash, known := b.hashes[user]
+	if !found || !known {
+		// the password is hashed all the same so unknown users take as long as the known ones
+		checkPassword("{SHA256}", password)
+		return "", errBadCredentials
+	}
+
+	if !checkPassword(hash, password) {
+		return "", errBadCredentials
+	}
+	return user, nil
+}
+
+// checkPassword compares the password with the htpasswd hash in constant time
+func checkPassword(hash string, password string) bool {
+	var computed string
+
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "{SHA256}"):
+		sum := sha256.Sum256([]byte(password))
+		computed = "{SHA256}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "{SSHA256}"):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SSHA256}"))
+		if err != nil || len(raw) <= sha256.Size {
+			return false
+		}
+		sum := sha256.Sum256(append([]byte(password), raw[sha256.Size:]...))
+		computed = "{SSHA256}" + base64.StdEncoding.EncodeToString(append(sum[:], raw[sha256.Size:]...))
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1(password, salt)
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 is the md5 based crypt of apache, the default format of htpasswd
+func apr1(password string, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alternate[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var encoded strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + encoded.String()
+}
+
+// bearerAuth checks static tokens, they are kept hashed so looking one up tells nothing of the others
+type bearerAuth struct {
+	realm  string
+	tokens map[[sha256.Size]byte]string
+}
+
+func newBearerAuth(realm string, tokens map[string]string) *bearerAuth {
+	b := &bearerAuth{realm: realm, tokens: make(map[[sha256.Size]byte]string, len(tokens))}
+	for token, principal := range tokens {
+		b.tokens[sha256.Sum256([]byte(token))] = principal
+	}
+	return b
+}
+
+func (b *bearerAuth) scheme() string {
+	return authSchemeBearer
+}
+
+func (b *bearerAuth) challenge(err error) string {
+	c := authSchemeBearer + ` realm=` + strconv.Quote(b.realm)
+	if err != nil {
+		c += `, error="invalid_token"`
+	}
+	return c
+}
+
+func (b *bearerAuth) authenticate(credentials string, props *reqProps) (string, error) {
+	principal, ok := b.tokens[sha256.Sum256([]byte(credentials))]
+	if !ok || credentials == "" {
+		return "", errBadCredentials
+	}
+	return principal, nil
+}
+
+// hmacAuth checks requests signed with a shared key. The client sends
+//
+//	Authorization: HMAC-SHA256 keyId="id", timestamp="unix seconds", signature="base64"
+//
+// the signature being the HMAC-SHA256 with the key of the method, target, timestamp and hex
+// SHA-256 of the body as sent, before its Content-Encoding is decoded, each on its own line. Timestamps too far from now are refused so a
+// captured request can not be replayed later
+type hmacAuth struct {
+	realm   string
+	keys    map[string][]byte
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+func newHMACAuth(realm string, keys map[string]string) *hmacAuth {
+	h := &hmacAuth{realm: realm, keys: make(map[string][]byte, len(keys)), maxSkew: defaultHMACSkew, now: time.Now}
+	for id, secret := range keys {
+		h.keys[id] = []byte(secret)
+	}
+	return h
+}
+
+func (h *hmacAuth) scheme() string {
+	return authSchemeHMAC
+}
+
+func (h *hmacAuth) challenge(err error) string {
+	return authSchemeHMAC + ` realm=` + strconv.Quote(h.realm)
+}
+
+func (h *hmacAuth) authenticate(credentials string, props *reqProps) (string, error) {
+	params := authParams(credentials)
+
+	key, ok := h.keys[params["keyId"]]
+	if !ok {
+		return "", errBadCredentials
+	}
+
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return "", errBadCredentials
+	}
+	if skew := h.now().Sub(time.Unix(timestamp, 0)); skew > h.maxSkew || skew < -h.maxSkew {
+		return "", errBadCredentials
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", errBadCredentials
+	}
+
+	// the signature covers the body, a streamed one has to be read whole first
+	if _, err := props.readBody(); err != nil {
+		return "", errBadCredentials
+	}
+
+	if !hmac.Equal(signature, signRequest(key, props, params["timestamp"])) {
+		return "", errBadCredentials
+	}
+	return params["keyId"], nil
+}
+
+// signRequest gives the HMAC of the request the hmac scheme expects
+func signRequest(key []byte, props *reqProps, timestamp string) []byte {
+	target := "/" + props.request.path
+	if props.request.query != "" {
+		target += "?" + props.request.query
+	}
+	bodySum := sha256.Sum256(props.body)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(props.method + "\n" + target + "\n" + timestamp + "\n" + hex.EncodeToString(bodySum[:])))
+	return mac.Sum(nil)
+}
+
+// authParams reads the name="value" pairs of the credentials
+func authParams(credentials string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(credentials, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// readCredentialFile reads the name:secret lines of a credential file, blank lines and the ones
+// starting with # are skipped
+func readCredentialFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, secret, found := strings.Cut(text, ":")
+		if !found || name == "" || secret == "" {
+			return nil, fmt.Errorf("line %d of %s should be written name:secret", line, path)
+		}
+		entries[name] = secret
+	}
+
+	return entries, scanner.Err()
+}
+
+// readHtpasswd reads the users of an htpasswd file, refusing the hash formats it can not check
+func readHtpasswd(path string) (map[string]string, error) {
+	hashes, err := readCredentialFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for user, hash := range hashes {
+		if !checkPasswordFormat(hash) {
+			return nil, fmt.Errorf("the password of %s in %s has an unsupported format, use {SHA}, {SHA256}, {SSHA256} or $apr1$", user, path)
+		}
+	}
+
+	return hashes, nil
+}
+
+func checkPasswordFormat(hash string) bool {
+	for _, prefix := range []string{"{SHA}", "{SHA256}", "{SSHA256}", "$apr1$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthenticators reads the credential files given, the schemes without one are left out
+func loadAuthenticators(realm string, htpasswd string, bearerTokens string, hmacKeys string) (map[string]authenticator, error) {
+	authenticators := make(map[string]authenticator)
+
+	if htpasswd != "" {
+		hashes, err := readHtpasswd(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		authenticators["basic"] = &basicAuth{realm: realm, hashes: hashes}
+	}
+
+	if bearerTokens != "" {
+		entries, err := readCredentialFile(bearerTokens)
+		if err != nil {
+			return nil, err
+		}
+		tokens := make(map[string]string, len(entries))
+		for principal, token := range entries {
+			tokens[token] = principal
+		}
+		authenticators["bearer"] = newBearerAuth(realm, tokens)
+	}
+
+	if hmacKeys != "" {
+		keys, err := readCredentialFile(hmacKeys)
+		if err != nil {
+			return nil, err
+		}
+		authenticators["hmac"] = newHMACAuth(realm, keys)
+	}
+
+	return authenticators, nil
+}
+
+// parseAuthRoutes reads the route=scheme,scheme values of the -auth flag
+func parseAuthRoutes(values []string) (map[string][]string, error) {
+	routes := make(map[string][]string, len(values))
+
+	for _, v := range values {
+		route, schemes, found := strings.Cut(v, "=")
+		if !found || schemes == "" {
+			return nil, fmt.Errorf("auth %s should be written route=scheme,scheme", v)
+		}
+
+		for _, scheme := range splitList(schemes) {
+			switch scheme {
+			case "basic", "bearer", "hmac":
+			default:
+				return nil, fmt.Errorf("auth %s should use the basic, bearer or hmac schemes", v)
+			}
+		}
+
+		routes[strings.Trim(route, "/")] = splitList(schemes)
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func authRequest(t *testing.T, addr string, method string, target string, body string, authorization string) (*http.Response, string) {
+	req, err := http.NewRequest(method, "http://"+addr+target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+
+	return res, string(b)
+}
+
+func signedAuthorization(keyID string, key string, method string, target string, body string, timestamp time.Time) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	bodySum := sha256.Sum256([]byte(body))
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + target + "\n" + ts + "\n" + hex.EncodeToString(bodySum[:])))
+
+	return `HMAC-SHA256 keyId="` + keyID + `", timestamp="` + ts + `", signature="` + base64.StdEncoding.EncodeToString(mac.Sum(nil)) + `"`
+}
+
+func TestCheckPassword(t *testing.T) {
+	hashes := []string{
+		"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/",
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"{SHA256}K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols=",
+	}
+
+	salt := []byte("saltsalt")
+	sum := sha256.Sum256(append([]byte("secret"), salt...))
+	hashes = append(hashes, "{SSHA256}"+base64.StdEncoding.EncodeToString(append(sum[:], salt...)))
+
+	t.Run("Should accept the right password in every format", func(t *testing.T) {
+		for _, hash := range hashes {
+			if !checkPassword(hash, "secret") {
+				t.Logf("secret should match %s", hash)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse a wrong password in every format", func(t *testing.T) {
+		for _, hash := range hashes {
+			if checkPassword(hash, "Secret") {
+				t.Logf("Secret should not match %s", hash)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse the formats it can not check", func(t *testing.T) {
+		if checkPassword("$2y$05$abcdefghijklmnopqrstuu", "secret") || checkPassword("secret", "secret") {
+			t.Log("bcrypt and plain passwords should never match")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse an htpasswd file with bcrypt passwords", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		os.WriteFile(path, []byte("# users\nalice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:$2y$05$abcdefghijklmnopqrstuu\n"), 0600)
+
+		if _, err := readHtpasswd(path); err == nil {
+			t.Log("the bcrypt password of bob should be refused")
+			t.Fail()
+		}
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	basic := &basicAuth{realm: "files", hashes: map[string]string{"alice": "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"}}
+	bearer := newBearerAuth("files", map[string]string{"s3cr3t-token": "ci"})
+	signed := newHMACAuth("files", map[string]string{"deploy": "shared-key"})
+
+	addr := listen(t, testServer(t, func(s *server) error {
+		whoami := func(props *reqProps, conn net.Conn) {
+			s.writeResponse(200, map[string]string{"Content-Length": strconv.Itoa(len(props.principal))}, props.principal, conn)
+		}
+		for _, method := range []string{"GET", "POST"} {
+			if err := s.registerMethodHandler(method, "private", whoami); err != nil {
+				return err
+			}
+		}
+
+		if err := s.registerHandler("private/reports/{name}", whoami); err != nil {
+			return err
+		}
+
+		s.protect("private", basic, bearer, signed)
+
+		return s.registerHandler("public", whoami)
+	}), nil)
+
+	t.Run("Should challenge a request without credentials with every scheme", func(t *testing.T) {
+		res, _ := authRequest(t, addr, "GET", "/private", "", "")
+
+		challenges := res.Header.Values("WWW-Authenticate")
+		if res.StatusCode != 401 || len(challenges) != 3 {
+			t.Logf("the request should be answered 401 with 3 challenges, got %d %v", res.StatusCode, challenges)
+			t.FailNow()
+		}
+
+		if challenges[0] != `Basic realm="files", charset="UTF-8"` || challenges[1] != `Bearer realm="files"` || challenges[2] != `HMAC-SHA256 realm="files"` {
+			t.Logf("the challenges are not the expected ones, got %v", challenges)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should give the handler the user of valid basic credentials", func(t *testing.T) {
+		credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		res, body := authRequest(t, addr, "GET", "/private", "", "Basic "+credentials)
+
+		if res.StatusCode != 200 || body != "alice" {
+			t.Logf("alice should be let in, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a wrong password or an unknown user", func(t *testing.T) {
+		for _, credentials := range []string{"alice:wrong", "mallory:secret", "alice", "!!!"} {
+			encoded := base64.StdEncoding.EncodeToString([]byte(credentials))
+			if credentials == "!!!" {
+				encoded = credentials
+			}
+
+			res, _ := authRequest(t, addr, "GET", "/private", "", "Basic "+encoded)
+			if res.StatusCode != 401 || res.Header.Get("WWW-Authenticate") != `Basic realm="files", charset="UTF-8"` {
+				t.Logf("%s should be answered 401 with the basic challenge, got %d %v", credentials, res.StatusCode, res.Header.Values("WWW-Authenticate"))
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should give the handler the principal of a known bearer token", func(t *testing.T) {
+		res, body := authRequest(t, addr, "GET", "/private", "", "Bearer s3cr3t-token")
+
+		if res.StatusCode != 200 || body != "ci" {
+			t.Logf("the token should be accepted, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should tell an unknown bearer token is invalid", func(t *testing.T) {
+		res, _ := authRequest(t, addr, "GET", "/private", "", "bearer guessed")
+
+		if res.StatusCode != 401 || res.Header.Get("WWW-Authenticate") != `Bearer realm="files", error="invalid_token"` {
+			t.Logf("the token should be refused as invalid, got %d %v", res.StatusCode, res.Header.Values("WWW-Authenticate"))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should accept a request signed with a known key", func(t *testing.T) {
+		authorization := signedAuthorization("deploy", "shared-key", "POST", "/private?force=1", "payload", time.Now())
+		res, body := authRequest(t, addr, "POST", "/private?force=1", "payload", authorization)
+
+		if res.StatusCode != 200 || body != "deploy" {
+			t.Logf("the signed request should be accepted, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a signed request that was changed", func(t *testing.T) {
+		authorization := signedAuthorization("deploy", "shared-key", "POST", "/private?force=1", "payload", time.Now())
+
+		for _, target := range []string{"/private?force=0", "/private"} {
+			if res, _ := authRequest(t, addr, "POST", target, "payload", authorization); res.StatusCode != 401 {
+				t.Logf("the signature should not be valid for %s, got %d", target, res.StatusCode)
+				t.Fail()
+			}
+		}
+
+		if res, _ := authRequest(t, addr, "POST", "/private?force=1", "other payload", authorization); res.StatusCode != 401 {
+			t.Logf("the signature should not be valid for another body, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a signature made with another key or too long ago", func(t *testing.T) {
+		cases := map[string]string{
+			"another key":   signedAuthorization("deploy", "other-key", "GET", "/private", "", time.Now()),
+			"an unknown id": signedAuthorization("nobody", "shared-key", "GET", "/private", "", time.Now()),
+			"an old stamp":  signedAuthorization("deploy", "shared-key", "GET", "/private", "", time.Now().Add(-10*time.Minute)),
+		}
+
+		for name, authorization := range cases {
+			if res, _ := authRequest(t, addr, "GET", "/private", "", authorization); res.StatusCode != 401 {
+				t.Logf("a signature with %s should be refused, got %d", name, res.StatusCode)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should protect the routes below the authenticated one", func(t *testing.T) {
+		if res, _ := authRequest(t, addr, "GET", "/private/reports/q3", "", ""); res.StatusCode != 401 {
+			t.Logf("a route below the authenticated one should ask for credentials, got %d", res.StatusCode)
+			t.Fail()
+		}
+
+		credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		if res, body := authRequest(t, addr, "GET", "/private/reports/q3", "", "Basic "+credentials); res.StatusCode != 200 || body != "alice" {
+			t.Logf("alice should be let in below the authenticated route, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should leave the other routes open", func(t *testing.T) {
+		if res, _ := authRequest(t, addr, "GET", "/public", "", ""); res.StatusCode != 200 {
+			t.Logf("a route without authentication should not ask for credentials, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+	t.Run("Should tell the routes with nothing to protect", func(t *testing.T) {
+		s := testServer(t, func(s *server) error {
+			return s.registerFileRoutes()
+		})
+
+		if !s.nodeFor("files").hasRoutes() || !s.nodeFor(filesRoute).hasRoutes() {
+			t.Log("the files routes should be found")
+			t.Fail()
+		}
+
+		if s.nodeFor("fles").hasRoutes() {
+			t.Log("a mistyped route should have nothing to protect")
+			t.Fail()
+		}
+	})
+}
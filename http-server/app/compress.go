@@ -0,0 +1,210 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the codings we know how to produce, in the order we prefer them when the client likes them the same
+var supportedEncodings = []string{"gzip", "deflate"}
+
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type compressionConfig struct {
+	// minSize is the smallest body compressed, streamed bodies of unknown size are always compressed
+	minSize int64
+	// contentTypes are the media types compressed, an entry ending with / matches the whole type
+	contentTypes []string
+	level        int
+}
+
+// compression encodes the responses with the best coding the client accepts, bodies written in one go
+// are compressed in memory and streamed ones are compressed as they are written
+func compression(cfg compressionConfig) middleware {
+	if cfg.contentTypes == nil {
+		cfg.contentTypes = defaultCompressibleTypes
+	}
+
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			rc, ok := conn.(*responseConn)
+			if !ok {
+				next(props, conn)
+				return
+			}
+
+			rc.onHead(func(status int, headers map[string]string, size int64) {
+				if !bodyAllowed(status) || headerValue(headers, "Content-Encoding") != "" {
+					return
+				}
+
+				if !cfg.compressible(headerValue(headers, "Content-Type")) {
+					return
+				}
+
+				// the body depends on the Accept-Encoding from here on, even when not compressed
+				addVary(headers, "Accept-Encoding")
+
+				if size >= 0 && size < cfg.minSize {
+					return
+				}
+
+				encoding := negotiateEncoding(props.header("Accept-Encoding"))
+				if encoding == "" {
+					return
+				}
+
+				setHeader(headers, "Content-Encoding", encoding)
+				rc.encodeWith(cfg.encoder(encoding))
+			})
+
+			next(props, conn)
+		}
+	}
+}
+
+func (cfg compressionConfig) compressible(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range cfg.contentTypes {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cfg compressionConfig) encoder(encoding string) func(w io.Writer) io.WriteCloser {
+	level := cfg.level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	return func(w io.Writer) io.WriteCloser {
+		var wc io.WriteCloser
+		var err error
+
+		if encoding == "gzip" {
+			wc, err = gzip.NewWriterLevel(w, level)
+		} else {
+			wc, err = zlib.NewWriterLevel(w, level)
+		}
+
+		if err != nil {
+			// only happens with an invalid level, which falls back to the default one
+			if encoding == "gzip" {
+				return gzip.NewWriter(w)
+			}
+			return zlib.NewWriter(w)
+		}
+
+		return wc
+	}
+}
+
+type acceptedEncoding struct {
+	coding string
+	q      float64
+}
+
+// negotiateEncoding picks the coding with the highest q-value among the ones we support, empty when
+// the identity should be sent
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	if len(accepted) == 0 {
+		return ""
+	}
+
+	qualities := make(map[string]float64, len(accepted))
+	for _, a := range accepted {
+		// the first occurrence wins when a coding is listed twice
+		if _, ok := qualities[a.coding]; !ok {
+			qualities[a.coding] = a.q
+		}
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, coding := range supportedEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// parseAcceptEncoding reads the codings of the header with their q-value, a q-value that is not valid counts as 0
+func parseAcceptEncoding(header string) []acceptedEncoding {
+	var accepted []acceptedEncoding
+
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, found := strings.Cut(param, "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		accepted = append(accepted, acceptedEncoding{coding: coding, q: q})
+	}
+
+	return accepted
+}
+
+// addVary adds the header name to the Vary header if it is not there yet
+func addVary(headers map[string]string, name string) {
+	vary := headerValue(headers, "Vary")
+
+	for _, v := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), name) || strings.TrimSpace(v) == "*" {
+			return
+		}
+	}
+
+	if vary == "" {
+		setHeader(headers, "Vary", name)
+	} else {
+		setHeader(headers, "Vary", vary+", "+name)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate":                 "deflate",
+		"gzip, deflate":           "gzip",
+		"gzip;q=0.5, deflate":     "deflate",
+		"gzip;q=0":                "",
+		"gzip;q=0, *":             "deflate",
+		"*;q=0.1":                 "gzip",
+		"br, zstd":                "",
+		"GZIP":                    "gzip",
+		"gzip, gzip":              "gzip",
+		"identity, gzip;q=0.0001": "gzip",
+	}
+
+	for header, expected := range cases {
+		if got := negotiateEncoding(header); got != expected {
+			t.Logf("Accept-Encoding %q should negotiate %q, got %q", header, expected, got)
+			t.Fail()
+		}
+	}
+}
+
+// compressedRequest runs the handler behind the compression middleware and parses what was written
+func compressedRequest(t *testing.T, cfg compressionConfig, acceptEncoding string, h handlerFunc) *http.Response {
+	props := &reqProps{
+		method:  "GET",
+		version: "HTTP/1.1",
+		request: &reqPath{path: "echo/abc"},
+		headers: map[string]string{"Accept-Encoding": acceptEncoding},
+	}
+
+	conn := &recordConn{}
+	rc := newResponseConn(conn, props)
+
+	compression(cfg)(h)(props, rc)
+	rc.finish()
+
+	res, err := http.ReadResponse(bufio.NewReader(&conn.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func textHandler(s *server, body string) handlerFunc {
+	return func(props *reqProps, conn net.Conn) {
+		s.writeResponse(200, map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": strconv.Itoa(len(body)),
+		}, body, conn)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := &server{paths: create()}
+	body := strings.Repeat("compress me ", 100)
+
+	t.Run("Should compress a whole body keeping the Content-Length right", func(t *testing.T) {
+		res := compressedRequest(t, compressionConfig{}, "gzip", textHandler(s, body))
+
+		if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Log("Response should be gzip encoded and vary on Accept-Encoding")
+			t.FailNow()
+		}
+
+		if res.ContentLength < 0 || res.ContentLength >= int64(len(body)) {
+			t.Logf("Content-Length should be the compressed size, was %d", res.ContentLength)
+			t.Fail()
+		}
+
+		r, _ := gzip.NewReader(res.Body)
+		decoded, _ := io.ReadAll(r)
+
+		if string(decoded) != body {
+			t.Log("Decoded body should be the original one")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should compress with deflate", func(t *testing.T) {
+		res := compressedRequest(t, compressionConfig{}, "deflate", textHandler(s, body))
+
+		r, err := zlib.NewReader(res.Body)
+		if err != nil {
+			t.Log("Body should be zlib encoded")
+			t.FailNow()
+		}
+		decoded, _ := io.ReadAll(r)
+
+		if string(decoded) != body {
+			t.Log("Decoded body should be the original one")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should compress a streamed body in chunks", func(t *testing.T) {
+		res := compressedRequest(t, compressionConfig{}, "gzip", func(props *reqProps, conn net.Conn) {
+			s.writeStream(200, map[string]string{"Content-Type": "text/plain"}, strings.NewReader(body), conn)
+		})
+
+		if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Log("Streamed response should be chunked")
+			t.Fail()
+		}
+
+		r, _ := gzip.NewReader(res.Body)
+		decoded, _ := io.ReadAll(r)
+
+		if string(decoded) != body {
+			t.Log("Decoded body should be the original one")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not compress small bodies or types outside of the allowlist", func(t *testing.T) {
+		res := compressedRequest(t, compressionConfig{minSize: 1 << 20}, "gzip", textHandler(s, body))
+
+		if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Log("Small body should not be compressed but still vary on Accept-Encoding")
+			t.Fail()
+		}
+
+		res = compressedRequest(t, compressionConfig{}, "gzip", func(props *reqProps, conn net.Conn) {
+			s.writeResponse(200, map[string]string{"Content-Type": "image/png"}, body, conn)
+		})
+
+		if res.Header.Get("Content-Encoding") != "" {
+			t.Log("Image should not be compressed")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not compress an already encoded body", func(t *testing.T) {
+		var buffer bytes.Buffer
+		w := gzip.NewWriter(&buffer)
+		w.Write([]byte(body))
+		w.Close()
+
+		res := compressedRequest(t, compressionConfig{}, "gzip", func(props *reqProps, conn net.Conn) {
+			s.writeResponse(200, map[string]string{
+				"Content-Type":     "text/plain",
+				"Content-Encoding": "gzip",
+			}, buffer.String(), conn)
+		})
+
+		r, _ := gzip.NewReader(res.Body)
+		decoded, _ := io.ReadAll(r)
+
+		if string(decoded) != body {
+			t.Log("Body should have been compressed only once")
+			t.Fail()
+		}
+	})
+}
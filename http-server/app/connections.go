@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAcceptQueue = 128
+	defaultRetryAfter  = 1
+	rejectWindow       = time.Second
+)
+
+// connectionLimits bound the connections served at once. Without workers every connection gets its
+// own goroutine, with them the accepted connections wait in a queue for a free worker. Connections
+// over the limits are answered 503 right away, zero values disable the limits
+type connectionLimits struct {
+	maxConnections int
+	workers        int
+	queue          int
+	retryAfter     int
+}
+
+type queuedConn struct {
+	conn     net.Conn
+	queuedAt time.Time
+}
+
+// serveConnection hands the accepted connection to a worker or to its own goroutine, unless the
+// server already has all the connections it can take
+func (s *server) serveConnection(conn net.Conn) {
+	s.connectionsOnce.Do(s.startWorkers)
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			go s.rejectConnection(conn)
+			return
+		}
+	}
+
+	if s.queue == nil {
+		go func() {
+			handleConnectionToServer(s, conn)
+			s.releaseSlot()
+		}()
+		return
+	}
+
+	select {
+	case s.queue <- queuedConn{conn: conn, queuedAt: time.Now()}:
+		if s.metrics != nil {
+			s.metrics.queuedConnections.Add(1)
+		}
+	default:
+		s.releaseSlot()
+		go s.rejectConnection(conn)
+	}
+}
+
+func (s *server) startWorkers() {
+	if s.connLimits.maxConnections > 0 {
+		s.slots = make(chan struct{}, s.connLimits.maxConnections)
+	}
+
+	if s.connLimits.workers <= 0 {
+		return
+	}
+
+	s.queue = make(chan queuedConn, s.connLimits.queue)
+
+	for i := 0; i < s.connLimits.workers; i++ {
+		go s.worker()
+	}
+}
+
+func (s *server) worker() {
+	for q := range s.queue {
+		if s.metrics != nil {
+			s.metrics.queuedConnections.Add(-1)
+			s.metrics.observeQueueWait(time.Since(q.queuedAt))
+		}
+
+		handleConnectionToServer(s, q.conn)
+		s.releaseSlot()
+	}
+}
+
+func (s *server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// rejectConnection answers 503 to a connection the server has no room for. What the client sent is
+// read for a moment before closing, closing with unread bytes would reset the connection and the
+// client could lose the response
+func (s *server) rejectConnection(conn net.Conn) {
+	defer conn.Close()
+
+	if s.metrics != nil {
+		s.metrics.rejectedConnections.Add(1)
+	}
+
+	retryAfter := s.connLimits.retryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+
+	conn.SetDeadline(time.Now().Add(rejectWindow))
+
+	_, err := conn.Write(buildHttpResponse(503, map[string]string{
+		"Retry-After":    strconv.Itoa(retryAfter),
+		"Connection":     "close",
+		"Content-Length": "0",
+	}, ""))
+	if err != nil {
+		return
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
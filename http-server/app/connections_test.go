@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// holdRequest starts a request on the hold route, the status line is sent on the channel
+func holdRequest(t *testing.T, addr string) chan string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	conn.Write([]byte("GET /hold HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	status := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		status <- line
+	}()
+
+	return status
+}
+
+func TestConnectionLimits(t *testing.T) {
+
+	// the requests of the hold route stay in their handler until release is closed
+	serve := func(t *testing.T, cl connectionLimits) (*server, string, chan struct{}, chan struct{}) {
+		s := routesServer(t)
+		s.connLimits = cl
+		s.metrics = newMetrics()
+
+		entered := make(chan struct{}, 10)
+		release := make(chan struct{})
+
+		s.registerHandler("hold", func(props *reqProps, conn net.Conn) {
+			entered <- struct{}{}
+			<-release
+			s.writeResponse(200, map[string]string{}, "", conn)
+		})
+
+		return s, listen(t, s, nil), entered, release
+	}
+
+	t.Run("Should answer 503 over the maximum of connections", func(t *testing.T) {
+		s, addr, entered, release := serve(t, connectionLimits{maxConnections: 1, retryAfter: 7})
+
+		first := holdRequest(t, addr)
+		<-entered
+
+		res := slowClient(t, addr, 0, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if !strings.HasPrefix(res, "HTTP/1.1 503 Service Unavailable") || !strings.Contains(res, "Retry-After:7") {
+			t.Logf("Should answer 503 with Retry-After, got %q", res)
+			t.Fail()
+		}
+
+		close(release)
+		if line := <-first; !strings.HasPrefix(line, "HTTP/1.1 200") {
+			t.Logf("The first connection should be answered, got %q", line)
+			t.Fail()
+		}
+
+		// the slot is given back once the connection is done
+		var res2 string
+		for i := 0; i < 50 && !strings.HasPrefix(res2, "HTTP/1.1 200"); i++ {
+			time.Sleep(10 * time.Millisecond)
+			res2 = slowClient(t, addr, 0, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		}
+		if !strings.HasPrefix(res2, "HTTP/1.1 200") {
+			t.Logf("Should serve connections again, got %q", res2)
+			t.Fail()
+		}
+
+		if s.metrics.rejectedConnections.Load() == 0 {
+			t.Log("The rejected connection should be counted")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should queue connections for the workers and refuse them once the queue is full", func(t *testing.T) {
+		s, addr, entered, release := serve(t, connectionLimits{workers: 1, queue: 1})
+
+		first := holdRequest(t, addr)
+		<-entered
+
+		second := holdRequest(t, addr)
+		for i := 0; i < 100 && s.metrics.queuedConnections.Load() != 1; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if s.metrics.queuedConnections.Load() != 1 {
+			t.Log("The second connection should wait in the queue")
+			t.FailNow()
+		}
+
+		res := slowClient(t, addr, 0, "GET /echo/x HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if !strings.HasPrefix(res, "HTTP/1.1 503") {
+			t.Logf("Should answer 503 with the queue full, got %q", res)
+			t.Fail()
+		}
+
+		close(release)
+
+		for _, status := range []chan string{first, second} {
+			if line := <-status; !strings.HasPrefix(line, "HTTP/1.1 200") {
+				t.Logf("Queued connections should be served, got %q", line)
+				t.Fail()
+			}
+		}
+
+		var b strings.Builder
+		s.metrics.writeTo(&b)
+		if !strings.Contains(b.String(), "http_connection_queue_wait_seconds_count 2\n") {
+			t.Log("The wait of both connections should be observed")
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cookieTimeLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+var errInvalidCookie = errors.New("the cookie is not valid")
+
+// cookie is a cookie as sent in Set-Cookie, RFC 6265 section 4.1. A maxAge above 0 is the seconds
+// the cookie lives, below 0 asks the browser to delete it right away and 0 leaves it out
+type cookie struct {
+	name     string
+	value    string
+	path     string
+	domain   string
+	expires  time.Time
+	maxAge   int
+	secure   bool
+	httpOnly bool
+	sameSite string
+}
+
+// serialize gives the Set-Cookie value of the cookie, refusing the names, values and attributes
+// browsers would misread
+func (c *cookie) serialize() (string, error) {
+	if !validCookieName(c.name) {
+		return "", fmt.Errorf("%w: the name %q is not a token", errInvalidCookie, c.name)
+	}
+	if !validCookieValue(c.value) {
+		return "", fmt.Errorf("%w: the value of %s has characters cookies can not hold", errInvalidCookie, c.name)
+	}
+
+	// the prefixes promise the browser how the cookie was set, RFC 6265bis section 4.1.3
+	if strings.HasPrefix(c.name, "__Secure-") && !c.secure {
+		return "", fmt.Errorf("%w: %s should be Secure", errInvalidCookie, c.name)
+	}
+	if strings.HasPrefix(c.name, "__Host-") && (!c.secure || c.path != "/" || c.domain != "") {
+		return "", fmt.Errorf("%w: %s should be Secure with the / Path and no Domain", errInvalidCookie, c.name)
+	}
+
+	var b strings.Builder
+	b.WriteString(c.name + "=" + c.value)
+
+	if c.path != "" {
+		if strings.ContainsFunc(c.path, func(r rune) bool { return r < ' ' || r == ';' || r == 0x7f }) {
+			return "", fmt.Errorf("%w: the path of %s is not valid", errInvalidCookie, c.name)
+		}
+		b.WriteString("; Path=" + c.path)
+	}
+
+	if c.domain != "" {
+		domain := strings.TrimPrefix(c.domain, ".")
+		if !validHost(domain) || strings.Contains(domain, ":") {
+			return "", fmt.Errorf("%w: the domain of %s is not valid", errInvalidCookie, c.name)
+		}
+		b.WriteString("; Domain=" + domain)
+	}
+
+	if !c.expires.IsZero() {
+		b.WriteString("; Expires=" + c.expires.UTC().Format(cookieTimeLayout))
+	}
+
+	if c.maxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.maxAge))
+	} else if c.maxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+
+	if c.secure {
+		b.WriteString("; Secure")
+	}
+	if c.httpOnly {
+		b.WriteString("; HttpOnly")
+	}
+
+	switch strings.ToLower(c.sameSite) {
+	case "":
+	case "lax":
+		b.WriteString("; SameSite=Lax")
+	case "strict":
+		b.WriteString("; SameSite=Strict")
+	case "none":
+		// browsers drop a SameSite=None cookie that is not Secure
+		if !c.secure {
+			return "", fmt.Errorf("%w: %s should be Secure to use SameSite=None", errInvalidCookie, c.name)
+		}
+		b.WriteString("; SameSite=None")
+	default:
+		return "", fmt.Errorf("%w: SameSite should be Lax, Strict or None, got %s", errInvalidCookie, c.sameSite)
+	}
+
+	return b.String(), nil
+}
+
+// setCookie adds the cookie to the response headers, each cookie is a Set-Cookie line of its own
+func setCookie(headers map[string]string, c *cookie) error {
+	line, err := c.serialize()
+	if err != nil {
+		return err
+	}
+
+	if existing := headerValue(headers, "Set-Cookie"); existing != "" {
+		line = existing + "\n" + line
+	}
+	setHeader(headers, "Set-Cookie", line)
+	return nil
+}
+
+// parseCookies reads the name=value pairs of a Cookie header, RFC 6265 section 5.4. The pairs
+// that are not valid are skipped so one bad cookie does not hide the others
+func parseCookies(header string) []cookie {
+	var cookies []cookie
+
+	for _, pair := range strings.Split(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !validCookieName(name) {
+			continue
+		}
+
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !validCookieValue(value) {
+			continue
+		}
+
+		cookies = append(cookies, cookie{name: name, value: value})
+	}
+
+	return cookies
+}
+
+// cookie gives the value of the request cookie, the first one wins when the browser sent the name
+// several times as it sends the cookie of the longest path first
+func (p *reqProps) cookie(name string) (string, bool) {
+	for _, c := range parseCookies(p.header("Cookie")) {
+		if c.name == name {
+			return c.value, true
+		}
+	}
+	return "", false
+}
+
+// validCookieName checks the name is a token, RFC 2616 section 2.2
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validCookieValue checks the value is made of cookie-octets, no spaces, quotes, commas,
+// semicolons or backslashes
+func validCookieValue(value string) bool {
+	for _, c := range value {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
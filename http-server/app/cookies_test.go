@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSerializeCookie(t *testing.T) {
+	t.Run("Should write the attributes in the order of RFC 6265", func(t *testing.T) {
+		c := &cookie{
+			name:     "id",
+			value:    "a3fWa",
+			path:     "/docs",
+			domain:   ".example.test",
+			expires:  time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+			maxAge:   3600,
+			secure:   true,
+			httpOnly: true,
+			sameSite: "strict",
+		}
+
+		line, err := c.serialize()
+		expected := "id=a3fWa; Path=/docs; Domain=example.test; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=Strict"
+		if err != nil || line != expected {
+			t.Logf("the cookie should be %q, got %q %v", expected, line, err)
+			t.Fail()
+		}
+
+		res := &http.Response{Header: http.Header{"Set-Cookie": {line}}}
+		if len(res.Cookies()) != 1 {
+			t.Fatalf("net/http should read the cookie back from %q", line)
+		}
+		parsed := res.Cookies()[0]
+		if parsed.Name != "id" || parsed.Value != "a3fWa" || parsed.MaxAge != 3600 || parsed.SameSite != http.SameSiteStrictMode {
+			t.Logf("net/http should read the cookie back, got %+v", parsed)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should ask the browser to delete a cookie with a negative max age", func(t *testing.T) {
+		c := &cookie{name: "id", maxAge: -1}
+
+		if line, _ := c.serialize(); line != "id=; Max-Age=0" {
+			t.Logf("the cookie should be deleted, got %q", line)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse what browsers would misread", func(t *testing.T) {
+		cookies := map[string]*cookie{
+			"a name with a space":        {name: "my id", value: "1"},
+			"an empty name":              {value: "1"},
+			"a value with a semicolon":   {name: "id", value: "1; Domain=evil.test"},
+			"a value with a space":       {name: "id", value: "a b"},
+			"a path with a semicolon":    {name: "id", value: "1", path: "/; Secure"},
+			"SameSite=None without TLS":  {name: "id", value: "1", sameSite: "None"},
+			"an unknown SameSite":        {name: "id", value: "1", sameSite: "Loose"},
+			"a __Secure- cookie":         {name: "__Secure-id", value: "1"},
+			"a __Host- cookie of a path": {name: "__Host-id", value: "1", secure: true, path: "/docs"},
+			"a domain with a port":       {name: "id", value: "1", domain: "example.test:80"},
+		}
+
+		for name, c := range cookies {
+			if _, err := c.serialize(); !errors.Is(err, errInvalidCookie) {
+				t.Logf("%s should be refused, got %v", name, err)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should write every cookie on a line of its own", func(t *testing.T) {
+		headers := map[string]string{}
+		setCookie(headers, &cookie{name: "a", value: "1"})
+		setCookie(headers, &cookie{name: "b", value: "2"})
+
+		if headers["Set-Cookie"] != "a=1\nb=2" {
+			t.Logf("the cookies should be separated by a new line, got %q", headers["Set-Cookie"])
+			t.Fail()
+		}
+	})
+}
+
+func TestParseCookies(t *testing.T) {
+	t.Run("Should read the pairs and unquote the values", func(t *testing.T) {
+		cookies := parseCookies(`theme=dark; id="a3fWa";lang=en`)
+
+		expected := []cookie{{name: "theme", value: "dark"}, {name: "id", value: "a3fWa"}, {name: "lang", value: "en"}}
+		if len(cookies) != len(expected) {
+			t.Fatalf("there should be %d cookies, got %+v", len(expected), cookies)
+		}
+		for i, c := range cookies {
+			if c.name != expected[i].name || c.value != expected[i].value {
+				t.Logf("cookie %d should be %+v, got %+v", i, expected[i], c)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should skip the invalid pairs and keep the others", func(t *testing.T) {
+		cookies := parseCookies(`bad name=1; novalue; ok=1; quote=a"b; =2`)
+
+		if len(cookies) != 1 || cookies[0].name != "ok" {
+			t.Logf("only ok should be read, got %+v", cookies)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should give the first of the cookies with the same name", func(t *testing.T) {
+		props := &reqProps{headers: map[string]string{"Cookie": "id=deep; id=shallow"}}
+
+		if v, ok := props.cookie("id"); !ok || v != "deep" {
+			t.Logf("the first cookie should win, got %q", v)
+			t.Fail()
+		}
+
+		if _, ok := props.cookie("missing"); ok {
+			t.Log("a missing cookie should not be found")
+			t.Fail()
+		}
+	})
+}
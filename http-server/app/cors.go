@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig describes the cross origin requests a route group accepts. Origins are exact like
+// https://app.test, patterns like https://*.app.test or * for any. Without headers the ones a
+// preflight asks for are all allowed, without methods the ones the route has are
+type corsConfig struct {
+	origins        []string
+	methods        []string
+	headers        []string
+	exposedHeaders []string
+	credentials    bool
+	maxAge         time.Duration
+}
+
+type corsPolicy struct {
+	cfg       corsConfig
+	anyOrigin bool
+	origins   map[string]bool
+	patterns  [][2]string
+}
+
+func newCorsPolicy(cfg corsConfig) *corsPolicy {
+	p := &corsPolicy{cfg: cfg, origins: make(map[string]bool)}
+
+	for _, o := range cfg.origins {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "*"):
+			prefix, suffix, _ := strings.Cut(o, "*")
+			p.patterns = append(p.patterns, [2]string{prefix, suffix})
+		default:
+			p.origins[o] = true
+		}
+	}
+
+	return p
+}
+
+// cors lets the route and every route below it be called from the origins of the config, the
+// preflight requests are answered by the router from the methods the routes have. Any origin can
+// not be allowed with credentials, every website could then read the responses of the users
+func (s *server) cors(path string, cfg corsConfig) error {
+	p := newCorsPolicy(cfg)
+	if p.anyOrigin && cfg.credentials {
+		return fmt.Errorf("the cors group %s can not allow any origin with credentials, list its origins", path)
+	}
+
+	s.nodeFor(path).cors = p
+	return nil
+}
+
+// corsPolicy gives the policy of the closest group the node is in, nil when there is none
+func (n *node) corsPolicy() *corsPolicy {
+	for c := n; c != nil; c = c.parent {
+		if c.cors != nil {
+			return c.cors
+		}
+	}
+	return nil
+}
+
+func (p *corsPolicy) allowedOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+
+	for _, pattern := range p.patterns {
+		prefix, suffix := pattern[0], pattern[1]
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originHeaders sets the headers every response to an allowed origin carries
+func (p *corsPolicy) originHeaders(origin string, headers map[string]string) {
+	if p.anyOrigin {
+		setHeader(headers, "Access-Control-Allow-Origin", "*")
+	} else {
+		setHeader(headers, "Access-Control-Allow-Origin", origin)
+		addVary(headers, "Origin")
+	}
+
+	if p.cfg.credentials {
+		setHeader(headers, "Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// isPreflight tells if the request is a browser asking if it may send the real one
+func isPreflight(props *reqProps) bool {
+	return props.method == "OPTIONS" && props.header("Origin") != "" && props.header("Access-Control-Request-Method") != ""
+}
+
+// preflight answers the preflight of the route, the methods allowed are the ones of its method
+// table when it has one, restricted to the methods of the config when it lists some
+func (s *server) preflight(n *node, p *corsPolicy, props *reqProps, conn net.Conn) {
+	origin := props.header("Origin")
+	headers := make(map[string]string)
+	addVary(headers, "Origin")
+	addVary(headers, "Access-Control-Request-Method")
+	addVary(headers, "Access-Control-Request-Headers")
+
+	methods := p.cfg.methods
+	if len(n.methods) > 0 {
+		methods = nil
+		for m := range n.methods {
+			if len(p.cfg.methods) == 0 || containsFold(p.cfg.methods, m) {
+				methods = append(methods, m)
+			}
+		}
+		sort.Strings(methods)
+	} else if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+
+	var requestedHeaders []string
+	headersAllowed := true
+	for _, h := range strings.Split(props.header("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if len(p.cfg.headers) > 0 && !containsFold(p.cfg.headers, h) {
+			headersAllowed = false
+		}
+		requestedHeaders = append(requestedHeaders, h)
+	}
+
+	if !p.allowedOrigin(origin) || !containsFold(methods, props.header("Access-Control-Request-Method")) || !headersAllowed {
+		headers["Content-Length"] = "0"
+		s.writeResponse(403, headers, "", conn)
+		return
+	}
+
+	p.originHeaders(origin, headers)
+	headers["Access-Control-Allow-Methods"] = strings.Join(methods, ", ")
+	if len(requestedHeaders) > 0 {
+		headers["Access-Control-Allow-Headers"] = strings.Join(requestedHeaders, ", ")
+	}
+	if p.cfg.maxAge > 0 {
+		headers["Access-Control-Max-Age"] = strconv.Itoa(int(p.cfg.maxAge.Seconds()))
+	}
+
+	if s.writeResponse(204, headers, "", conn) == -1 {
+		fmt.Println("we could not answer the request")
+	}
+}
+
+// corsHeaders adds the headers of the policy to the response of a cross origin request
+func corsHeaders(p *corsPolicy) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			origin := props.header("Origin")
+
+			if rc, ok := conn.(*responseConn); ok && origin != "" {
+				rc.onHead(func(status int, headers map[string]string, size int64) {
+					if !p.allowedOrigin(origin) {
+						addVary(headers, "Origin")
+						return
+					}
+
+					p.originHeaders(origin, headers)
+					if len(p.cfg.exposedHeaders) > 0 {
+						setHeader(headers, "Access-Control-Expose-Headers", strings.Join(p.cfg.exposedHeaders, ", "))
+					}
+				})
+			}
+
+			next(props, conn)
+		}
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCorsGroups reads the path=origin,origin values of the -cors flag
+func parseCorsGroups(values []string) (map[string][]string, error) {
+	groups := make(map[string][]string, len(values))
+
+	for _, v := range values {
+		path, origins, found := strings.Cut(v, "=")
+		if !found || origins == "" {
+			return nil, fmt.Errorf("cors group %s should be written path=origin,origin", v)
+		}
+
+		groups[strings.Trim(path, "/")] = splitList(origins)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func corsRequest(t *testing.T, addr string, method string, path string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func TestCors(t *testing.T) {
+	serve := func(t *testing.T, cfg corsConfig) string {
+		return listen(t, testServer(t, func(s *server) error {
+			ok := func(props *reqProps, conn net.Conn) {
+				s.writeResponse(200, map[string]string{"Content-Length": "0", "X-Total": "3"}, "", conn)
+			}
+
+			for _, method := range []string{"GET", "PUT", "DELETE"} {
+				if err := s.registerMethodHandler(method, "api/items", ok); err != nil {
+					return err
+				}
+			}
+			if err := s.registerHandler("public", ok); err != nil {
+				return err
+			}
+
+			if err := s.cors("api", cfg); err != nil {
+				return err
+			}
+
+			// a route refusing every request shows the preflights are answered before the route middlewares
+			s.useOn("api/items", func(next handlerFunc) handlerFunc {
+				return func(props *reqProps, conn net.Conn) {
+					if props.header("Authorization") == "" {
+						s.writeResponse(401, map[string]string{"Content-Length": "0"}, "", conn)
+						return
+					}
+					next(props, conn)
+				}
+			})
+
+			return nil
+		}), nil)
+	}
+
+	addr := serve(t, corsConfig{
+		origins:        []string{"https://app.test", "https://*.preview.test"},
+		methods:        []string{"GET", "PUT"},
+		headers:        []string{"Authorization", "Content-Type"},
+		exposedHeaders: []string{"X-Total"},
+		credentials:    true,
+		maxAge:         10 * time.Minute,
+	})
+
+	t.Run("Should answer the preflight from the method table of the route", func(t *testing.T) {
+		res := corsRequest(t, addr, "OPTIONS", "/api/items", map[string]string{
+			"Origin":                         "https://app.test",
+			"Access-Control-Request-Method":  "PUT",
+			"Access-Control-Request-Headers": "authorization, content-type",
+		})
+
+		if res.StatusCode != 204 {
+			t.Logf("the preflight should be answered 204 before the route middlewares, got %d", res.StatusCode)
+			t.FailNow()
+		}
+
+		expected := map[string]string{
+			"Access-Control-Allow-Origin":      "https://app.test",
+			"Access-Control-Allow-Methods":     "GET, PUT",
+			"Access-Control-Allow-Headers":     "authorization, content-type",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Max-Age":           "600",
+		}
+		for name, value := range expected {
+			if res.Header.Get(name) != value {
+				t.Logf("%s should be %q, got %q", name, value, res.Header.Get(name))
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse the preflight of a method the route or the config does not allow", func(t *testing.T) {
+		res := corsRequest(t, addr, "OPTIONS", "/api/items", map[string]string{
+			"Origin":                        "https://app.test",
+			"Access-Control-Request-Method": "DELETE",
+		})
+
+		if res.StatusCode != 403 || res.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Logf("a method out of the config should be refused, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse the preflight of a header out of the config", func(t *testing.T) {
+		res := corsRequest(t, addr, "OPTIONS", "/api/items", map[string]string{
+			"Origin":                         "https://app.test",
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "X-Secret",
+		})
+
+		if res.StatusCode != 403 {
+			t.Logf("a header out of the config should be refused, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse the preflight of an unknown origin", func(t *testing.T) {
+		for _, origin := range []string{"https://evil.test", "https://a.preview.test.evil.test", "http://a.preview.test", "https://preview.test"} {
+			res := corsRequest(t, addr, "OPTIONS", "/api/items", map[string]string{
+				"Origin":                        origin,
+				"Access-Control-Request-Method": "GET",
+			})
+
+			if res.StatusCode != 403 {
+				t.Logf("the origin %s should be refused, got %d", origin, res.StatusCode)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should add the headers to the responses of an allowed origin", func(t *testing.T) {
+		res := corsRequest(t, addr, "GET", "/api/items", map[string]string{
+			"Origin":        "https://pr-12.preview.test",
+			"Authorization": "Bearer token",
+		})
+
+		if res.StatusCode != 200 || res.Header.Get("Access-Control-Allow-Origin") != "https://pr-12.preview.test" {
+			t.Logf("the origin should be allowed, got %d %q", res.StatusCode, res.Header.Get("Access-Control-Allow-Origin"))
+			t.Fail()
+		}
+
+		if res.Header.Get("Access-Control-Expose-Headers") != "X-Total" || res.Header.Get("Vary") != "Origin" {
+			t.Logf("the exposed headers and Vary should be set, got %v", res.Header)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should add the headers to the responses refused by the route middlewares", func(t *testing.T) {
+		res := corsRequest(t, addr, "GET", "/api/items", map[string]string{"Origin": "https://app.test"})
+
+		if res.StatusCode != 401 || res.Header.Get("Access-Control-Allow-Origin") != "https://app.test" {
+			t.Logf("the browser should be able to read the 401, got %d %v", res.StatusCode, res.Header)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not add the headers for an unknown origin", func(t *testing.T) {
+		res := corsRequest(t, addr, "GET", "/api/items", map[string]string{
+			"Origin":        "https://evil.test",
+			"Authorization": "Bearer token",
+		})
+
+		if res.Header.Get("Access-Control-Allow-Origin") != "" || res.Header.Get("Vary") != "Origin" {
+			t.Logf("an unknown origin should get no cors headers, got %v", res.Header)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should leave the routes out of the group alone", func(t *testing.T) {
+		res := corsRequest(t, addr, "GET", "/public", map[string]string{"Origin": "https://app.test"})
+
+		if res.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Log("a route out of the group should get no cors headers")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer any origin with a star without credentials", func(t *testing.T) {
+		addr := serve(t, corsConfig{origins: []string{"*"}})
+
+		res := corsRequest(t, addr, "GET", "/api/items", map[string]string{
+			"Origin":        "https://anywhere.test",
+			"Authorization": "Bearer token",
+		})
+
+		if res.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Logf("any origin should be answered with *, got %q", res.Header.Get("Access-Control-Allow-Origin"))
+			t.Fail()
+		}
+	})
+	t.Run("Should refuse any origin with credentials", func(t *testing.T) {
+		s := &server{paths: create()}
+		rootCreation(s)
+
+		if err := s.cors("api", corsConfig{origins: []string{"https://app.test", "*"}, credentials: true}); err == nil {
+			t.Log("allowing any origin with credentials should be refused")
+			t.Fail()
+		}
+
+		if s.nodeFor("api").cors != nil {
+			t.Log("the refused group should not be set")
+			t.Fail()
+		}
+	})
+}
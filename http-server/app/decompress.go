@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("the content encoding is not supported")
+	errBodyTooLarge        = errors.New("the request body is bigger than allowed")
+)
+
+// decompression decodes gzip and deflate request bodies before the handler sees them, maxSize bounds
+// the decoded body so a small compressed body can not blow up in memory. It runs after the
+// other middlewares so a signature is checked over the bytes the client sent, and a streamed
+// body is decoded as the handler reads it
+func (s *server) decompression(maxSize int64) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			encoding := props.header("Content-Encoding")
+			if encoding == "" {
+				next(props, conn)
+				return
+			}
+
+			streamed := props.bodyReader != nil
+			decoded, err := decodingReader(props.bodyStream(), encoding, maxSize)
+
+			var body []byte
+			if err == nil && !streamed {
+				body, err = io.ReadAll(decoded)
+			}
+
+			if errors.Is(err, errUnsupportedEncoding) {
+				var headers = map[string]string{
+					"Accept-Encoding": strings.Join(supportedEncodings, ", "),
+				}
+				s.writeResponse(415, headers, "", conn)
+				return
+			}
+
+			if errors.Is(err, errBodyTooLarge) {
+				s.writeResponse(413, map[string]string{"Connection": "close"}, "", conn)
+				return
+			}
+
+			if err != nil {
+				fmt.Println("Error while decoding the request body : ", err.Error())
+				s.writeResponse(400, map[string]string{}, "", conn)
+				return
+			}
+
+			deleteHeader(props.headers, "Content-Encoding")
+			if streamed {
+				// the decoded length is only known once the handler read it all
+				props.bodyReader = decoded
+				deleteHeader(props.headers, "Content-Length")
+			} else {
+				props.body = body
+				setHeader(props.headers, "Content-Length", strconv.Itoa(len(body)))
+			}
+
+			next(props, conn)
+		}
+	}
+}
+
+// decodingReader undoes the codings of the Content-Encoding as the body is read, they are listed
+// in the order they were applied. Reading past maxSize decoded bytes gives errBodyTooLarge
+func decodingReader(body io.Reader, contentEncoding string, maxSize int64) (io.Reader, error) {
+	codings := strings.Split(contentEncoding, ",")
+
+	// an unsupported coding is refused before anything is read
+	for _, coding := range codings {
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "identity", "", "gzip", "x-gzip", "deflate":
+		default:
+			return nil, errUnsupportedEncoding
+		}
+	}
+
+	r := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = deflateReader(r)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sizeLimitedReader{r: r, left: maxSize}, nil
+}
+
+// sizeLimitedReader gives errBodyTooLarge instead of the bytes past its limit
+type sizeLimitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// reading one byte more than allowed tells a body at the limit apart from a bigger one
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n + int(l.left), errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// deflateReader reads the zlib format the spec asks for, falling back to raw deflate as some
+// clients send it. A zlib stream is told apart by its two bytes header
+func deflateReader(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+// bodyErrorStatus gives the status answering a request whose streamed body could not be read,
+// 0 when it is not the fault of the client
+func bodyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return 413
+	case errors.Is(err, errRequestTimeout):
+		return 408
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.Is(err, zlib.ErrChecksum),
+		errors.Is(err, zlib.ErrHeader), errors.Is(err, io.ErrUnexpectedEOF):
+		return 400
+	}
+
+	var corrupt flate.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return 400
+	}
+	return 0
+}
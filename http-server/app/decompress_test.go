@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func gzipBytes(b []byte) []byte {
+	var buffer bytes.Buffer
+	w := gzip.NewWriter(&buffer)
+	w.Write(b)
+	w.Close()
+	return buffer.Bytes()
+}
+
+func decodedRequest(maxSize int64, encoding string, body []byte) (*recordConn, []byte) {
+	s := &server{paths: create()}
+	props := &reqProps{
+		method:  "POST",
+		request: &reqPath{path: "files/a"},
+		headers: map[string]string{"Content-Encoding": encoding},
+		body:    body,
+	}
+
+	var received []byte
+	conn := &recordConn{}
+	s.decompression(maxSize)(func(props *reqProps, conn net.Conn) {
+		received = props.body
+		s.writeResponse(201, map[string]string{}, "", conn)
+	})(props, conn)
+
+	return conn, received
+}
+
+func TestDecompression(t *testing.T) {
+	body := bytes.Repeat([]byte("decode me "), 100)
+
+	t.Run("Should decode a gzip body", func(t *testing.T) {
+		res, received := decodedRequest(1<<20, "gzip", gzipBytes(body))
+
+		if res.status() != 201 || !bytes.Equal(received, body) {
+			t.Log("Handler should receive the decoded body")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should decode a deflate body", func(t *testing.T) {
+		var buffer bytes.Buffer
+		w := zlib.NewWriter(&buffer)
+		w.Write(body)
+		w.Close()
+
+		res, received := decodedRequest(1<<20, "deflate", buffer.Bytes())
+
+		if res.status() != 201 || !bytes.Equal(received, body) {
+			t.Log("Handler should receive the decoded body")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should decode every coding in reverse order", func(t *testing.T) {
+		res, received := decodedRequest(1<<20, "gzip, gzip", gzipBytes(gzipBytes(body)))
+
+		if res.status() != 201 || !bytes.Equal(received, body) {
+			t.Log("Handler should receive the decoded body")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse bodies that decode above the limit", func(t *testing.T) {
+		bomb := gzipBytes(make([]byte, 10<<20))
+
+		res, received := decodedRequest(1<<20, "gzip", bomb)
+
+		if res.status() != 413 || received != nil {
+			t.Logf("Status should be 413, was %d", res.status())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse unsupported encodings", func(t *testing.T) {
+		res, _ := decodedRequest(1<<20, "br", body)
+
+		if res.status() != 415 {
+			t.Logf("Status should be 415, was %d", res.status())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse corrupted bodies", func(t *testing.T) {
+		res, _ := decodedRequest(1<<20, "gzip", body)
+
+		if res.status() != 400 {
+			t.Logf("Status should be 400, was %d", res.status())
+			t.Fail()
+		}
+	})
+}
+
+func TestDecompressionRoutes(t *testing.T) {
+	body := bytes.Repeat([]byte("decode me "), 100)
+	encoded := gzipBytes(body)
+
+	addr := listen(t, testServer(t, func(s *server) error {
+		s.useLast(s.decompression(1 << 20))
+
+		echoLength := func(props *reqProps, conn net.Conn) {
+			n, err := io.Copy(io.Discard, props.bodyStream())
+			if status := bodyErrorStatus(err); status != 0 {
+				s.writeResponse(status, map[string]string{"Connection": "close"}, "", conn)
+				return
+			}
+			length := strconv.FormatInt(n, 10)
+			s.writeResponse(200, map[string]string{"Content-Length": strconv.Itoa(len(length))}, length, conn)
+		}
+
+		// like a signature check, the other middlewares see the body as it was sent
+		s.use(func(next handlerFunc) handlerFunc {
+			return func(props *reqProps, conn net.Conn) {
+				if props.request.path == "checked" && (props.header("Content-Encoding") != "gzip" || !bytes.Equal(props.body, encoded)) {
+					s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", conn)
+					return
+				}
+				next(props, conn)
+			}
+		})
+		if err := s.registerHandler("checked", echoLength); err != nil {
+			return err
+		}
+
+		s.streamBody("stream")
+		return s.registerHandler("stream", echoLength)
+	}), nil)
+
+	post := func(t *testing.T, path string, sent []byte) (int, string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("POST /" + path + " HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(len(sent)) + "\r\n\r\n"))
+		conn.Write(sent)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	t.Run("Should decode the body after the other middlewares", func(t *testing.T) {
+		status, length := post(t, "checked", encoded)
+		if status != 200 || length != strconv.Itoa(len(body)) {
+			t.Logf("the middleware should see the body as sent and the handler the decoded one, got %d %s", status, length)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should decode a streamed body as the handler reads it", func(t *testing.T) {
+		status, length := post(t, "stream", encoded)
+		if status != 200 || length != strconv.Itoa(len(body)) {
+			t.Logf("the handler should read the decoded body, got %d %s", status, length)
+			t.Fail()
+		}
+
+		if status, _ := post(t, "stream", gzipBytes(make([]byte, 10<<20))); status != 413 {
+			t.Logf("a streamed body decoding above the limit should be answered 413, got %d", status)
+			t.Fail()
+		}
+	})
+}
+
+func TestDecodingReader(t *testing.T) {
+	t.Run("Should stop one byte past the limit", func(t *testing.T) {
+		r, err := decodingReader(bytes.NewReader(gzipBytes(make([]byte, 100))), "gzip", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := io.ReadAll(r)
+		if !errors.Is(err, errBodyTooLarge) || len(decoded) != 10 {
+			t.Logf("should read 10 bytes then errBodyTooLarge, got %d %v", len(decoded), err)
+			t.Fail()
+		}
+	})
+}
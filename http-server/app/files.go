@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	filesRoute  = "files/{filename}"
+	uploadRoute = "files"
+)
+
+func (s *server) registerFileRoutes() error {
+	handlers := map[string]func(props *reqProps, conn net.Conn){
+		"GET":    s.getFile,
+		"POST":   s.createFile,
+		"PUT":    s.replaceFile,
+		"DELETE": s.deleteFile,
+		"PATCH":  s.appendFile,
+	}
+
+	for method, h := range handlers {
+		if err := s.registerMethodHandler(method, filesRoute, h); err != nil {
+			return err
+		}
+	}
+
+	// the uploaded files go to the multipart reader as they arrive, so the ones above the form
+	// memory are written to disk without being held in memory first
+	s.streamBody(uploadRoute)
+
+	return s.registerMethodHandler("POST", uploadRoute, s.uploadFiles)
+}
+
+func (s *server) getFile(props *reqProps, conn net.Conn) {
+	path, ok := s.filePath(props, conn)
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		fmt.Printf("File %s was not found: %s", path, err.Error())
+		s.writeResponse(404, map[string]string{}, "", conn)
+		return
+	}
+
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+			fmt.Println("Error while closing the file : ", err.Error())
+		}
+	}(f)
+
+	stat, statErr := f.Stat()
+
+	if statErr != nil || stat.IsDir() {
+		s.writeResponse(404, map[string]string{}, "", conn)
+		return
+	}
+
+	var headers = map[string]string{
+		"Content-type":   "application/octet-stream",
+		"Content-Length": strconv.FormatInt(stat.Size(), 10),
+	}
+
+	// the body is copied straight from the file into the connection, for a tcp connection
+	// this lets the kernel do the work with sendfile/splice instead of us going through a buffer
+	b := s.writeStream(200, headers, f, conn)
+
+	if b == -1 {
+		fmt.Println("we could not answer the request")
+	}
+}
+
+// createFile writes the body as the whole content of the file, replacing it if it exists
+func (s *server) createFile(props *reqProps, conn net.Conn) {
+	path, ok := s.filePath(props, conn)
+	if !ok {
+		return
+	}
+
+	s.filesMu.Lock()
+	err := writeFileAtomic(path, props.bodyStream())
+	s.filesMu.Unlock()
+
+	if status := bodyErrorStatus(err); status != 0 {
+		s.writeResponse(status, map[string]string{"Connection": "close"}, "", conn)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error while creating the file : ", err.Error())
+		s.writeInternalError(conn)
+		return
+	}
+
+	s.writeResponse(201, map[string]string{}, "", conn)
+}
+
+// replaceFile answers 201 when the file did not exist and 204 when its content was replaced
+func (s *server) replaceFile(props *reqProps, conn net.Conn) {
+	path, ok := s.filePath(props, conn)
+	if !ok {
+		return
+	}
+
+	s.filesMu.Lock()
+	_, statErr := os.Stat(path)
+	existed := statErr == nil
+	err := writeFileAtomic(path, props.bodyStream())
+	s.filesMu.Unlock()
+
+	if status := bodyErrorStatus(err); status != 0 {
+		s.writeResponse(status, map[string]string{"Connection": "close"}, "", conn)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error while replacing the file : ", err.Error())
+		s.writeInternalError(conn)
+		return
+	}
+
+	if existed {
+		s.writeResponse(204, map[string]string{}, "", conn)
+	} else {
+		s.writeResponse(201, map[string]string{}, "", conn)
+	}
+}
+
+func (s *server) deleteFile(props *reqProps, conn net.Conn) {
+	path, ok := s.filePath(props, conn)
+	if !ok {
+		return
+	}
+
+	s.filesMu.Lock()
+	err := os.Remove(path)
+	s.filesMu.Unlock()
+
+	if errors.Is(err, fs.ErrNotExist) {
+		s.writeResponse(404, map[string]string{}, "", conn)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("Error while deleting the file : ", err.Error())
+		s.writeInternalError(conn)
+		return
+	}
+
+	s.writeResponse(204, map[string]string{}, "", conn)
+}
+
+// appendFile adds the body at the end of an existing file, the new content is still written to
+// a temporary file first so a failed append never leaves the file half written
+func (s *server) appendFile(props *reqProps, conn net.Conn) {
+	path, ok := s.filePath(props, conn)
+	if !ok {
+		return
+	}
+
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+
+	f, err := os.Open(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		s.writeResponse(404, map[string]string{}, "", conn)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("Error while opening the file : ", err.Error())
+		s.writeInternalError(conn)
+		return
+	}
+
+	err = writeFileAtomic(path, f, props.bodyStream())
+	f.Close()
+
+	if status := bodyErrorStatus(err); status != 0 {
+		s.writeResponse(status, map[string]string{"Connection": "close"}, "", conn)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error while appending to the file : ", err.Error())
+		s.writeInternalError(conn)
+		return
+	}
+
+	s.writeResponse(204, map[string]string{}, "", conn)
+}
+
+// uploadFiles saves every file of a multipart form into the directory, the response lists the
+// names the files were saved with
+func (s *server) uploadFiles(props *reqProps, conn net.Conn) {
+	f, err := parseForm(props, s.formMemory)
+
+	if errors.Is(err, errUnsupportedForm) || (err == nil && f.parts == nil) {
+		s.writeResponse(415, map[string]string{}, "", conn)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("Error while reading the form : ", err.Error())
+		s.writeResponse(400, map[string]string{}, "", conn)
+		return
+	}
+
+	defer func(f *form) {
+		err := f.removeAll()
+		if err != nil {
+			fmt.Println("Error while removing the form files : ", err.Error())
+		}
+	}(f)
+
+	var saved []string
+	for _, headers := range f.files {
+		for _, header := range headers {
+			name := filepath.Base(header.Filename)
+			if name == "." || name == ".." || name == string(filepath.Separator) {
+				continue
+			}
+
+			if saveErr := s.saveUpload(header, filepath.Join(s.directory, name)); saveErr != nil {
+				fmt.Println("Error while saving the uploaded file : ", saveErr.Error())
+				s.writeInternalError(conn)
+				return
+			}
+			saved = append(saved, name)
+		}
+	}
+
+	if len(saved) == 0 {
+		s.writeResponse(400, map[string]string{}, "", conn)
+		return
+	}
+
+	sort.Strings(saved)
+	body := strings.Join(saved, "\n")
+
+	var headers = map[string]string{
+		"Content-Type":   "text/plain",
+		"Content-Length": strconv.Itoa(len(body)),
+	}
+	s.writeResponse(201, headers, body, conn)
+}
+
+func (s *server) saveUpload(header *multipart.FileHeader, path string) error {
+	part, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+
+	return writeFileAtomic(path, part)
+}
+
+// filePath resolves the file of the request inside the served directory, names that would point
+// outside of it are answered with 400
+func (s *server) filePath(props *reqProps, conn net.Conn) (string, bool) {
+	filename := props.request.params[0]
+
+	if filename == "" || filename == "." || filename == ".." {
+		s.writeResponse(400, map[string]string{}, "", conn)
+		return "", false
+	}
+
+	return filepath.Join(s.directory, filename), true
+}
+
+func (s *server) writeInternalError(conn net.Conn) {
+	var errHeaders = map[string]string{
+		"Content-Type": "text/plain",
+	}
+	s.writeResponse(500, errHeaders, "Internal Error", conn)
+}
+
+// writeFileAtomic writes the content into a temporary file of the same directory and renames it
+// over the destination, readers either see the previous file or the new one and never a partial write
+func writeFileAtomic(path string, content ...io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	// nothing to clean when the rename went through, the temporary file does not exist anymore
+	defer os.Remove(tmp.Name())
+
+	mode := fs.FileMode(0644)
+	if stat, statErr := os.Stat(path); statErr == nil {
+		mode = stat.Mode().Perm()
+	}
+
+	if _, err = io.Copy(tmp, io.MultiReader(content...)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordConn keeps everything the handlers write so the response can be inspected
+type recordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func (c *recordConn) status() int {
+	parts := strings.SplitN(c.out.String(), " ", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	status, _ := strconv.Atoi(parts[1])
+	return status
+}
+
+func fileServer(t *testing.T) *server {
+	s := &server{
+		paths:     create(),
+		directory: t.TempDir(),
+	}
+	rootCreation(s)
+
+	if err := s.registerFileRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func doRequest(s *server, method string, path string, body string) *recordConn {
+	conn := &recordConn{}
+	s.req = &reqProps{
+		method: method,
+		request: &reqPath{
+			path:   path,
+			params: nil,
+		},
+		headers: make(map[string]string),
+		body:    []byte(body),
+	}
+
+	if err := s.handle(conn); err != nil {
+		s.writeResponse(404, make(map[string]string), "", conn)
+	}
+
+	return conn
+}
+
+func TestFiles(t *testing.T) {
+
+	t.Run("Should replace the whole content when posting over a longer file", func(t *testing.T) {
+		s := fileServer(t)
+
+		doRequest(s, "POST", "files/a.txt", "a longer content")
+		res := doRequest(s, "POST", "files/a.txt", "short")
+
+		if res.status() != 201 {
+			t.Logf("Status should be 201, was %d", res.status())
+			t.Fail()
+		}
+
+		content, _ := os.ReadFile(filepath.Join(s.directory, "a.txt"))
+		if string(content) != "short" {
+			t.Logf("File should only have the new content, has %q", content)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 201 when putting a new file and 204 when replacing it", func(t *testing.T) {
+		s := fileServer(t)
+
+		if res := doRequest(s, "PUT", "files/b.txt", "first"); res.status() != 201 {
+			t.Logf("Status should be 201, was %d", res.status())
+			t.Fail()
+		}
+
+		if res := doRequest(s, "PUT", "files/b.txt", "second"); res.status() != 204 {
+			t.Logf("Status should be 204, was %d", res.status())
+			t.Fail()
+		}
+
+		content, _ := os.ReadFile(filepath.Join(s.directory, "b.txt"))
+		if string(content) != "second" {
+			t.Logf("File should have the replaced content, has %q", content)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should append to an existing file", func(t *testing.T) {
+		s := fileServer(t)
+
+		doRequest(s, "POST", "files/c.txt", "abc")
+
+		if res := doRequest(s, "PATCH", "files/c.txt", "def"); res.status() != 204 {
+			t.Logf("Status should be 204, was %d", res.status())
+			t.Fail()
+		}
+
+		content, _ := os.ReadFile(filepath.Join(s.directory, "c.txt"))
+		if string(content) != "abcdef" {
+			t.Logf("File should have the appended content, has %q", content)
+			t.Fail()
+		}
+
+		if res := doRequest(s, "PATCH", "files/missing.txt", "def"); res.status() != 404 {
+			t.Logf("Status should be 404 for a missing file, was %d", res.status())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should delete a file", func(t *testing.T) {
+		s := fileServer(t)
+
+		doRequest(s, "POST", "files/d.txt", "abc")
+
+		if res := doRequest(s, "DELETE", "files/d.txt", ""); res.status() != 204 {
+			t.Logf("Status should be 204, was %d", res.status())
+			t.Fail()
+		}
+
+		if res := doRequest(s, "GET", "files/d.txt", ""); res.status() != 404 {
+			t.Logf("Status should be 404 after deleting, was %d", res.status())
+			t.Fail()
+		}
+
+		if res := doRequest(s, "DELETE", "files/d.txt", ""); res.status() != 404 {
+			t.Logf("Status should be 404 for a missing file, was %d", res.status())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not leave temporary files behind", func(t *testing.T) {
+		s := fileServer(t)
+
+		doRequest(s, "POST", "files/e.txt", "abc")
+		doRequest(s, "PATCH", "files/e.txt", "def")
+
+		entries, _ := os.ReadDir(s.directory)
+		if len(entries) != 1 {
+			t.Logf("Directory should only have the file, has %d entries", len(entries))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 405 with the allowed methods", func(t *testing.T) {
+		s := fileServer(t)
+
+		res := doRequest(s, "HEAD", "files/f.txt", "")
+
+		if res.status() != 405 {
+			t.Logf("Status should be 405, was %d", res.status())
+			t.Fail()
+		}
+
+		if !strings.Contains(res.out.String(), "Allow:DELETE, GET, PATCH, POST, PUT") {
+			t.Log("Response should list the allowed methods")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should save every file of a multipart upload", func(t *testing.T) {
+		s := fileServer(t)
+
+		contentType, body := multipartBody(t, nil, map[string]string{"one.txt": "1", "two.txt": "22"})
+		s.req = &reqProps{
+			method:  "POST",
+			request: &reqPath{path: "files"},
+			headers: map[string]string{"Content-Type": contentType},
+			body:    body,
+		}
+		res := &recordConn{}
+		s.handle(res)
+
+		if res.status() != 201 {
+			t.Logf("Status should be 201, was %d", res.status())
+			t.Fail()
+		}
+
+		two, _ := os.ReadFile(filepath.Join(s.directory, "two.txt"))
+		if string(two) != "22" {
+			t.Logf("Uploaded file should have been saved, has %q", two)
+			t.Fail()
+		}
+
+		if res := doRequest(s, "POST", "files", "not a form"); res.status() != 415 {
+			t.Logf("Status should be 415 without a multipart body, was %d", res.status())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should stream an upload larger than the form memory from the connection", func(t *testing.T) {
+		s := fileServer(t)
+		s.formMemory = 1024
+
+		content := strings.Repeat("u", 256<<10)
+		contentType, body := multipartBody(t, nil, map[string]string{"big.txt": content})
+
+		client, peer := net.Pipe()
+		defer client.Close()
+		go handleConnectionToServer(s, peer)
+
+		go func() {
+			client.Write([]byte("POST /files HTTP/1.1\r\nHost: localhost\r\nContent-Type: " + contentType + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"))
+			client.Write(body)
+		}()
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		res, _ := io.ReadAll(client)
+		if !strings.HasPrefix(string(res), "HTTP/1.1 201") {
+			t.Logf("the upload should be saved, got %q", res)
+			t.Fail()
+		}
+
+		saved, _ := os.ReadFile(filepath.Join(s.directory, "big.txt"))
+		if string(saved) != content {
+			t.Logf("the whole file should be saved, got %d bytes", len(saved))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should hand the upload route its request before the body is read", func(t *testing.T) {
+		s := fileServer(t)
+		client, peer := net.Pipe()
+		defer client.Close()
+		defer peer.Close()
+
+		go peer.Write([]byte("POST /files HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100000\r\n\r\nfirst"))
+
+		data, err := s.readBytes(client)
+		if err != nil || !strings.HasSuffix(string(data), "\r\n\r\nfirst") {
+			t.Logf("only the head and the bytes sent with it should be read, got %q %v", data, err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse names outside of the directory", func(t *testing.T) {
+		s := fileServer(t)
+
+		if res := doRequest(s, "GET", "files/..", ""); res.status() != 400 {
+			t.Logf("Status should be 400, was %d", res.status())
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+const defaultFormMemory = 10 << 20
+
+var (
+	errUnsupportedForm = errors.New("the request body is not a form")
+	errMissingBoundary = errors.New("the multipart form has no boundary")
+)
+
+type form struct {
+	values url.Values
+	files  map[string][]*multipart.FileHeader
+	parts  *multipart.Form
+}
+
+// parseForm reads the query string and the urlencoded or multipart body of the request, values of the
+// body come before the ones of the query. Multipart file parts above maxMemory are kept in temporary
+// files, removeAll has to be called once the form is not needed anymore
+func parseForm(props *reqProps, maxMemory int64) (*form, error) {
+	values, err := url.ParseQuery(props.request.query)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &form{
+		values: make(url.Values),
+		files:  make(map[string][]*multipart.FileHeader),
+	}
+
+	contentType := props.header("Content-Type")
+	if contentType == "" {
+		f.values = values
+		return f, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		body, readErr := props.readBody()
+		if readErr != nil {
+			return nil, readErr
+		}
+		bodyValues, parseErr := url.ParseQuery(string(body))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		for k, v := range bodyValues {
+			f.values[k] = append(f.values[k], v...)
+		}
+	case "multipart/form-data":
+		boundary := params["boundary"]
+		if boundary == "" {
+			return nil, errMissingBoundary
+		}
+
+		// a streamed body is read part by part, the files are kept in memory up to maxMemory
+		parts, readErr := multipart.NewReader(props.bodyStream(), boundary).ReadForm(maxMemory)
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		f.parts = parts
+		f.files = parts.File
+		for k, v := range parts.Value {
+			f.values[k] = append(f.values[k], v...)
+		}
+	default:
+		return nil, errUnsupportedForm
+	}
+
+	for k, v := range values {
+		f.values[k] = append(f.values[k], v...)
+	}
+
+	return f, nil
+}
+
+// value gives the first value of the field, empty when the form does not have it
+func (f *form) value(name string) string {
+	return f.values.Get(name)
+}
+
+// removeAll deletes the temporary files created for the multipart parts
+func (f *form) removeAll() error {
+	if f.parts == nil {
+		return nil
+	}
+	return f.parts.RemoveAll()
+}
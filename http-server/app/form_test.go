@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"testing"
+)
+
+func multipartBody(t *testing.T, fields map[string]string, files map[string]string) (string, []byte) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	for name, value := range fields {
+		w.WriteField(name, value)
+	}
+
+	for name, content := range files {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	w.Close()
+
+	return w.FormDataContentType(), body.Bytes()
+}
+
+func formRequest(contentType string, query string, body []byte) *reqProps {
+	return &reqProps{
+		method: "POST",
+		request: &reqPath{
+			path:  "form",
+			query: query,
+		},
+		headers: map[string]string{"content-type": contentType},
+		body:    body,
+	}
+}
+
+func TestParseForm(t *testing.T) {
+
+	t.Run("Should be able to parse an urlencoded body and the query", func(t *testing.T) {
+		props := formRequest("application/x-www-form-urlencoded", "b=3&c=4", []byte("a=1&b=2"))
+
+		f, err := parseForm(props, defaultFormMemory)
+
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+
+		if f.value("a") != "1" || f.value("c") != "4" {
+			t.Log("Values from the body and the query should be there")
+			t.Fail()
+		}
+
+		if b := f.values["b"]; len(b) != 2 || b[0] != "2" {
+			t.Log("Values of the body should come before the ones of the query")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should be able to parse a multipart body keeping big parts on disk", func(t *testing.T) {
+		big := string(bytes.Repeat([]byte("x"), 4096))
+		contentType, body := multipartBody(t, map[string]string{"name": "value"}, map[string]string{"big.txt": big})
+
+		f, err := parseForm(formRequest(contentType, "", body), 1024)
+
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+		defer f.removeAll()
+
+		if f.value("name") != "value" {
+			t.Log("The field of the form should be there")
+			t.Fail()
+		}
+
+		headers := f.files["file"]
+		if len(headers) != 1 || headers[0].Filename != "big.txt" {
+			t.Log("There should be the file of the form")
+			t.FailNow()
+		}
+
+		part, _ := headers[0].Open()
+		content, _ := io.ReadAll(part)
+		part.Close()
+
+		if string(content) != big {
+			t.Log("The content of the file should be the one sent")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse bodies that are not forms", func(t *testing.T) {
+		_, err := parseForm(formRequest("application/json", "", []byte("{}")), defaultFormMemory)
+
+		if err != errUnsupportedForm {
+			t.Log("There should be an unsupported form error")
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const forwardProxyRoute = "forward-proxy"
+
+// errProxyDestinationRefused is a destination out of the allowlist, or one resolving to an internal
+// address the allowlist does not name
+var errProxyDestinationRefused = errors.New("the destination is not allowed")
+
+// forwardProxyConfig describes the forward proxy. The allowlist holds host:port patterns, a * host
+// or port matches any and *.example.com matches the subdomains, an empty list allows every public
+// destination. Loopback, private and link-local addresses are only reached when an entry names
+// their host. With credentials the clients have to authenticate with Proxy-Authorization
+type forwardProxyConfig struct {
+	allow           []string
+	credentials     map[string]string
+	dialTimeout     time.Duration
+	responseTimeout time.Duration
+}
+
+// forwardProxy answers the requests made to the server as a proxy, the ones with an absolute-form
+// target and the CONNECT tunnels
+type forwardProxy struct {
+	s         *server
+	cfg       forwardProxyConfig
+	transport *http.Transport
+}
+
+func newForwardProxy(s *server, cfg forwardProxyConfig) *forwardProxy {
+	if cfg.dialTimeout <= 0 {
+		cfg.dialTimeout = defaultProxyDialTimeout
+	}
+	if cfg.responseTimeout <= 0 {
+		cfg.responseTimeout = defaultProxyResponseTimeout
+	}
+
+	fp := &forwardProxy{s: s, cfg: cfg}
+	fp.transport = &http.Transport{
+		DialContext:           fp.dial,
+		ResponseHeaderTimeout: cfg.responseTimeout,
+		DisableCompression:    true,
+	}
+
+	return fp
+}
+
+// handles tells if the request is for the proxy rather than for the routes of the server
+func (fp *forwardProxy) handles(props *reqProps) bool {
+	return props.method == "CONNECT" || isAbsoluteForm(props.target)
+}
+
+// serve answers a proxy request, r reads what the client sends after the request for the tunnels
+func (fp *forwardProxy) serve(props *reqProps, rc *responseConn, r io.Reader) {
+	props.route = forwardProxyRoute
+
+	if !fp.authorized(props) {
+		fp.s.writeResponse(407, map[string]string{
+			"Proxy-Authenticate": `Basic realm="proxy"`,
+			"Content-Length":     "0",
+		}, "", rc)
+		return
+	}
+
+	if props.method == "CONNECT" {
+		fp.tunnel(props, rc, r)
+		return
+	}
+
+	fp.forward(props, rc)
+}
+
+// authorized checks the Basic credentials of Proxy-Authorization when the proxy has users
+func (fp *forwardProxy) authorized(props *reqProps) bool {
+	if len(fp.cfg.credentials) == 0 {
+		return true
+	}
+
+	scheme, encoded, _ := strings.Cut(props.header("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	user, password, found := strings.Cut(string(decoded), ":")
+	expected, known := fp.cfg.credentials[user]
+	if !found || !known {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// allowed matches the destination against the allowlist, named tells if an entry gives its host
+// rather than a pattern, which lets it resolve to an internal address
+func (fp *forwardProxy) allowed(host string, port string) (allowed bool, named bool) {
+	allowed = len(fp.cfg.allow) == 0
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, entry := range fp.cfg.allow {
+		entryHost, entryPort := entry, "*"
+		if i := strings.LastIndex(entry, ":"); i != -1 && !strings.HasSuffix(entry, "]") {
+			entryHost, entryPort = entry[:i], entry[i+1:]
+		}
+		entryHost = strings.ToLower(strings.Trim(entryHost, "[]"))
+
+		if entryPort != "*" && entryPort != port {
+			continue
+		}
+
+		switch {
+		case entryHost == host:
+			return true, true
+		case entryHost == "*", strings.HasPrefix(entryHost, "*.") && strings.HasSuffix(host, entryHost[1:]):
+			allowed = true
+		}
+	}
+
+	return allowed, false
+}
+
+// dial connects to an allowed destination. The addresses the host resolves to are checked when
+// connecting, so a public name can not be pointed at the internal network
+func (fp *forwardProxy) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, named := fp.allowed(host, port)
+	if !allowed {
+		return nil, errProxyDestinationRefused
+	}
+
+	dialer := &net.Dialer{Timeout: fp.cfg.dialTimeout}
+	if !named {
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			ip, parseErr := netip.ParseAddrPort(address)
+			if parseErr != nil || internalAddress(ip.Addr()) {
+				return errProxyDestinationRefused
+			}
+			return nil
+		}
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// internalAddress tells if the address is one of the machine or of its network
+func internalAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// dialErrorStatus answers 403 to a refused destination and like upstreamErrorStatus otherwise
+func dialErrorStatus(err error) int {
+	if errors.Is(err, errProxyDestinationRefused) {
+		return 403
+	}
+	return upstreamErrorStatus(err)
+}
+
+// forward sends a request with an absolute-form target to its host
+func (fp *forwardProxy) forward(props *reqProps, rc *responseConn) {
+	target, err := url.Parse(props.target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		fp.s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if allowed, _ := fp.allowed(target.Hostname(), port); !allowed {
+		fp.s.writeResponse(403, map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+
+	out, err := forwardedRequest(props, rc, target)
+	if err != nil {
+		fp.s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+
+	res, err := fp.transport.RoundTrip(out)
+	if err != nil {
+		fmt.Println("Error forwarding the proxy request : ", err.Error())
+		fp.s.writeResponse(dialErrorStatus(err), map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+	defer res.Body.Close()
+
+	fp.s.relayResponse(res, rc)
+}
+
+// tunnel connects to the host:port of a CONNECT and copies the bytes both ways until both sides
+// are done, or until one of them is idle for longer than the idle timeout
+func (fp *forwardProxy) tunnel(props *reqProps, rc *responseConn, r io.Reader) {
+	host, port, err := net.SplitHostPort(props.target)
+	if err != nil || host == "" {
+		fp.s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+
+	if allowed, _ := fp.allowed(host, port); !allowed {
+		fp.s.writeResponse(403, map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+
+	upstream, err := fp.dial(context.Background(), "tcp", props.target)
+	if err != nil {
+		fmt.Println("Error opening the tunnel : ", err.Error())
+		fp.s.writeResponse(dialErrorStatus(err), map[string]string{"Content-Length": "0"}, "", rc)
+		return
+	}
+	defer upstream.Close()
+
+	// a successful CONNECT has no body, the connection is the tunnel from now on
+	if fp.s.writeResponse(200, make(map[string]string), "", rc) == -1 {
+		return
+	}
+
+	rc.Conn.SetDeadline(time.Time{})
+
+	idle := &tunnelIdle{timeout: fp.s.timeouts.idle, last: time.Now()}
+	fromClient := &idleReader{r: r, conn: rc.Conn, idle: idle}
+	fromUpstream := &idleReader{r: upstream, conn: upstream, idle: idle}
+
+	done := make(chan error, 2)
+	go func() {
+		_, copyErr := io.Copy(upstream, fromClient)
+		closeWrite(upstream)
+		done <- copyErr
+	}()
+	go func() {
+		_, copyErr := io.Copy(rc, fromUpstream)
+		closeWrite(rc.Conn)
+		done <- copyErr
+	}()
+
+	// when a side fails the other one is cut off instead of waiting for it to be idle
+	if copyErr := <-done; copyErr != nil {
+		idle.cut(upstream, rc.Conn)
+	}
+	<-done
+}
+
+// tunnelIdle tracks when either side of a tunnel last sent something. A side can stay quiet as
+// long as the other one talks, the tunnel is idle when both are
+type tunnelIdle struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	last    time.Time
+	stopped bool
+}
+
+// arm sets the read deadline of the connection, false once the tunnel was cut
+func (ti *tunnelIdle) arm(conn net.Conn) bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if ti.stopped {
+		return false
+	}
+	conn.SetReadDeadline(deadline(ti.timeout))
+	return true
+}
+
+func (ti *tunnelIdle) touch() {
+	ti.mu.Lock()
+	ti.last = time.Now()
+	ti.mu.Unlock()
+}
+
+func (ti *tunnelIdle) active() bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	return time.Since(ti.last) < ti.timeout
+}
+
+// cut stops the reads of both sides right away
+func (ti *tunnelIdle) cut(conns ...net.Conn) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.stopped = true
+	for _, conn := range conns {
+		conn.SetDeadline(time.Now())
+	}
+}
+
+// idleReader reads one side of a tunnel, a read deadline passing while the other side is active
+// is not the end of the tunnel
+type idleReader struct {
+	r    io.Reader
+	conn net.Conn
+	idle *tunnelIdle
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	for {
+		if !ir.idle.arm(ir.conn) {
+			return 0, net.ErrClosed
+		}
+
+		n, err := ir.r.Read(p)
+		if n > 0 {
+			ir.idle.touch()
+		}
+
+		if n == 0 && isTimeout(err) && ir.idle.active() {
+			continue
+		}
+		return n, err
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// parseProxyUsers reads the user:password values of the -proxy-user flag
+func parseProxyUsers(values []string) (map[string]string, error) {
+	users := make(map[string]string, len(values))
+
+	for _, v := range values {
+		user, password, found := strings.Cut(v, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("proxy user %s should be written user:password", v)
+		}
+		users[user] = password
+	}
+
+	return users, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyRequest(t *testing.T, addr string, raw string) (*http.Response, net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, raw)
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, conn, r
+}
+
+func echoListener(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestForwardProxy(t *testing.T) {
+	serve := func(t *testing.T, cfg forwardProxyConfig) string {
+		return listen(t, testServer(t, func(s *server) error {
+			s.forwardProxy = newForwardProxy(s, cfg)
+			return nil
+		}), nil)
+	}
+
+	t.Run("Should forward an absolute-form request to its host", func(t *testing.T) {
+		received := make(chan *http.Request, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- r
+			io.WriteString(w, "from upstream")
+		}))
+		defer upstream.Close()
+
+		host := strings.TrimPrefix(upstream.URL, "http://")
+		addr := serve(t, forwardProxyConfig{allow: []string{host}})
+
+		res, _, _ := proxyRequest(t, addr, "GET "+upstream.URL+"/page?q=1 HTTP/1.1\r\nHost: "+host+"\r\nProxy-Connection: keep-alive\r\n\r\n")
+		body, _ := io.ReadAll(res.Body)
+
+		r := <-received
+		if r.URL.Path != "/page" || r.URL.RawQuery != "q=1" || r.Host != host {
+			t.Logf("the request should reach the upstream as /page?q=1 for %s, got %s?%s for %s", host, r.URL.Path, r.URL.RawQuery, r.Host)
+			t.Fail()
+		}
+
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Log("the proxy headers should not be forwarded")
+			t.Fail()
+		}
+
+		if res.StatusCode != 200 || string(body) != "from upstream" {
+			t.Logf("the upstream response should be sent back, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should ask for proxy credentials", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Proxy-Authorization") != "" {
+				w.WriteHeader(500)
+			}
+		}))
+		defer upstream.Close()
+
+		addr := serve(t, forwardProxyConfig{
+			allow:       []string{strings.TrimPrefix(upstream.URL, "http://")},
+			credentials: map[string]string{"alice": "secret"},
+		})
+
+		res, _, _ := proxyRequest(t, addr, "GET "+upstream.URL+"/ HTTP/1.1\r\n\r\n")
+		if res.StatusCode != 407 || !strings.HasPrefix(res.Header.Get("Proxy-Authenticate"), "Basic") {
+			t.Logf("a request without credentials should be answered 407 with Proxy-Authenticate, got %d", res.StatusCode)
+			t.Fail()
+		}
+
+		wrong := base64.StdEncoding.EncodeToString([]byte("alice:wrong"))
+		res, _, _ = proxyRequest(t, addr, "GET "+upstream.URL+"/ HTTP/1.1\r\nProxy-Authorization: Basic "+wrong+"\r\n\r\n")
+		if res.StatusCode != 407 {
+			t.Logf("a wrong password should be answered 407, got %d", res.StatusCode)
+			t.Fail()
+		}
+
+		right := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		res, _, _ = proxyRequest(t, addr, "GET "+upstream.URL+"/ HTTP/1.1\r\nProxy-Authorization: Basic "+right+"\r\n\r\n")
+		if res.StatusCode != 200 {
+			t.Logf("the right credentials should be let through and not forwarded, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should leave the origin-form requests to the routes", func(t *testing.T) {
+		addr := listen(t, testServer(t, func(s *server) error {
+			s.forwardProxy = newForwardProxy(s, forwardProxyConfig{credentials: map[string]string{"alice": "secret"}})
+			return s.registerHandler("login", func(props *reqProps, conn net.Conn) {
+				s.writeResponse(200, map[string]string{"Content-Length": "0"}, "", conn)
+			})
+		}), nil)
+
+		res, _, _ := proxyRequest(t, addr, "GET /login?next=https://example.com/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if res.StatusCode != 200 {
+			t.Logf("a path with a url in its query should be served by the route, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse the destinations out of the allowlist", func(t *testing.T) {
+		echo := echoListener(t)
+		_, port, _ := net.SplitHostPort(echo)
+
+		addr := serve(t, forwardProxyConfig{allow: []string{"*.example.com:443", "127.0.0.1:1"}})
+
+		res, _, _ := proxyRequest(t, addr, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+		if res.StatusCode != 403 {
+			t.Logf("a tunnel to a port out of the allowlist should be answered 403, got %d", res.StatusCode)
+			t.Fail()
+		}
+
+		res, _, _ = proxyRequest(t, addr, "GET http://127.0.0.1:"+port+"/ HTTP/1.1\r\n\r\n")
+		if res.StatusCode != 403 {
+			t.Logf("a request to a host out of the allowlist should be answered 403, got %d", res.StatusCode)
+			t.Fail()
+		}
+
+		fp := newForwardProxy(nil, forwardProxyConfig{allow: []string{"*.example.com:443", "localhost", "[::1]:8080"}})
+		cases := []struct {
+			host, port string
+			allowed    bool
+			named      bool
+		}{
+			{"api.example.com", "443", true, false},
+			{"api.example.com", "80", false, false},
+			{"example.org", "443", false, false},
+			{"LOCALHOST", "22", true, true},
+			{"::1", "8080", true, true},
+		}
+		for _, c := range cases {
+			if allowed, named := fp.allowed(c.host, c.port); allowed != c.allowed || named != c.named {
+				t.Logf("%s:%s should be allowed %v and named %v, got %v %v", c.host, c.port, c.allowed, c.named, allowed, named)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse the internal addresses the allowlist does not name", func(t *testing.T) {
+		echo := echoListener(t)
+		_, port, _ := net.SplitHostPort(echo)
+
+		for _, allow := range [][]string{nil, {"*"}, {"*:" + port}} {
+			addr := serve(t, forwardProxyConfig{allow: allow})
+
+			// localhost is checked once resolved, not only by its name
+			for _, target := range []string{echo, "localhost:" + port} {
+				res, _, _ := proxyRequest(t, addr, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+				if res.StatusCode != 403 {
+					t.Logf("a tunnel to %s allowed by %v should be answered 403, got %d", target, allow, res.StatusCode)
+					t.Fail()
+				}
+
+				res, _, _ = proxyRequest(t, addr, "GET http://"+target+"/ HTTP/1.1\r\n\r\n")
+				if res.StatusCode != 403 {
+					t.Logf("a request to %s allowed by %v should be answered 403, got %d", target, allow, res.StatusCode)
+					t.Fail()
+				}
+			}
+		}
+	})
+
+	t.Run("Should tunnel the bytes both ways after CONNECT", func(t *testing.T) {
+		echo := echoListener(t)
+		addr := serve(t, forwardProxyConfig{allow: []string{echo}})
+
+		// the bytes sent along the CONNECT request are already for the tunnel
+		res, conn, r := proxyRequest(t, addr, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\nfirst ")
+		if res.StatusCode != 200 {
+			t.Logf("the tunnel should be opened with 200, got %d", res.StatusCode)
+			t.FailNow()
+		}
+
+		io.WriteString(conn, "second")
+
+		echoed := make([]byte, len("first second"))
+		if _, err := io.ReadFull(r, echoed); err != nil || string(echoed) != "first second" {
+			t.Logf("the bytes should come back through the tunnel, got %q %v", echoed, err)
+			t.Fail()
+		}
+
+		conn.(*net.TCPConn).CloseWrite()
+		if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+			t.Logf("the tunnel should end once both sides are done, got %q %v", rest, err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 502 when the tunnel can not be opened", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := l.Addr().String()
+		l.Close()
+
+		addr := serve(t, forwardProxyConfig{allow: []string{closed}})
+
+		res, _, _ := proxyRequest(t, addr, "CONNECT "+closed+" HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+		if res.StatusCode != 502 {
+			t.Logf("an unreachable destination should be answered 502, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not tunnel without the forward proxy", func(t *testing.T) {
+		addr := listen(t, testServer(t, func(s *server) error { return nil }), nil)
+
+		res, _, _ := proxyRequest(t, addr, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		if res.StatusCode != 501 {
+			t.Logf("CONNECT should be answered 501 without the forward proxy, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// hpack is the header compression of http/2 (rfc 7541). The decoder keeps the dynamic table the
+// client fills, the encoder only uses the static table and literals so it never needs to track the
+// table size the client allows
+
+var (
+	errHpackIndex   = errors.New("hpack: invalid table index")
+	errHpackInteger = errors.New("hpack: invalid integer")
+	errHpackString  = errors.New("hpack: invalid string")
+	errHpackHuffman = errors.New("hpack: invalid huffman code")
+	errHpackSize    = errors.New("hpack: dynamic table size update above the limit")
+	errHpackTooBig  = errors.New("hpack: header list is too big")
+)
+
+type headerField struct {
+	name      string
+	value     string
+	sensitive bool
+}
+
+// size is the size the field takes in the dynamic table, the 32 is the overhead the spec asks for
+func (f headerField) size() uint32 {
+	return uint32(len(f.name) + len(f.value) + 32)
+}
+
+var staticTable = []headerField{
+	{name: ":authority"},
+	{name: ":method", value: "GET"},
+	{name: ":method", value: "POST"},
+	{name: ":path", value: "/"},
+	{name: ":path", value: "/index.html"},
+	{name: ":scheme", value: "http"},
+	{name: ":scheme", value: "https"},
+	{name: ":status", value: "200"},
+	{name: ":status", value: "204"},
+	{name: ":status", value: "206"},
+	{name: ":status", value: "304"},
+	{name: ":status", value: "400"},
+	{name: ":status", value: "404"},
+	{name: ":status", value: "500"},
+	{name: "accept-charset"},
+	{name: "accept-encoding", value: "gzip, deflate"},
+	{name: "accept-language"},
+	{name: "accept-ranges"},
+	{name: "accept"},
+	{name: "access-control-allow-origin"},
+	{name: "age"},
+	{name: "allow"},
+	{name: "authorization"},
+	{name: "cache-control"},
+	{name: "content-disposition"},
+	{name: "content-encoding"},
+	{name: "content-language"},
+	{name: "content-length"},
+	{name: "content-location"},
+	{name: "content-range"},
+	{name: "content-type"},
+	{name: "cookie"},
+	{name: "date"},
+	{name: "etag"},
+	{name: "expect"},
+	{name: "expires"},
+	{name: "from"},
+	{name: "host"},
+	{name: "if-match"},
+	{name: "if-modified-since"},
+	{name: "if-none-match"},
+	{name: "if-range"},
+	{name: "if-unmodified-since"},
+	{name: "last-modified"},
+	{name: "link"},
+	{name: "location"},
+	{name: "max-forwards"},
+	{name: "proxy-authenticate"},
+	{name: "proxy-authorization"},
+	{name: "range"},
+	{name: "referer"},
+	{name: "refresh"},
+	{name: "retry-after"},
+	{name: "server"},
+	{name: "set-cookie"},
+	{name: "strict-transport-security"},
+	{name: "transfer-encoding"},
+	{name: "user-agent"},
+	{name: "vary"},
+	{name: "via"},
+	{name: "www-authenticate"},
+}
+
+type hpackDecoder struct {
+	// dynamic has the newest entry last, index 62 of the spec is the last element
+	dynamic []headerField
+	size    uint32
+	maxSize uint32
+	// allowedMaxSize is the table size we announced with SETTINGS_HEADER_TABLE_SIZE
+	allowedMaxSize uint32
+	// maxListSize bounds the decoded header list, 0 for no limit
+	maxListSize uint32
+}
+
+func newHpackDecoder(maxTableSize uint32, maxListSize uint32) *hpackDecoder {
+	return &hpackDecoder{
+		maxSize:        maxTableSize,
+		allowedMaxSize: maxTableSize,
+		maxListSize:    maxListSize,
+	}
+}
+
+// decode reads a whole header block, the dynamic table is updated as the fields are read
+func (d *hpackDecoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	var listSize uint32
+
+	for len(block) > 0 {
+		b := block[0]
+
+		var field headerField
+		var err error
+
+		switch {
+		case b&0x80 != 0: // indexed field
+			var index uint64
+			index, block, err = readHpackInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err = d.at(index)
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			field, block, err = d.readLiteral(block, 6)
+			if err == nil {
+				d.add(field)
+			}
+		case b&0xe0 == 0x20: // dynamic table size update
+			var size uint64
+			size, block, err = readHpackInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, errHpackSize
+			}
+			d.maxSize = uint32(size)
+			d.evict()
+			continue
+		case b&0xf0 == 0x10: // literal never indexed
+			field, block, err = d.readLiteral(block, 4)
+			field.sensitive = true
+		default: // literal without indexing
+			field, block, err = d.readLiteral(block, 4)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		listSize += field.size()
+		if d.maxListSize > 0 && listSize > d.maxListSize {
+			return nil, errHpackTooBig
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func (d *hpackDecoder) at(index uint64) (headerField, error) {
+	if index == 0 {
+		return headerField{}, errHpackIndex
+	}
+
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+
+	dynamicIndex := index - uint64(len(staticTable))
+	if dynamicIndex > uint64(len(d.dynamic)) {
+		return headerField{}, errHpackIndex
+	}
+
+	return d.dynamic[uint64(len(d.dynamic))-dynamicIndex], nil
+}
+
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint8) (headerField, []byte, error) {
+	var field headerField
+
+	nameIndex, rest, err := readHpackInt(block, prefix)
+	if err != nil {
+		return field, nil, err
+	}
+
+	if nameIndex > 0 {
+		indexed, indexErr := d.at(nameIndex)
+		if indexErr != nil {
+			return field, nil, indexErr
+		}
+		field.name = indexed.name
+	} else {
+		field.name, rest, err = readHpackString(rest)
+		if err != nil {
+			return field, nil, err
+		}
+	}
+
+	field.value, rest, err = readHpackString(rest)
+	if err != nil {
+		return field, nil, err
+	}
+
+	return field, rest, nil
+}
+
+func (d *hpackDecoder) add(field headerField) {
+	d.dynamic = append(d.dynamic, field)
+	d.size += field.size()
+	d.evict()
+}
+
+// evict drops the oldest entries until the table fits its size, an entry bigger than the table
+// empties it
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		d.size -= d.dynamic[0].size()
+		d.dynamic = d.dynamic[1:]
+	}
+}
+
+// readHpackInt reads an integer with an n bit prefix as described in rfc 7541 section 5.1
+func readHpackInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHpackInteger
+	}
+
+	max := uint64(1)<<n - 1
+	value := uint64(block[0]) & max
+	block = block[1:]
+
+	if value < max {
+		return value, block, nil
+	}
+
+	var shift uint
+	for len(block) > 0 {
+		b := block[0]
+		block = block[1:]
+
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+
+		shift += 7
+		if shift > 56 {
+			return 0, nil, errHpackInteger
+		}
+	}
+
+	return 0, nil, errHpackInteger
+}
+
+func readHpackString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHpackString
+	}
+
+	huffman := block[0]&0x80 != 0
+
+	length, rest, err := readHpackInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if uint64(len(rest)) < length {
+		return "", nil, errHpackString
+	}
+
+	raw := rest[:length]
+	rest = rest[length:]
+
+	if !huffman {
+		return string(raw), rest, nil
+	}
+
+	decoded, err := huffmanDecode(raw)
+	return decoded, rest, err
+}
+
+// appendHpackInt writes the integer with an n bit prefix, first has the bits of the first byte that
+// are above the prefix
+func appendHpackInt(dst []byte, first byte, n uint8, value uint64) []byte {
+	max := uint64(1)<<n - 1
+
+	if value < max {
+		return append(dst, first|byte(value))
+	}
+
+	dst = append(dst, first|byte(max))
+	value -= max
+
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+
+	return append(dst, byte(value))
+}
+
+// appendHpackString writes the string with huffman when it makes it shorter
+func appendHpackString(dst []byte, s string) []byte {
+	if encodedLen := huffmanEncodedLen(s); encodedLen < len(s) {
+		dst = appendHpackInt(dst, 0x80, 7, uint64(encodedLen))
+		return huffmanEncode(dst, s)
+	}
+
+	dst = appendHpackInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// encodeHeaders makes a header block for the fields, fully matching static entries are indexed and
+// the rest is sent as literals that the client does not add to its table
+func encodeHeaders(fields []headerField) []byte {
+	var block []byte
+
+	for _, f := range fields {
+		name := strings.ToLower(f.name)
+		nameIndex := 0
+
+		for i, s := range staticTable {
+			if s.name != name {
+				continue
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+			if s.value == f.value && !f.sensitive {
+				nameIndex = -(i + 1)
+				break
+			}
+		}
+
+		if nameIndex < 0 {
+			block = appendHpackInt(block, 0x80, 7, uint64(-nameIndex))
+			continue
+		}
+
+		first := byte(0x00)
+		if f.sensitive {
+			first = 0x10
+		}
+
+		block = appendHpackInt(block, first, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			block = appendHpackString(block, name)
+		}
+		block = appendHpackString(block, f.value)
+	}
+
+	return block
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+
+	for sym, code := range huffmanCodes {
+		length := huffmanCodeLen[sym]
+		n := root
+
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+
+	return root
+}
+
+// huffmanDecode walks the code tree bit by bit, the padding at the end has to be the most significant
+// bits of the end of string code, which is all ones, and shorter than a byte
+func huffmanDecode(b []byte) (string, error) {
+	var out strings.Builder
+	n := huffmanRoot
+	padding := 0
+	paddingOnes := true
+
+	for _, octet := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (octet >> uint(i)) & 1
+
+			n = n.children[bit]
+			if n == nil {
+				return "", errHpackHuffman
+			}
+
+			padding++
+			if bit == 0 {
+				paddingOnes = false
+			}
+
+			if n.leaf {
+				out.WriteByte(n.sym)
+				n = huffmanRoot
+				padding = 0
+				paddingOnes = true
+			}
+		}
+	}
+
+	if padding > 7 || !paddingOnes {
+		return "", errHpackHuffman
+	}
+
+	return out.String(), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	var bits uint
+
+	for i := 0; i < len(s); i++ {
+		length := uint(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+
+	if bits > 0 {
+		// pad with the most significant bits of the end of string code, all ones
+		acc = acc<<(8-bits) | (1<<(8-bits) - 1)
+		dst = append(dst, byte(acc))
+	}
+
+	return dst
+}
+
+// huffmanCodes are the codes of rfc 7541 appendix B, indexed by the byte they encode
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
@@ -0,0 +1,1145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRstStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+
+	settingHeaderTableSize      = 0x1
+	settingEnablePush           = 0x2
+	settingMaxConcurrentStreams = 0x3
+	settingInitialWindowSize    = 0x4
+	settingMaxFrameSize         = 0x5
+	settingMaxHeaderListSize    = 0x6
+
+	errCodeNo           = 0x0
+	errCodeProtocol     = 0x1
+	errCodeInternal     = 0x2
+	errCodeFlowControl  = 0x3
+	errCodeStreamClosed = 0x5
+	errCodeFrameSize    = 0x6
+	errCodeRefused      = 0x7
+	errCodeCompression  = 0x9
+
+	http2DefaultWindow        = 65535
+	http2MaxWindow            = 1<<31 - 1
+	http2DefaultFrameSize     = 16384
+	http2MaxFrameSize         = 1<<24 - 1
+	http2HeaderTableSize      = 4096
+	http2MaxConcurrentStreams = 250
+	http2MaxHeaderListSize    = 1 << 20
+)
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// http2Error is a connection error, the connection is ended with a GOAWAY carrying the code
+type http2Error struct {
+	code   uint32
+	reason string
+}
+
+func (e http2Error) Error() string {
+	return fmt.Sprintf("http2 connection error %d: %s", e.code, e.reason)
+}
+
+type http2Frame struct {
+	typ      uint8
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *http2Frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+func readHTTP2Frame(r io.Reader, maxSize uint32) (*http2Frame, error) {
+	var head [9]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	if length > maxSize {
+		return nil, http2Error{code: errCodeFrameSize, reason: "frame bigger than SETTINGS_MAX_FRAME_SIZE"}
+	}
+
+	f := &http2Frame{
+		typ:      head[3],
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & 0x7fffffff,
+		payload:  make([]byte, length),
+	}
+
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func appendHTTP2Frame(dst []byte, typ uint8, flags uint8, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), typ, flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&0x7fffffff)
+	return append(dst, payload...)
+}
+
+// stripPadding removes the pad length byte and the padding of DATA and HEADERS frames
+func stripPadding(f *http2Frame) ([]byte, error) {
+	payload := f.payload
+	if !f.has(flagPadded) {
+		return payload, nil
+	}
+
+	if len(payload) == 0 {
+		return nil, http2Error{code: errCodeProtocol, reason: "padded frame without pad length"}
+	}
+
+	padLength := int(payload[0])
+	if padLength >= len(payload) {
+		return nil, http2Error{code: errCodeProtocol, reason: "padding bigger than the frame"}
+	}
+
+	return payload[1 : len(payload)-padLength], nil
+}
+
+// http2Conn is one http/2 connection, the frames are read in a single goroutine and every request
+// is served in its own goroutine writing its frames back through the connection
+type http2Conn struct {
+	s       *server
+	conn    net.Conn
+	r       io.Reader
+	writeMu sync.Mutex
+
+	// mu guards the fields below, cond wakes the streams waiting for flow control window
+	mu            sync.Mutex
+	cond          *sync.Cond
+	streams       map[uint32]*http2Stream
+	sendWindow    int64
+	initialWindow int64
+	maxFrameSize  uint32
+	closed        bool
+
+	decoder      *hpackDecoder
+	lastStreamID uint32
+	handlers     sync.WaitGroup
+
+	// a header block spread over CONTINUATION frames
+	continuing  *http2Stream
+	headerBlock []byte
+	trailers    bool
+	endStream   bool
+}
+
+// http2Stream is handed to the handlers as their connection, its writes become DATA frames and its
+// reads give the request body
+type http2Stream struct {
+	id           uint32
+	c            *http2Conn
+	headers      []headerField
+	sendWindow   int64
+	remoteClosed bool
+	reset        bool
+	headSent     bool
+	ended        bool
+	maxBody      int64
+
+	// readDeadline is when the client has to be done sending the request, its headers and then its body
+	readDeadline time.Time
+
+	// guarded by the mu of the connection, the body waits there until the handler reads it
+	body     bytes.Buffer
+	received int64
+	bodyDone bool
+	bodyErr  error
+	discard  bool
+}
+
+// serveHTTP2 speaks http/2 on the connection until the client goes away, r reads the connection
+// with the bytes already read in front. An upgraded request is answered on stream 1
+func (s *server) serveHTTP2(conn net.Conn, r io.Reader, upgraded *reqProps, upgradeSettings []byte) {
+	c := &http2Conn{
+		s:             s,
+		conn:          conn,
+		r:             r,
+		streams:       make(map[uint32]*http2Stream),
+		sendWindow:    http2DefaultWindow,
+		initialWindow: http2DefaultWindow,
+		maxFrameSize:  http2DefaultFrameSize,
+		decoder:       newHpackDecoder(http2HeaderTableSize, http2MaxHeaderListSize),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	err := c.writeSettings()
+
+	if err == nil && upgraded != nil {
+		err = c.applySettings(upgradeSettings)
+		if err == nil {
+			st := c.newStream(1)
+			st.remoteClosed = true
+			c.lastStreamID = 1
+			c.serveStream(st, upgraded)
+		}
+	}
+
+	if err == nil {
+		err = c.readPreface()
+	}
+
+	if err == nil {
+		err = c.readFrames()
+	}
+
+	var h2Err http2Error
+	if errors.As(err, &h2Err) {
+		fmt.Println("Closing http2 connection : ", h2Err.Error())
+		c.goAway(h2Err.code)
+	}
+
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.handlers.Wait()
+}
+
+func (c *http2Conn) readPreface() error {
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(c.r, preface); err != nil {
+		return err
+	}
+
+	if string(preface) != http2Preface {
+		return http2Error{code: errCodeProtocol, reason: "invalid connection preface"}
+	}
+
+	return nil
+}
+
+func (c *http2Conn) readFrames() error {
+	for {
+		c.conn.SetReadDeadline(c.readDeadline())
+
+		f, err := readHTTP2Frame(c.r, http2DefaultFrameSize)
+		if isTimeout(err) {
+			c.timeOut()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if c.continuing != nil && (f.typ != frameContinuation || f.streamID != c.continuing.id) {
+			return http2Error{code: errCodeProtocol, reason: "expected a CONTINUATION frame"}
+		}
+
+		switch f.typ {
+		case frameData:
+			err = c.onData(f)
+		case frameHeaders:
+			err = c.onHeaders(f)
+		case frameContinuation:
+			err = c.onContinuation(f)
+		case framePriority:
+			if len(f.payload) != 5 {
+				err = http2Error{code: errCodeFrameSize, reason: "PRIORITY frame of the wrong size"}
+			}
+		case frameRstStream:
+			err = c.onRstStream(f)
+		case frameSettings:
+			err = c.onSettings(f)
+		case framePushPromise:
+			err = http2Error{code: errCodeProtocol, reason: "clients can not push"}
+		case framePing:
+			err = c.onPing(f)
+		case frameGoAway:
+			// the client is leaving, the streams already started still get their responses
+			return nil
+		case frameWindowUpdate:
+			err = c.onWindowUpdate(f)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readDeadline gives the deadline of the next frame. A connection without streams is idle, one
+// with streams still sending their request waits for them until the header and body timeouts of
+// the earliest one, and one whose streams were all received waits for their handlers
+func (c *http2Conn) readDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.streams) == 0 {
+		return deadline(c.s.timeouts.idle)
+	}
+
+	var earliest time.Time
+	for _, st := range c.streams {
+		if !st.remoteClosed && !st.readDeadline.IsZero() && (earliest.IsZero() || st.readDeadline.Before(earliest)) {
+			earliest = st.readDeadline
+		}
+	}
+
+	return earliest
+}
+
+// timeOut ends the connection once the client was too slow. The streams still sending their
+// request are answered 408 like a slow client is over http/1, the others get their responses
+func (c *http2Conn) timeOut() {
+	var slow []*http2Stream
+
+	c.mu.Lock()
+	for _, st := range c.streams {
+		if st.remoteClosed {
+			continue
+		}
+		if st.headers != nil {
+			// the handler was called, it gets the error reading the body
+			st.bodyErr = errRequestTimeout
+		} else {
+			slow = append(slow, st)
+		}
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	for _, st := range slow {
+		c.refuse(st, 408)
+	}
+
+	c.goAway(errCodeNo)
+}
+
+func (c *http2Conn) onHeaders(f *http2Frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return http2Error{code: errCodeProtocol, reason: "HEADERS on an invalid stream"}
+	}
+
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	if f.has(flagPriority) {
+		if len(payload) < 5 {
+			return http2Error{code: errCodeFrameSize, reason: "HEADERS too short for its priority"}
+		}
+		payload = payload[5:]
+	}
+
+	c.mu.Lock()
+	st, exists := c.streams[f.streamID]
+	c.mu.Unlock()
+
+	trailers := false
+	if exists {
+		// a second header block on an open stream are the trailers, which end the stream
+		if st.remoteClosed || !f.has(flagEndStream) {
+			return http2Error{code: errCodeStreamClosed, reason: "HEADERS on a closed stream"}
+		}
+		trailers = true
+	} else {
+		if f.streamID <= c.lastStreamID {
+			return http2Error{code: errCodeStreamClosed, reason: "HEADERS on a closed stream"}
+		}
+		c.lastStreamID = f.streamID
+		st = c.newStream(f.streamID)
+		st.readDeadline = deadline(c.s.timeouts.header)
+	}
+
+	c.continuing = st
+	c.headerBlock = append([]byte(nil), payload...)
+	c.trailers = trailers
+	c.endStream = f.has(flagEndStream)
+
+	if f.has(flagEndHeaders) {
+		return c.endHeaders()
+	}
+
+	return nil
+}
+
+func (c *http2Conn) onContinuation(f *http2Frame) error {
+	if c.continuing == nil {
+		return http2Error{code: errCodeProtocol, reason: "CONTINUATION without HEADERS"}
+	}
+
+	c.headerBlock = append(c.headerBlock, f.payload...)
+	if len(c.headerBlock) > http2MaxHeaderListSize {
+		return http2Error{code: errCodeProtocol, reason: "header block too big"}
+	}
+
+	if f.has(flagEndHeaders) {
+		return c.endHeaders()
+	}
+
+	return nil
+}
+
+// endHeaders decodes the whole header block, which has to happen even for refused streams so the
+// decoder table stays in sync with the client
+func (c *http2Conn) endHeaders() error {
+	st := c.continuing
+	c.continuing = nil
+
+	fields, err := c.decoder.decode(c.headerBlock)
+	c.headerBlock = nil
+	if err != nil {
+		return http2Error{code: errCodeCompression, reason: err.Error()}
+	}
+
+	if !c.trailers {
+		st.headers = fields
+
+		c.mu.Lock()
+		active := len(c.streams)
+		c.mu.Unlock()
+
+		if active > http2MaxConcurrentStreams {
+			c.resetStream(st, errCodeRefused)
+			return nil
+		}
+
+		host := st.field(":authority")
+		if host == "" {
+			host = st.field("host")
+		}
+		st.maxBody = c.s.bodyLimit(host, st.field(":path"))
+		if length, err := strconv.ParseInt(st.field("content-length"), 10, 64); err == nil && st.maxBody > 0 && length > st.maxBody {
+			st.remoteClosed = true
+			return c.refuse(st, 413)
+		}
+	}
+
+	if c.endStream {
+		st.remoteClosed = true
+
+		c.mu.Lock()
+		st.bodyDone = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	} else {
+		st.readDeadline = deadline(c.s.timeouts.body)
+	}
+
+	// the handler is called once the headers are there, it reads the body as it arrives
+	if !c.trailers {
+		c.dispatch(st)
+	}
+
+	return nil
+}
+
+func (c *http2Conn) onData(f *http2Frame) error {
+	if f.streamID == 0 {
+		return http2Error{code: errCodeProtocol, reason: "DATA on stream 0"}
+	}
+
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	st, ok := c.streams[f.streamID]
+	open := ok && !st.remoteClosed
+	buffered := 0
+	if open && !st.discard {
+		if st.maxBody > 0 && st.received+int64(len(payload)) > st.maxBody {
+			// the handler answers 413 when it reads the error, the rest of the body is dropped
+			st.bodyErr = errBodyTooLarge
+			st.discard = true
+		} else {
+			st.body.Write(payload)
+			st.received += int64(len(payload))
+			buffered = len(payload)
+		}
+	}
+	if open && f.has(flagEndStream) {
+		st.bodyDone = true
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	// the buffered bytes are given back to the flow control windows once the handler read them, so
+	// a slow handler slows the client down. The padding and the dropped bytes are given back now
+	if unread := len(f.payload) - buffered; unread > 0 {
+		if err := c.windowUpdate(0, uint32(unread)); err != nil {
+			return err
+		}
+		if open && !f.has(flagEndStream) {
+			if err := c.windowUpdate(st.id, uint32(unread)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !open {
+		if f.streamID > c.lastStreamID {
+			return http2Error{code: errCodeProtocol, reason: "DATA on an idle stream"}
+		}
+		return c.writeFrame(frameRstStream, 0, f.streamID, binary.BigEndian.AppendUint32(nil, errCodeStreamClosed))
+	}
+
+	if f.has(flagEndStream) {
+		st.remoteClosed = true
+	}
+
+	return nil
+}
+
+func (c *http2Conn) onRstStream(f *http2Frame) error {
+	if f.streamID == 0 || f.streamID > c.lastStreamID {
+		return http2Error{code: errCodeProtocol, reason: "RST_STREAM on an idle stream"}
+	}
+
+	if len(f.payload) != 4 {
+		return http2Error{code: errCodeFrameSize, reason: "RST_STREAM of the wrong size"}
+	}
+
+	c.mu.Lock()
+	if st, ok := c.streams[f.streamID]; ok {
+		st.reset = true
+		delete(c.streams, f.streamID)
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *http2Conn) onSettings(f *http2Frame) error {
+	if f.streamID != 0 {
+		return http2Error{code: errCodeProtocol, reason: "SETTINGS on a stream"}
+	}
+
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return http2Error{code: errCodeFrameSize, reason: "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+
+	if err := c.applySettings(f.payload); err != nil {
+		return err
+	}
+
+	return c.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (c *http2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return http2Error{code: errCodeFrameSize, reason: "SETTINGS of the wrong size"}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < len(payload); i += 6 {
+		id := binary.BigEndian.Uint16(payload[i:])
+		value := binary.BigEndian.Uint32(payload[i+2:])
+
+		switch id {
+		case settingEnablePush:
+			if value > 1 {
+				return http2Error{code: errCodeProtocol, reason: "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if value > http2MaxWindow {
+				return http2Error{code: errCodeFlowControl, reason: "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			// the change applies to the window of every open stream
+			delta := int64(value) - c.initialWindow
+			c.initialWindow = int64(value)
+			for _, st := range c.streams {
+				st.sendWindow += delta
+			}
+			c.cond.Broadcast()
+		case settingMaxFrameSize:
+			if value < http2DefaultFrameSize || value > http2MaxFrameSize {
+				return http2Error{code: errCodeProtocol, reason: "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			c.maxFrameSize = value
+		}
+	}
+
+	return nil
+}
+
+func (c *http2Conn) onPing(f *http2Frame) error {
+	if f.streamID != 0 {
+		return http2Error{code: errCodeProtocol, reason: "PING on a stream"}
+	}
+
+	if len(f.payload) != 8 {
+		return http2Error{code: errCodeFrameSize, reason: "PING of the wrong size"}
+	}
+
+	if f.has(flagAck) {
+		return nil
+	}
+
+	return c.writeFrame(framePing, flagAck, 0, f.payload)
+}
+
+func (c *http2Conn) onWindowUpdate(f *http2Frame) error {
+	if len(f.payload) != 4 {
+		return http2Error{code: errCodeFrameSize, reason: "WINDOW_UPDATE of the wrong size"}
+	}
+
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.streamID == 0 {
+		if increment == 0 {
+			return http2Error{code: errCodeProtocol, reason: "WINDOW_UPDATE of 0"}
+		}
+		c.sendWindow += increment
+		if c.sendWindow > http2MaxWindow {
+			return http2Error{code: errCodeFlowControl, reason: "connection window above the maximum"}
+		}
+		c.cond.Broadcast()
+		return nil
+	}
+
+	st, ok := c.streams[f.streamID]
+	if !ok {
+		return nil
+	}
+
+	if increment == 0 || st.sendWindow+increment > http2MaxWindow {
+		st.reset = true
+		delete(c.streams, st.id)
+		c.cond.Broadcast()
+		go c.writeFrame(frameRstStream, 0, st.id, binary.BigEndian.AppendUint32(nil, errCodeFlowControl))
+		return nil
+	}
+
+	st.sendWindow += increment
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *http2Conn) newStream(id uint32) *http2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := &http2Stream{
+		id:         id,
+		c:          c,
+		sendWindow: c.initialWindow,
+	}
+	c.streams[id] = st
+
+	return st
+}
+
+// dispatch serves the request of the stream once the client has sent its headers, the body is read
+// from the stream as it arrives
+func (c *http2Conn) dispatch(st *http2Stream) {
+	props, err := st.request()
+	if err != nil {
+		fmt.Println("Malformed http2 request : ", err.Error())
+		if c.s.metrics != nil {
+			c.s.metrics.parseErrors.Add(1)
+		}
+		c.resetStream(st, errCodeProtocol)
+		return
+	}
+
+	props.bodyReader = st
+	c.serveStream(st, props)
+}
+
+func (c *http2Conn) serveStream(st *http2Stream, props *reqProps) {
+	c.handlers.Add(1)
+
+	go func() {
+		defer c.handlers.Done()
+		defer c.discardBody(st)
+
+		if !c.bufferBody(st, props) {
+			return
+		}
+
+		rc := newResponseConn(st, props)
+		start := c.s.beginRequest(props, rc)
+
+		if hErr := c.s.serve(props, rc); hErr != nil {
+			c.s.writeResponse(404, make(map[string]string), "", rc)
+		}
+
+		if fErr := rc.finish(); fErr != nil {
+			fmt.Println("Error while finishing the response : ", fErr.Error())
+		}
+
+		c.s.endRequest(props, rc, start)
+	}()
+}
+
+// bufferBody reads the body of the routes that do not stream it before their handler is called,
+// like the server does over http/1. A body that could not be read is answered here, false tells
+// that the handler should not be called
+func (c *http2Conn) bufferBody(st *http2Stream, props *reqProps) bool {
+	if props.bodyReader == nil || c.s.streamsBody(props.header("Host"), st.field(":path")) {
+		return true
+	}
+
+	body, err := io.ReadAll(props.bodyReader)
+	switch {
+	case err == nil:
+		props.body = body
+		props.bodyReader = nil
+		return true
+	case errors.Is(err, errBodyTooLarge):
+		c.refuse(st, 413)
+	case errors.Is(err, errRequestTimeout):
+		c.refuse(st, 408)
+	}
+
+	// otherwise the stream was reset or the connection closed, there is no one to answer
+	return false
+}
+
+// discardBody drops what the handler left of the body, the window it holds is given back so the
+// other streams of the connection are not starved
+func (c *http2Conn) discardBody(st *http2Stream) {
+	c.mu.Lock()
+	unread := st.body.Len()
+	st.body.Reset()
+	st.discard = true
+	c.mu.Unlock()
+
+	if unread > 0 {
+		c.windowUpdate(0, uint32(unread))
+	}
+}
+
+func (c *http2Conn) resetStream(st *http2Stream, code uint32) {
+	c.mu.Lock()
+	st.reset = true
+	delete(c.streams, st.id)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.writeFrame(frameRstStream, 0, st.id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// refuse answers a stream whose request can not be served, a body over the limit or a client too
+// slow sending it. The client is then told with RST_STREAM to stop sending the rest of it
+func (c *http2Conn) refuse(st *http2Stream, status int) error {
+	if err := st.writeHead(status, map[string]string{"content-length": "0"}); err != nil {
+		return err
+	}
+	if err := st.endStream(); err != nil {
+		return err
+	}
+
+	return c.writeFrame(frameRstStream, 0, st.id, binary.BigEndian.AppendUint32(nil, errCodeNo))
+}
+
+func (c *http2Conn) closeStream(st *http2Stream) {
+	c.mu.Lock()
+	delete(c.streams, st.id)
+	c.mu.Unlock()
+}
+
+func (c *http2Conn) writeSettings() error {
+	var payload []byte
+	for _, setting := range [][2]uint32{
+		{settingMaxConcurrentStreams, http2MaxConcurrentStreams},
+		{settingMaxHeaderListSize, http2MaxHeaderListSize},
+		{settingEnablePush, 0},
+	} {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(setting[0]))
+		payload = binary.BigEndian.AppendUint32(payload, setting[1])
+	}
+
+	return c.writeFrame(frameSettings, 0, 0, payload)
+}
+
+func (c *http2Conn) windowUpdate(streamID uint32, increment uint32) error {
+	return c.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func (c *http2Conn) goAway(code uint32) {
+	payload := binary.BigEndian.AppendUint32(nil, c.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	c.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (c *http2Conn) writeFrame(typ uint8, flags uint8, streamID uint32, payload []byte) error {
+	return c.writeFrames(appendHTTP2Frame(nil, typ, flags, streamID, payload))
+}
+
+// writeFrames writes already encoded frames in one go, so no other frame lands between them
+func (c *http2Conn) writeFrames(frames []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(deadline(c.s.timeouts.write))
+
+	_, err := c.conn.Write(frames)
+	return err
+}
+
+// reserveWindow waits until the stream can send and takes at most n bytes of the windows
+func (c *http2Conn) reserveWindow(st *http2Stream, n int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for !c.closed && !st.reset && (c.sendWindow <= 0 || st.sendWindow <= 0) {
+		c.cond.Wait()
+	}
+
+	if c.closed || st.reset {
+		return 0, errStreamClosed
+	}
+
+	allowed := int64(n)
+	allowed = min(allowed, c.sendWindow, st.sendWindow, int64(c.maxFrameSize))
+
+	c.sendWindow -= allowed
+	st.sendWindow -= allowed
+
+	return int(allowed), nil
+}
+
+// field gives the value of the first header field of the stream with the name
+func (st *http2Stream) field(name string) string {
+	for _, f := range st.headers {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// request builds the request props from the pseudo headers and fields of the stream
+func (st *http2Stream) request() (*reqProps, error) {
+	headers := make(map[string]string)
+	var method, path, authority string
+	regular := false
+
+	for _, f := range st.headers {
+		if strings.HasPrefix(f.name, ":") {
+			if regular {
+				return nil, errors.New("pseudo header after a regular one")
+			}
+
+			switch f.name {
+			case ":method":
+				method = f.value
+			case ":path":
+				path = f.value
+			case ":authority":
+				authority = f.value
+			case ":scheme":
+			default:
+				return nil, fmt.Errorf("unknown pseudo header %s", f.name)
+			}
+			continue
+		}
+
+		regular = true
+
+		if strings.ToLower(f.name) != f.name {
+			return nil, fmt.Errorf("header %s is not lowercase", f.name)
+		}
+
+		name := textproto.CanonicalMIMEHeaderKey(f.name)
+		if existing, ok := headers[name]; ok {
+			if name == "Host" {
+				return nil, errors.New("repeated host header")
+			}
+			separator := ", "
+			if name == "Cookie" {
+				separator = "; "
+			}
+			headers[name] = existing + separator + f.value
+		} else {
+			headers[name] = f.value
+		}
+	}
+
+	if method == "" || path == "" {
+		return nil, errors.New("request without :method or :path")
+	}
+
+	// the Host has to name the same host as the :authority, RFC 9113 section 8.3.1
+	if host, ok := headers["Host"]; !ok && authority != "" {
+		headers["Host"] = authority
+	} else if ok && authority != "" && !strings.EqualFold(host, authority) {
+		return nil, errors.New("host header not matching the :authority")
+	}
+	if host, ok := headers["Host"]; ok && !validHost(host) {
+		return nil, fmt.Errorf("invalid host %s", host)
+	}
+
+	target, query, _ := strings.Cut(strings.TrimPrefix(path, "/"), "?")
+
+	return &reqProps{
+		method:  method,
+		version: "HTTP/2.0",
+		request: &reqPath{
+			path:  target,
+			query: query,
+		},
+		headers: headers,
+	}, nil
+}
+
+// connection specific headers have no meaning in http/2 and make the response malformed
+var http2ConnectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// writeHead sends the response headers as a HEADERS frame followed by CONTINUATION frames when the
+// block does not fit in one frame
+func (st *http2Stream) writeHead(status int, headers map[string]string) error {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := []headerField{{name: ":status", value: strconv.Itoa(status)}}
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if http2ConnectionHeaders[lower] {
+			continue
+		}
+		for _, v := range strings.Split(headers[name], "\n") {
+			fields = append(fields, headerField{name: lower, value: v})
+		}
+	}
+
+	block := encodeHeaders(fields)
+
+	st.c.mu.Lock()
+	maxFrameSize := int(st.c.maxFrameSize)
+	st.c.mu.Unlock()
+
+	var frames []byte
+	typ := uint8(frameHeaders)
+	for {
+		chunk := block
+		if len(chunk) > maxFrameSize {
+			chunk = block[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+
+		flags := uint8(0)
+		if len(block) == 0 {
+			flags = flagEndHeaders
+		}
+
+		frames = appendHTTP2Frame(frames, typ, flags, st.id, chunk)
+		typ = frameContinuation
+
+		if len(block) == 0 {
+			break
+		}
+	}
+
+	st.headSent = true
+
+	return st.c.writeFrames(frames)
+}
+
+// endStream ends the response, a stream whose handler never answered is reset
+func (st *http2Stream) endStream() error {
+	if st.ended {
+		return nil
+	}
+	st.ended = true
+
+	if !st.headSent {
+		st.c.resetStream(st, errCodeInternal)
+		return nil
+	}
+
+	st.c.mu.Lock()
+	reset := st.reset
+	st.c.mu.Unlock()
+
+	// the client does not want the response anymore, nothing left to end
+	if reset {
+		return nil
+	}
+
+	err := st.c.writeFrame(frameData, flagEndStream, st.id, nil)
+	st.c.closeStream(st)
+
+	return err
+}
+
+// Write sends the bytes as DATA frames as the flow control windows allow
+func (st *http2Stream) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		n, err := st.c.reserveWindow(st, len(b))
+		if err != nil {
+			return written, err
+		}
+
+		if err = st.c.writeFrame(frameData, 0, st.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Read gives the request body as the client sends it. The bytes read are given back to the flow
+// control windows, the client can only send more once the handler made room for it
+func (st *http2Stream) Read(b []byte) (int, error) {
+	c := st.c
+
+	c.mu.Lock()
+	for st.body.Len() == 0 && st.bodyErr == nil && !st.bodyDone && !st.reset && !c.closed {
+		c.cond.Wait()
+	}
+
+	if st.bodyErr != nil {
+		err := st.bodyErr
+		c.mu.Unlock()
+		return 0, err
+	}
+	if st.body.Len() == 0 {
+		done := st.bodyDone
+		c.mu.Unlock()
+		if done {
+			return 0, io.EOF
+		}
+		return 0, errStreamClosed
+	}
+
+	n, _ := st.body.Read(b)
+	open := !st.bodyDone
+	c.mu.Unlock()
+
+	if n > 0 {
+		c.windowUpdate(0, uint32(n))
+		if open {
+			c.windowUpdate(st.id, uint32(n))
+		}
+	}
+
+	return n, nil
+}
+
+func (st *http2Stream) Close() error {
+	return nil
+}
+
+func (st *http2Stream) LocalAddr() net.Addr {
+	return st.c.conn.LocalAddr()
+}
+
+func (st *http2Stream) RemoteAddr() net.Addr {
+	return st.c.conn.RemoteAddr()
+}
+
+func (st *http2Stream) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (st *http2Stream) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (st *http2Stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// isH2CUpgrade tells if a cleartext request asks to switch to http/2 as described in rfc 7540 section 3.2
+func isH2CUpgrade(props *reqProps) bool {
+	if props.header("HTTP2-Settings") == "" {
+		return false
+	}
+
+	return headerHasToken(props.header("Upgrade"), "h2c") && headerHasToken(props.header("Connection"), "upgrade")
+}
+
+// upgradeToHTTP2 answers 101 and continues the connection in http/2, the request is answered on stream 1
+func (s *server) upgradeToHTTP2(conn net.Conn, r io.Reader, props *reqProps) {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(props.header("HTTP2-Settings"), "="))
+	if err != nil {
+		s.writeResponse(400, map[string]string{}, "", conn)
+		return
+	}
+
+	for _, h := range []string{"Connection", "Upgrade", "HTTP2-Settings"} {
+		deleteHeader(props.headers, h)
+	}
+	props.version = "HTTP/2.0"
+
+	_, err = conn.Write(buildHttpResponse(101, map[string]string{
+		"Connection": "Upgrade",
+		"Upgrade":    "h2c",
+	}, ""))
+	if err != nil {
+		fmt.Println("Error sending response in connection: ", err.Error())
+		return
+	}
+
+	s.serveHTTP2(conn, r, props, settings)
+}
+
+// headerHasToken looks for the token in a comma separated header, ignoring case
+func headerHasToken(value string, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHpack(t *testing.T) {
+
+	t.Run("Should decode the request examples of rfc 7541 sharing the dynamic table", func(t *testing.T) {
+		d := newHpackDecoder(4096, 0)
+
+		// appendix C.4.1 and C.4.2, with huffman encoded strings
+		first, _ := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+		second, _ := hex.DecodeString("828684be5886a8eb10649cbf")
+
+		fields, err := d.decode(first)
+		if err != nil || len(fields) != 4 || fields[3].name != ":authority" || fields[3].value != "www.example.com" {
+			t.Logf("First block was not decoded right: %v %v", fields, err)
+			t.FailNow()
+		}
+
+		fields, err = d.decode(second)
+		if err != nil || len(fields) != 5 || fields[3].value != "www.example.com" || fields[4].value != "no-cache" {
+			t.Logf("Second block was not decoded right: %v %v", fields, err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should decode what it encodes", func(t *testing.T) {
+		fields := []headerField{
+			{name: ":status", value: "200"},
+			{name: ":status", value: "201"},
+			{name: "content-type", value: "text/plain"},
+			{name: "x-custom-header", value: strings.Repeat("long value ", 20)},
+			{name: "authorization", value: "secret", sensitive: true},
+		}
+
+		decoded, err := newHpackDecoder(4096, 0).decode(encodeHeaders(fields))
+
+		if err != nil || len(decoded) != len(fields) {
+			t.Logf("Block was not decoded right: %v %v", decoded, err)
+			t.FailNow()
+		}
+
+		for i := range fields {
+			if decoded[i] != fields[i] {
+				t.Logf("Field %d should be %v, was %v", i, fields[i], decoded[i])
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse invalid huffman padding", func(t *testing.T) {
+		// a literal whose huffman string is padded with zeros instead of ones
+		block := []byte{0x00, 0x81, 0x00, 0x81, 0x00}
+
+		if _, err := newHpackDecoder(4096, 0).decode(block); err == nil {
+			t.Log("There should be an error")
+			t.Fail()
+		}
+	})
+}
+
+// readStream reads frames until the stream ends, giving its status and body
+func readStream(t *testing.T, r io.Reader, streamID uint32) (string, []byte) {
+	decoder := newHpackDecoder(4096, 0)
+	var status string
+	var body []byte
+
+	for {
+		f, err := readHTTP2Frame(r, http2MaxFrameSize)
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+
+		if f.streamID != streamID {
+			continue
+		}
+
+		if f.typ == frameHeaders {
+			fields, _ := decoder.decode(f.payload)
+			status = fields[0].value
+		}
+
+		if f.typ == frameData {
+			body = append(body, f.payload...)
+			if f.has(flagEndStream) {
+				return status, body
+			}
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	s := routesServer(t)
+	addr := listen(t, s, nil)
+
+	config, err := buildTLSConfig(tlsOptions{
+		certificates: []certificatePair{writeCertificate(t, t.TempDir(), "default", "localhost")},
+		alpn:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsAddr := listen(t, s, config)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+
+	t.Run("Should answer with prior knowledge h2c", func(t *testing.T) {
+		conn, dialErr := net.Dial("tcp", addr)
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		defer conn.Close()
+
+		block := encodeHeaders([]headerField{
+			{name: ":method", value: "GET"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/echo/prior"},
+			{name: ":authority", value: "localhost"},
+		})
+
+		conn.Write([]byte(http2Preface))
+		conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+		conn.Write(appendHTTP2Frame(nil, frameHeaders, flagEndHeaders|flagEndStream, 1, block))
+
+		status, body := readStream(t, conn, 1)
+
+		if status != "200" || string(body) != "prior" {
+			t.Logf("Stream 1 should answer the request, got %s %q", status, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer over tls negotiated with ALPN", func(t *testing.T) {
+		res, err := client.Get("https://" + tlsAddr + "/echo/hello")
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.ProtoMajor != 2 || res.StatusCode != 200 || string(body) != "hello" {
+			t.Logf("Should get hello over http/2, got %s %d %q", res.Proto, res.StatusCode, body)
+			t.Fail()
+		}
+
+		if !res.Uncompressed {
+			t.Log("The body should have been gzip encoded by the compression middleware")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should move bodies bigger than the flow control windows both ways", func(t *testing.T) {
+		content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+
+		res, err := client.Post("https://"+tlsAddr+"/files/big", "application/octet-stream", bytes.NewReader(content))
+		if err != nil || res.StatusCode != 201 {
+			t.Logf("Upload should have succeeded: %v", err)
+			t.FailNow()
+		}
+		res.Body.Close()
+
+		res, err = client.Get("https://" + tlsAddr + "/files/big")
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if !bytes.Equal(body, content) {
+			t.Logf("Downloaded file should be the uploaded one, got %d bytes", len(body))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should only give the window back once the handler read the body", func(t *testing.T) {
+		release := make(chan struct{})
+		holdAddr := listen(t, testServer(t, func(s *server) error {
+			s.streamBody("hold")
+			return s.registerHandler("hold", func(props *reqProps, conn net.Conn) {
+				<-release
+				body, _ := io.ReadAll(props.bodyStream())
+				read := strconv.Itoa(len(body))
+				s.writeResponse(200, map[string]string{"Content-Length": strconv.Itoa(len(read))}, read, conn)
+			})
+		}), nil)
+
+		conn, dialErr := net.Dial("tcp", holdAddr)
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		defer conn.Close()
+
+		block := encodeHeaders([]headerField{
+			{name: ":method", value: "POST"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/hold"},
+			{name: ":authority", value: "localhost"},
+		})
+
+		conn.Write([]byte(http2Preface))
+		conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+		conn.Write(appendHTTP2Frame(nil, frameHeaders, flagEndHeaders, 1, block))
+		conn.Write(appendHTTP2Frame(nil, frameData, 0, 1, bytes.Repeat([]byte("a"), 1000)))
+
+		r := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			f, err := readHTTP2Frame(r, http2MaxFrameSize)
+			if err != nil {
+				break
+			}
+			if f.typ == frameWindowUpdate {
+				t.Log("No window should be given back before the handler read the body")
+				t.Fail()
+			}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		close(release)
+		conn.Write(appendHTTP2Frame(nil, frameData, flagEndStream, 1, nil))
+
+		given := uint32(0)
+		var body []byte
+		for {
+			f, err := readHTTP2Frame(r, http2MaxFrameSize)
+			if err != nil {
+				t.Logf("There should be no error: %s", err.Error())
+				t.FailNow()
+			}
+			if f.typ == frameWindowUpdate && f.streamID == 0 {
+				given += binary.BigEndian.Uint32(f.payload)
+			}
+			if f.typ == frameData && f.streamID == 1 {
+				body = append(body, f.payload...)
+				if f.has(flagEndStream) {
+					break
+				}
+			}
+		}
+
+		if given != 1000 || string(body) != "1000" {
+			t.Logf("The window of the 1000 bytes read should be given back, got %d and %q", given, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should multiplex concurrent requests", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan string, 50)
+
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				expected := fmt.Sprintf("stream%d", i)
+				res, err := client.Get("https://" + tlsAddr + "/echo/" + expected)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				body, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+
+				if string(body) != expected {
+					errs <- fmt.Sprintf("expected %s, got %s", expected, body)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for e := range errs {
+			t.Log(e)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 404 for unknown routes", func(t *testing.T) {
+		res, err := client.Get("https://" + tlsAddr + "/nothing/here/at/all")
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+		res.Body.Close()
+
+		if res.StatusCode != 404 {
+			t.Logf("Status should be 404, was %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should give the handlers the request headers", func(t *testing.T) {
+		res, err := client.Get("https://" + tlsAddr + "/user-agent")
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if !strings.HasPrefix(string(body), "Go-http-client") {
+			t.Logf("Should get the user agent, got %q", body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should upgrade a cleartext request to h2c", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET /echo/upgraded HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"))
+
+		r := bufio.NewReader(conn)
+		statusLine, _ := r.ReadString('\n')
+		if !strings.HasPrefix(statusLine, "HTTP/1.1 101") {
+			t.Logf("Should switch protocols, got %q", statusLine)
+			t.FailNow()
+		}
+		for line, _ := r.ReadString('\n'); line != "\r\n"; line, _ = r.ReadString('\n') {
+		}
+
+		conn.Write([]byte(http2Preface))
+		conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+
+		status, body := readStream(t, r, 1)
+
+		if status != "200" || string(body) != "upgraded" {
+			t.Logf("Stream 1 should answer the upgraded request, got %s %q", status, body)
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const defaultJSONBodyLimit = 1 << 20
+
+// jsonBindError is a request body that could not be bound, with the status it is answered with
+type jsonBindError struct {
+	status  int
+	message string
+}
+
+func (e *jsonBindError) Error() string {
+	return e.message
+}
+
+// decodeJSON decodes the JSON body of the request into v. The body has to be sent as
+// application/json or a +json type, be at most limit bytes, defaultJSONBodyLimit when limit is not
+// above 0, hold a single value and only have the fields v knows about
+func decodeJSON(props *reqProps, v any, limit int64) error {
+	if limit <= 0 {
+		limit = defaultJSONBodyLimit
+	}
+
+	mediaType, params, err := mime.ParseMediaType(props.header("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))) {
+		return &jsonBindError{415, "the body should be sent as application/json"}
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return &jsonBindError{415, "the body should be encoded in utf-8"}
+	}
+
+	// a streamed body is never read past the limit, one byte more tells it is over
+	tooLarge := &jsonBindError{413, "the body should be at most " + strconv.FormatInt(limit, 10) + " bytes"}
+	body, err := io.ReadAll(io.LimitReader(props.bodyStream(), limit+1))
+	if errors.Is(err, errBodyTooLarge) {
+		return tooLarge
+	}
+	if err != nil {
+		return &jsonBindError{400, "the body could not be read"}
+	}
+	if int64(len(body)) > limit {
+		return tooLarge
+	}
+	props.body, props.bodyReader = body, nil
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &jsonBindError{400, "the body is empty"}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return &jsonBindError{400, jsonErrorMessage(err)}
+	}
+
+	// a second value after the first one is most likely a client bug, it is not silently dropped
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return &jsonBindError{400, "the body should hold a single JSON value"}
+	}
+
+	return nil
+}
+
+// jsonErrorMessage tells the client what is wrong with the body without the go types of the
+// messages of encoding/json
+func jsonErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("the body is not valid JSON at byte %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "the body is not valid JSON, it ends too early"
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("the field %s should be of type %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()))
+		}
+		return "the body should be of type " + jsonTypeName(typeErr.Type.Kind().String())
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for it
+		return "the field " + strings.TrimPrefix(err.Error(), "json: unknown field ") + " is unknown"
+	default:
+		return "the body is not valid JSON"
+	}
+}
+
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "array"
+	case kind == "struct", kind == "map":
+		return "object"
+	default:
+		return kind
+	}
+}
+
+// bindJSON decodes the body into v like decodeJSON and answers the request itself when it can
+// not, the handler goes on only when it returns true
+func (s *server) bindJSON(props *reqProps, conn net.Conn, v any, limit int64) bool {
+	err := decodeJSON(props, v, limit)
+	if err == nil {
+		return true
+	}
+
+	var bindErr *jsonBindError
+	if !errors.As(err, &bindErr) {
+		bindErr = &jsonBindError{400, err.Error()}
+	}
+	s.writeJSONError(bindErr.status, bindErr.message, conn)
+	return false
+}
+
+// writeJSON answers with v encoded as JSON, a value that can not be encoded is answered 500
+func (s *server) writeJSON(status int, v any, conn net.Conn) int {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Error while encoding the JSON response : ", err.Error())
+		s.writeInternalError(conn)
+		return -1
+	}
+
+	var headers = map[string]string{
+		"Content-Type":           "application/json",
+		"Content-Length":         strconv.Itoa(len(body)),
+		"X-Content-Type-Options": "nosniff",
+	}
+	return s.writeResponse(status, headers, string(body), conn)
+}
+
+// writeJSONError answers with a {"error": message} body
+func (s *server) writeJSONError(status int, message string, conn net.Conn) int {
+	return s.writeJSON(status, map[string]string{"error": message}, conn)
+}
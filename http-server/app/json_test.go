@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testItem struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+}
+
+func jsonProps(contentType string, body string) *reqProps {
+	return &reqProps{
+		method:  "POST",
+		request: &reqPath{},
+		headers: map[string]string{"Content-Type": contentType},
+		body:    []byte(body),
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	t.Run("Should decode a valid body", func(t *testing.T) {
+		for _, contentType := range []string{"application/json", "application/json; charset=UTF-8", "application/merge-patch+json"} {
+			var item testItem
+			err := decodeJSON(jsonProps(contentType, `{"name":"pen","count":2,"tags":["office"]}`), &item, 1024)
+
+			if err != nil || item.Name != "pen" || item.Count != 2 || len(item.Tags) != 1 {
+				t.Logf("the body sent as %s should be decoded, got %+v %v", contentType, item, err)
+				t.Fail()
+			}
+		}
+	})
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		message     string
+	}{
+		{"Should answer 415 to a body that is not JSON", "text/plain", `{"name":"pen"}`, 415, "the body should be sent as application/json"},
+		{"Should answer 415 to a body without a type", "", `{"name":"pen"}`, 415, "the body should be sent as application/json"},
+		{"Should answer 415 to a charset other than utf-8", "application/json; charset=latin1", `{"name":"pen"}`, 415, "the body should be encoded in utf-8"},
+		{"Should answer 413 to a body over the limit", "application/json", `{"name":"` + strings.Repeat("a", 64) + `"}`, 413, "the body should be at most 32 bytes"},
+		{"Should answer 400 to an empty body", "application/json", "  ", 400, "the body is empty"},
+		{"Should answer 400 to an unknown field", "application/json", `{"name":"pen","price":3}`, 400, `the field "price" is unknown`},
+		{"Should answer 400 to a field of the wrong type", "application/json", `{"count":"two"}`, 400, "the field count should be of type number"},
+		{"Should answer 400 to a body of the wrong type", "application/json", `[1]`, 400, "the body should be of type object"},
+		{"Should answer 400 to invalid JSON", "application/json", `{"name":pen}`, 400, "the body is not valid JSON at byte 9"},
+		{"Should answer 400 to a cut body", "application/json", `{"name":"pen"`, 400, "the body is not valid JSON, it ends too early"},
+		{"Should answer 400 to a second value", "application/json", `{"name":"pen"} {}`, 400, "the body should hold a single JSON value"},
+	}
+
+	t.Run("Should stop reading a streamed body past the limit", func(t *testing.T) {
+		props := jsonProps("application/json", "")
+		body := strings.NewReader(`{"name":"` + strings.Repeat("a", 1000) + `"}`)
+		props.bodyReader = body
+
+		var item testItem
+		err := decodeJSON(props, &item, 32)
+
+		var bindErr *jsonBindError
+		if !errors.As(err, &bindErr) || bindErr.status != 413 {
+			t.Logf("the body should be answered 413, got %v", err)
+			t.Fail()
+		}
+		if read := body.Size() - int64(body.Len()); read != 33 {
+			t.Logf("only one byte past the limit should be read, %d were", read)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should apply the default limit when there is none", func(t *testing.T) {
+		var item testItem
+		err := decodeJSON(jsonProps("application/json", `{"name":"`+strings.Repeat("a", defaultJSONBodyLimit)+`"}`), &item, 0)
+
+		var bindErr *jsonBindError
+		if !errors.As(err, &bindErr) || bindErr.status != 413 {
+			t.Logf("the body over the default limit should be answered 413, got %v", err)
+			t.Fail()
+		}
+	})
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var item testItem
+			err := decodeJSON(jsonProps(c.contentType, c.body), &item, 32)
+
+			var bindErr *jsonBindError
+			if !errors.As(err, &bindErr) || bindErr.status != c.status || bindErr.message != c.message {
+				t.Logf("expected %d %q, got %v", c.status, c.message, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestJSONHandlers(t *testing.T) {
+	addr := listen(t, testServer(t, func(s *server) error {
+		return s.registerMethodHandler("POST", "items", func(props *reqProps, conn net.Conn) {
+			var item testItem
+			if !s.bindJSON(props, conn, &item, defaultJSONBodyLimit) {
+				return
+			}
+			item.Count++
+			s.writeJSON(201, item, conn)
+		})
+	}), nil)
+
+	post := func(t *testing.T, contentType string, body string) (*http.Response, map[string]any) {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/items", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		// the server answers one request per connection, a POST is not retried on a closed one
+		req.Close = true
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		raw, _ := io.ReadAll(res.Body)
+		var decoded map[string]any
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatalf("the response should be JSON, got %q", raw)
+		}
+		return res, decoded
+	}
+
+	t.Run("Should answer with the JSON of the value", func(t *testing.T) {
+		res, decoded := post(t, "application/json", `{"name":"pen","count":1}`)
+
+		if res.StatusCode != 201 || res.Header.Get("Content-Type") != "application/json" || res.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Logf("the response should be a 201 JSON, got %d %v", res.StatusCode, res.Header)
+			t.Fail()
+		}
+
+		if decoded["name"] != "pen" || decoded["count"] != float64(2) {
+			t.Logf("the item should be sent back counted, got %v", decoded)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer the binding errors with a JSON error", func(t *testing.T) {
+		res, decoded := post(t, "text/plain", `{}`)
+
+		if res.StatusCode != 415 || decoded["error"] != "the body should be sent as application/json" {
+			t.Logf("the request should be answered 415 with the reason, got %d %v", res.StatusCode, decoded)
+			t.Fail()
+		}
+	})
+}
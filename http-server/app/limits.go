@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxRequestLine = 8 << 10
+	defaultMaxHeaderCount = 100
+	defaultMaxHeaderBytes = 64 << 10
+	defaultMaxBody        = 32 << 20
+)
+
+var (
+	errRequestLineTooLong = errors.New("the request line is too long")
+	errHeadersTooLarge    = errors.New("the request headers are too large")
+)
+
+// limits bound the size of the requests so a client can not make the server buffer as much as it
+// wants, a zero value disables the limit
+type limits struct {
+	requestLine int
+	headerCount int
+	headerBytes int
+	body        int64
+}
+
+// limitStatus gives the status answering a request refused for its size
+func limitStatus(err error) int {
+	switch {
+	case errors.Is(err, errRequestLineTooLong):
+		return 414
+	case errors.Is(err, errHeadersTooLarge):
+		return 431
+	case errors.Is(err, errBodyTooLarge):
+		return 413
+	}
+	return 0
+}
+
+// checkHead looks at the request read so far, the head can still be incomplete so the limits are
+// checked as the bytes arrive instead of once everything was buffered
+func (l limits) checkHead(data []byte) error {
+	lineEnd := bytes.Index(data, []byte(HttpPartSeperator))
+	if lineEnd == -1 {
+		lineEnd = len(data)
+	}
+
+	if l.requestLine > 0 && lineEnd > l.requestLine {
+		return errRequestLineTooLong
+	}
+
+	if lineEnd == len(data) {
+		return nil
+	}
+
+	headers := data[lineEnd:]
+	if end := bytes.Index(headers, []byte("\r\n\r\n")); end != -1 {
+		headers = headers[:end]
+	}
+
+	if l.headerBytes > 0 && len(headers) > l.headerBytes {
+		return errHeadersTooLarge
+	}
+
+	if l.headerCount > 0 && bytes.Count(headers, []byte(HttpPartSeperator)) > l.headerCount {
+		return errHeadersTooLarge
+	}
+
+	return nil
+}
+
+// setBodyLimit gives the route its own limit on the request bodies in place of the server one,
+// a negative limit lets the route take bodies of any size
+func (s *server) setBodyLimit(path string, limit int64) {
+	s.nodeFor(path).maxBody = limit
+}
+
+// bodyLimit gives the largest body accepted on the path of the host, the one of its route when it
+// has one
+func (s *server) bodyLimit(host string, target string) int64 {
+	if n := s.targetNode(host, target); n != nil && n.maxBody != 0 {
+		return n.maxBody
+	}
+
+	return s.limits.body
+}
+
+// parseBodyLimits reads the route=bytes values of the -route-body-limit flag
+func parseBodyLimits(values []string) (map[string]int64, error) {
+	routeLimits := make(map[string]int64, len(values))
+
+	for _, v := range values {
+		route, size, found := strings.Cut(v, "=")
+		if !found {
+			return nil, fmt.Errorf("route body limit %s should be written route=bytes", v)
+		}
+
+		limit, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("route body limit %s should be written route=bytes", v)
+		}
+
+		routeLimits[strings.Trim(route, "/")] = limit
+	}
+
+	return routeLimits, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	serve := func(t *testing.T, l limits) (*server, string) {
+		s := routesServer(t)
+		s.limits = l
+
+		return s, listen(t, s, nil)
+	}
+
+	_, addr := serve(t, limits{requestLine: 64, headerCount: 3, headerBytes: 256, body: 5})
+
+	cases := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{"Should answer 414 to a long request line", "GET /echo/" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 414 URI Too Long"},
+		{"Should answer 431 to too many headers", "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"Should answer 431 to headers too large", "GET / HTTP/1.1\r\nHost: localhost\r\nA: " + strings.Repeat("a", 300) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"Should answer 413 to a body too large without reading it", "POST /files/big HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n", "HTTP/1.1 413 Content Too Large"},
+		{"Should accept requests within the limits", "POST /files/small HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nsmall", "HTTP/1.1 201 Created"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := slowClient(t, addr, 0, c.request)
+
+			if !strings.HasPrefix(res, c.expected) {
+				t.Logf("Should answer %q, got %q", c.expected, res)
+				t.Fail()
+			}
+		})
+	}
+
+	t.Run("Should refuse a head that never ends before it is all sent", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nA: "))
+
+		// the server answers and stops reading while the client is still sending the header
+		done := make(chan string)
+		go func() {
+			buffer := make([]byte, 512)
+			n, _ := conn.Read(buffer)
+			done <- string(buffer[:n])
+		}()
+
+		for i := 0; i < 100; i++ {
+			if _, err := conn.Write([]byte(strings.Repeat("a", 1024))); err != nil {
+				break
+			}
+		}
+
+		select {
+		case res := <-done:
+			if !strings.HasPrefix(res, "HTTP/1.1 431") {
+				t.Logf("Should answer 431, got %q", res)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("The server should have answered")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should use the limit of the route over the server one", func(t *testing.T) {
+		s, routeAddr := serve(t, limits{body: 5})
+		s.setBodyLimit("files/{filename}", 10)
+
+		res := slowClient(t, routeAddr, 0, "POST /files/route HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n\r\n12345678")
+		if !strings.HasPrefix(res, "HTTP/1.1 201") {
+			t.Logf("The route should take 8 bytes, got %q", res)
+			t.Fail()
+		}
+
+		res = slowClient(t, routeAddr, 0, "POST /files/route HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\n")
+		if !strings.HasPrefix(res, "HTTP/1.1 413") {
+			t.Logf("The route should refuse 11 bytes, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 413 on http2 streams", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		block := encodeHeaders([]headerField{
+			{name: ":method", value: "POST"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/files/h2"},
+			{name: ":authority", value: "localhost"},
+		})
+
+		conn.Write([]byte(http2Preface))
+		conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+		conn.Write(appendHTTP2Frame(nil, frameHeaders, flagEndHeaders, 1, block))
+		conn.Write(appendHTTP2Frame(nil, frameData, 0, 1, []byte("more than five")))
+
+		if status, _ := readStream(t, conn, 1); status != "413" {
+			t.Logf("Status should be 413, was %s", status)
+			t.Fail()
+		}
+	})
+}
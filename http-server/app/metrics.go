@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsRoute = "metrics"
+
+// durationBuckets are the upper bounds in seconds of the latency histogram buckets
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// knownMethods keeps the method label bounded, anything else a client sends is counted as OTHER
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// metrics counts what the server does, exposed in the prometheus text format. Routes are labelled
+// with the template they were registered with so the number of series stays bounded
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[requestSeries]uint64
+	durations map[durationSeries]*histogram
+
+	inFlight        atomic.Int64
+	openConnections atomic.Int64
+	bytesIn         atomic.Int64
+	bytesOut        atomic.Int64
+	parseErrors     atomic.Int64
+
+	queuedConnections   atomic.Int64
+	rejectedConnections atomic.Int64
+	queueWait           histogram
+}
+
+type requestSeries struct {
+	route  string
+	method string
+	status int
+}
+
+type durationSeries struct {
+	route  string
+	method string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[requestSeries]uint64),
+		durations: make(map[durationSeries]*histogram),
+		queueWait: histogram{counts: make([]uint64, len(durationBuckets))},
+	}
+}
+
+// observe records a finished request
+func (m *metrics) observe(props *reqProps, rc *responseConn, duration time.Duration) {
+	route := props.route
+	if route == "" {
+		route = "unmatched"
+	}
+
+	method := props.method
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+
+	bytesIn := int64(len(props.body))
+	if props.bodyReader != nil {
+		// a streamed body is not kept, its length is the announced one
+		bytesIn, _ = strconv.ParseInt(props.header("Content-Length"), 10, 64)
+	}
+	m.bytesIn.Add(bytesIn)
+	m.bytesOut.Add(rc.bodyBytes)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestSeries{route: route, method: method, status: rc.status}]++
+
+	key := durationSeries{route: route, method: method}
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[key] = h
+	}
+
+	h.observe(duration)
+}
+
+// observeQueueWait records how long a connection waited for a worker
+func (m *metrics) observeQueueWait(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queueWait.observe(wait)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// writeTo writes every metric in the prometheus text exposition format, series sorted so two
+// scrapes can be compared
+func (m *metrics) writeTo(w io.Writer) error {
+	var b strings.Builder
+
+	m.mu.Lock()
+
+	requests := make([]requestSeries, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, c := requests[i], requests[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.status < c.status
+	})
+
+	writeHelp(&b, "http_requests_total", "counter", "Requests answered by route template, method and status.")
+	for _, k := range requests {
+		fmt.Fprintf(&b, "http_requests_total{route=%s,method=%s,status=\"%d\"} %d\n", labelValue(k.route), labelValue(k.method), k.status, m.requests[k])
+	}
+
+	durations := make([]durationSeries, 0, len(m.durations))
+	for k := range m.durations {
+		durations = append(durations, k)
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		if durations[i].route != durations[j].route {
+			return durations[i].route < durations[j].route
+		}
+		return durations[i].method < durations[j].method
+	})
+
+	writeHelp(&b, "http_request_duration_seconds", "histogram", "Time taken to answer the requests by route template and method.")
+	for _, k := range durations {
+		writeHistogram(&b, "http_request_duration_seconds", "route="+labelValue(k.route)+",method="+labelValue(k.method), m.durations[k])
+	}
+
+	writeHelp(&b, "http_connection_queue_wait_seconds", "histogram", "Time the connections waited for a worker.")
+	writeHistogram(&b, "http_connection_queue_wait_seconds", "", &m.queueWait)
+
+	m.mu.Unlock()
+
+	writeHelp(&b, "http_requests_in_flight", "gauge", "Requests being answered.")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight.Load())
+
+	writeHelp(&b, "http_open_connections", "gauge", "Client connections open.")
+	fmt.Fprintf(&b, "http_open_connections %d\n", m.openConnections.Load())
+
+	writeHelp(&b, "http_request_body_bytes_total", "counter", "Bytes of request bodies received.")
+	fmt.Fprintf(&b, "http_request_body_bytes_total %d\n", m.bytesIn.Load())
+
+	writeHelp(&b, "http_response_body_bytes_total", "counter", "Bytes of response bodies sent.")
+	fmt.Fprintf(&b, "http_response_body_bytes_total %d\n", m.bytesOut.Load())
+
+	writeHelp(&b, "http_parse_errors_total", "counter", "Requests that could not be parsed.")
+	fmt.Fprintf(&b, "http_parse_errors_total %d\n", m.parseErrors.Load())
+
+	writeHelp(&b, "http_queued_connections", "gauge", "Connections waiting for a worker.")
+	fmt.Fprintf(&b, "http_queued_connections %d\n", m.queuedConnections.Load())
+
+	writeHelp(&b, "http_rejected_connections_total", "counter", "Connections answered 503 as the server was full.")
+	fmt.Fprintf(&b, "http_rejected_connections_total %d\n", m.rejectedConnections.Load())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// registerMetrics exposes the metrics of the server on GET /metrics
+func (s *server) registerMetrics() error {
+	return s.registerMethodHandler("GET", metricsRoute, func(props *reqProps, conn net.Conn) {
+		var b strings.Builder
+		s.metrics.writeTo(&b)
+
+		headers := map[string]string{
+			"Content-Type":   "text/plain; version=0.0.4; charset=utf-8",
+			"Content-Length": strconv.Itoa(b.Len()),
+		}
+
+		if s.writeResponse(200, headers, b.String(), conn) == -1 {
+			fmt.Println("we could not answer the request")
+		}
+	})
+}
+
+// writeHistogram writes the buckets, sum and count of the histogram, labels are added to each line
+func writeHistogram(b *strings.Builder, name string, labels string, h *histogram) {
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, suffix, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, suffix, h.count)
+}
+
+func writeHelp(b *strings.Builder, name string, typ string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelValue quotes the value escaping what the text format requires
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
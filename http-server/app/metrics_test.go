@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := routesServer(t)
+	s.metrics = newMetrics()
+	if err := s.registerMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	addr := listen(t, s, nil)
+
+	logRequest(t, addr, "GET /files/a HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	logRequest(t, addr, "GET /files/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	logRequest(t, addr, "GET /echo/hello HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	logRequest(t, addr, "BREW /nothing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	logRequest(t, addr, "POST /files/c HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\ndata")
+	logRequest(t, addr, "garbage\r\nnot a header\r\n\r\n")
+
+	res := logRequest(t, addr, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	t.Run("Should label the requests with the route templates", func(t *testing.T) {
+		expected := []string{
+			`http_requests_total{route="/files/{filename}",method="GET",status="404"} 2`,
+			`http_requests_total{route="/files/{filename}",method="POST",status="201"} 1`,
+			`http_requests_total{route="/echo/{str}",method="GET",status="200"} 1`,
+			`http_requests_total{route="unmatched",method="OTHER",status="404"} 1`,
+			`http_request_duration_seconds_bucket{route="/echo/{str}",method="GET",le="+Inf"} 1`,
+			`http_request_duration_seconds_count{route="/files/{filename}",method="GET"} 2`,
+			"# TYPE http_request_duration_seconds histogram",
+		}
+
+		for _, line := range expected {
+			if !strings.Contains(res, line+"\n") {
+				t.Logf("Metrics should have the line %s", line)
+				t.Fail()
+			}
+		}
+
+		if strings.Contains(res, "/files/a") || strings.Contains(res, "BREW") {
+			t.Log("Raw paths and unknown methods should not be labels")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should count the connections, bytes and parse errors", func(t *testing.T) {
+		expected := []string{
+			"http_requests_in_flight 1",
+			"http_open_connections 1",
+			"http_request_body_bytes_total 4",
+			"http_response_body_bytes_total 5",
+			"http_parse_errors_total 1",
+		}
+
+		for _, line := range expected {
+			if !strings.Contains(res, line+"\n") {
+				t.Logf("Metrics should have the line %s", line)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should escape the label values", func(t *testing.T) {
+		if labelValue("a\"b\\c\nd") != `"a\"b\\c\nd"` {
+			t.Logf("Label was not escaped right: %s", labelValue("a\"b\\c\nd"))
+			t.Fail()
+		}
+	})
+}
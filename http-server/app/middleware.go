@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+)
+
+type handlerFunc func(props *reqProps, conn net.Conn)
+
+// middleware wraps a handler to run code before and after it, it is given the next handler of the chain
+type middleware func(next handlerFunc) handlerFunc
+
+// use adds a middleware to every route, the first one added is the first one to run
+func (s *server) use(m middleware) {
+	s.middlewares = append(s.middlewares, m)
+}
+
+// useOn adds a middleware to a single route, it runs after the ones of the server
+func (s *server) useOn(path string, m middleware) {
+	n := s.nodeFor(path)
+	n.middlewares = append(n.middlewares, m)
+}
+
+// useBelow adds a middleware to the route and every route below it, like a cors group. It runs
+// after the ones of the server and of the route itself
+func (s *server) useBelow(path string, m middleware) {
+	n := s.nodeFor(path)
+	n.groupMiddlewares = append(n.groupMiddlewares, m)
+}
+
+// useLast adds a middleware to every route that runs after all the others, right before the
+// handler, like the decoding of the body that should come after the checks of the route
+func (s *server) useLast(m middleware) {
+	s.lastMiddlewares = append(s.lastMiddlewares, m)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// registerHTTPHandler serves the path with a net/http handler, the values of the templates of the
+// path are given to it as path values like net/http routes do
+func (s *server) registerHTTPHandler(path string, h http.Handler) error {
+	return s.registerHandler(path, s.httpHandler(path, h))
+}
+
+// httpHandler adapts a net/http handler to the handlers of the tree, the route is the path it is
+// registered on so the template values can be named. It can be given to registerMethodHandler
+func (s *server) httpHandler(route string, h http.Handler) func(props *reqProps, conn net.Conn) {
+	var names []string
+	for _, part := range strings.Split(route, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			names = append(names, strings.TrimSuffix(strings.Trim(part, "{}"), "..."))
+		}
+	}
+
+	return func(props *reqProps, conn net.Conn) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req, err := httpRequest(ctx, props, conn)
+		if err != nil {
+			fmt.Println("Error while building the net/http request : ", err.Error())
+			s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", conn)
+			return
+		}
+
+		for i, name := range names {
+			if i >= len(props.request.params) {
+				break
+			}
+			value, unescapeErr := url.PathUnescape(props.request.params[i])
+			if unescapeErr != nil {
+				value = props.request.params[i]
+			}
+			req.SetPathValue(name, value)
+		}
+
+		w := &connResponseWriter{s: s, conn: conn, header: make(http.Header)}
+		h.ServeHTTP(w, req)
+
+		// net/http answers with an empty body when the handler wrote none
+		if !w.headSent {
+			if w.header.Get("Content-Length") == "" && bodyAllowed(w.statusCode()) {
+				w.header.Set("Content-Length", "0")
+			}
+			w.sendHead(nil)
+		}
+	}
+}
+
+// httpRequest builds the net/http request of the props, the body is served from memory or from
+// the connection on the routes streaming it
+func httpRequest(ctx context.Context, props *reqProps, conn net.Conn) (*http.Request, error) {
+	target := props.target
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + props.request.path
+		if props.request.query != "" {
+			target += "?" + props.request.query
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, props.method, target, props.bodyStream())
+	if err != nil {
+		return nil, err
+	}
+
+	if major, minor, ok := http.ParseHTTPVersion(props.version); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = props.version, major, minor
+	}
+
+	for name, value := range props.headers {
+		req.Header[textproto.CanonicalMIMEHeaderKey(name)] = []string{value}
+	}
+	req.Host = props.header("Host")
+	req.Header.Del("Host")
+
+	req.RequestURI = target
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.TLS = tlsState(conn)
+
+	return req, nil
+}
+
+// connResponseWriter is the http.ResponseWriter given to net/http handlers, the response goes
+// through the server helpers so the middlewares still see its head. Like net/http the head is
+// only sent with the first bytes of the body, so the handler can change the headers until then
+type connResponseWriter struct {
+	s        *server
+	conn     net.Conn
+	header   http.Header
+	status   int
+	headSent bool
+}
+
+func (w *connResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader sets the status of the response, informational ones are not sent as the client
+// gets the final one
+func (w *connResponseWriter) WriteHeader(status int) {
+	if w.status != 0 || status < 200 {
+		return
+	}
+	w.status = status
+}
+
+func (w *connResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// sendHead writes the head, the Content-Type is guessed from the first bytes of the body when the
+// handler set none. Headers with several values are sent as several lines
+func (w *connResponseWriter) sendHead(first []byte) {
+	w.headSent = true
+	status := w.statusCode()
+
+	if len(first) > 0 && w.header.Get("Content-Type") == "" && w.header.Get("Transfer-Encoding") == "" {
+		w.header.Set("Content-Type", http.DetectContentType(first))
+	}
+
+	headers := make(map[string]string, len(w.header))
+	for name, values := range w.header {
+		if len(values) > 0 {
+			headers[name] = strings.Join(values, "\n")
+		}
+	}
+
+	if err := w.s.writeHead(status, headers, w.conn); err != nil {
+		fmt.Println("Error while writing the response head : ", err.Error())
+	}
+}
+
+func (w *connResponseWriter) Write(b []byte) (int, error) {
+	if !bodyAllowed(w.statusCode()) {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	if !w.headSent {
+		w.sendHead(b)
+	}
+
+	return w.conn.Write(b)
+}
+
+// Flush pushes the bytes buffered by the encoders, for the handlers streaming their response
+func (w *connResponseWriter) Flush() {
+	if !w.headSent {
+		w.sendHead(nil)
+	}
+
+	if rc, ok := w.conn.(*responseConn); ok {
+		if err := rc.flush(); err != nil {
+			fmt.Println("Error while flushing the response : ", err.Error())
+		}
+	}
+}
+
+// ServeHTTP lets the router serve a net/http server, the routes, middlewares and limits are the
+// same as when the server accepts the connections itself
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	props, err := requestProps(r, s.bodyLimit(r.Host, r.URL.RequestURI()))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(status)
+		return
+	}
+
+	rc := newResponseConn(&handlerConn{w: w, r: r}, props)
+	start := s.beginRequest(props, rc)
+
+	if hErr := s.serve(props, rc); hErr != nil {
+		s.writeResponse(404, make(map[string]string), "", rc)
+	}
+
+	if fErr := rc.finish(); fErr != nil {
+		fmt.Println("Error while finishing the response : ", fErr.Error())
+	}
+
+	s.endRequest(props, rc, start)
+}
+
+// requestProps gives the props of a net/http request, reading its body up to the limit
+func requestProps(r *http.Request, limit int64) (*reqProps, error) {
+	var body []byte
+	if r.Body != nil {
+		reader := io.Reader(r.Body)
+		if limit > 0 {
+			reader = io.LimitReader(r.Body, limit+1)
+		}
+
+		var err error
+		if body, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+		if limit > 0 && int64(len(body)) > limit {
+			return nil, errBodyTooLarge
+		}
+	}
+
+	headers := make(map[string]string, len(r.Header)+1)
+	for name, values := range r.Header {
+		separator := ", "
+		if name == "Cookie" {
+			separator = "; "
+		}
+		headers[name] = strings.Join(values, separator)
+	}
+	headers["Host"] = r.Host
+
+	return &reqProps{
+		method:  r.Method,
+		version: r.Proto,
+		request: &reqPath{
+			path:  strings.TrimPrefix(r.URL.EscapedPath(), "/"),
+			query: r.URL.RawQuery,
+		},
+		headers: headers,
+		body:    body,
+		target:  r.RequestURI,
+	}, nil
+}
+
+// handlerConn is the connection of a request served through ServeHTTP, the head and body
+// written by the handlers go to the net/http response writer
+type handlerConn struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	headSent bool
+}
+
+func (hc *handlerConn) writeHead(status int, headers map[string]string) error {
+	for name, value := range headers {
+		// net/http frames the body itself
+		if strings.EqualFold(name, "Transfer-Encoding") || strings.EqualFold(name, "Connection") {
+			continue
+		}
+		hc.w.Header()[textproto.CanonicalMIMEHeaderKey(name)] = strings.Split(value, "\n")
+	}
+
+	hc.w.WriteHeader(status)
+	hc.headSent = true
+	return nil
+}
+
+// endStream answers 500 for a handler that never answered, net/http would send a 200
+func (hc *handlerConn) endStream() error {
+	if !hc.headSent {
+		hc.w.WriteHeader(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Write sends the bytes right away as the handlers expect from a connection
+func (hc *handlerConn) Write(b []byte) (int, error) {
+	n, err := hc.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if flushErr := http.NewResponseController(hc.w).Flush(); flushErr != nil && !errors.Is(flushErr, http.ErrNotSupported) {
+		return n, flushErr
+	}
+	return n, nil
+}
+
+// Read has nothing to give, the whole request body was read before the handler was called
+func (hc *handlerConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (hc *handlerConn) Close() error {
+	return nil
+}
+
+func (hc *handlerConn) LocalAddr() net.Addr {
+	if addr, ok := hc.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return handlerAddr("")
+}
+
+func (hc *handlerConn) RemoteAddr() net.Addr {
+	return handlerAddr(hc.r.RemoteAddr)
+}
+
+func (hc *handlerConn) SetDeadline(t time.Time) error {
+	if err := hc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return hc.SetWriteDeadline(t)
+}
+
+func (hc *handlerConn) SetReadDeadline(t time.Time) error {
+	if err := http.NewResponseController(hc.w).SetReadDeadline(t); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (hc *handlerConn) SetWriteDeadline(t time.Time) error {
+	if err := http.NewResponseController(hc.w).SetWriteDeadline(t); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// handlerAddr is the address of the client as net/http gives it, host:port
+type handlerAddr string
+
+func (a handlerAddr) Network() string {
+	return "tcp"
+}
+
+func (a handlerAddr) String() string {
+	return string(a)
+}
+
+// tlsState gives the tls state of the connection the request came on, nil for plain http
+func tlsState(conn net.Conn) *tls.ConnectionState {
+	if rc, ok := conn.(*responseConn); ok {
+		conn = rc.Conn
+	}
+	if hc, ok := conn.(*handlerConn); ok {
+		return hc.r.TLS
+	}
+	if st, ok := conn.(*http2Stream); ok {
+		conn = st.c.conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+
+	return nil
+}
+
+var _ http.Handler = (*server)(nil)
+var _ http.Flusher = (*connResponseWriter)(nil)
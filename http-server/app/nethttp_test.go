@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerOnRoute(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte("<html><body>static page</body></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, r.Method+" "+r.PathValue("name")+" "+r.URL.Query().Get("q")+" "+r.Host+" "+r.Header.Get("X-Test")+" "+string(body))
+	})
+
+	addr := listen(t, testServer(t, func(s *server) error {
+		if err := s.registerHTTPHandler("echo/{name}", echo); err != nil {
+			return err
+		}
+		if err := s.registerHTTPHandler("static/{path...}", http.StripPrefix("/static/", http.FileServer(http.Dir(dir)))); err != nil {
+			return err
+		}
+		return s.registerHTTPHandler("empty", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}), nil)
+
+	t.Run("Should give the handler the request and send its response", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "http://"+addr+"/echo/hello%20world?q=1", strings.NewReader("payload"))
+		req.Header.Set("X-Test", "yes")
+		req.Close = true
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+
+		expected := "PUT hello world 1 " + addr + " yes payload"
+		if res.StatusCode != 202 || string(body) != expected {
+			t.Logf("the handler should answer 202 %q, got %d %q", expected, res.StatusCode, body)
+			t.Fail()
+		}
+
+		if len(res.Cookies()) != 2 || res.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Logf("both cookies and the sniffed type should be sent, got %v", res.Header)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should serve a net/http file server below a catch-all", func(t *testing.T) {
+		res, err := http.Get("http://" + addr + "/static/page.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+
+		if res.StatusCode != 200 || string(body) != "<html><body>static page</body></html>" || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Logf("the file should be served, got %d %q %v", res.StatusCode, body, res.Header)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 200 for a handler that wrote nothing", func(t *testing.T) {
+		res, err := http.Get("http://" + addr + "/empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != 200 || res.ContentLength != 0 {
+			t.Logf("an empty 200 should be sent, got %d %d", res.StatusCode, res.ContentLength)
+			t.Fail()
+		}
+	})
+}
+
+func TestServerAsHTTPHandler(t *testing.T) {
+	s := testServer(t, func(s *server) error {
+		s.limits = limits{body: 16}
+
+		if err := s.registerHandler("hello/{name}", func(props *reqProps, conn net.Conn) {
+			body := "hello " + props.request.params[0] + " " + string(props.body)
+			headers := map[string]string{"Content-Length": strconv.Itoa(len(body))}
+			setCookie(headers, &cookie{name: "a", value: "1"})
+			setCookie(headers, &cookie{name: "b", value: "2"})
+			s.writeResponse(200, headers, body, conn)
+		}); err != nil {
+			return err
+		}
+		return s.registerHandler("stream", func(props *reqProps, conn net.Conn) {
+			s.writeStream(200, map[string]string{"Content-Type": "text/plain"}, strings.NewReader("streamed body"), conn)
+		})
+	})
+
+	// a net/http middleware wrapping the router shows the two can be mixed
+	wrapped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Wrapped", "yes")
+		s.ServeHTTP(w, r)
+	})
+
+	ts := httptest.NewServer(wrapped)
+	t.Cleanup(ts.Close)
+
+	send := func(t *testing.T, method string, path string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	t.Run("Should route the request to the handler of the tree", func(t *testing.T) {
+		res, body := send(t, "POST", "/hello/alice", "hi")
+
+		if res.StatusCode != 200 || body != "hello alice hi" || res.Header.Get("X-Wrapped") != "yes" {
+			t.Logf("the route should answer, got %d %q %v", res.StatusCode, body, res.Header)
+			t.Fail()
+		}
+
+		if len(res.Cookies()) != 2 {
+			t.Logf("both cookies should be sent, got %v", res.Header.Values("Set-Cookie"))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should let net/http frame a streamed body", func(t *testing.T) {
+		res, body := send(t, "GET", "/stream", "")
+
+		if res.StatusCode != 200 || body != "streamed body" {
+			t.Logf("the streamed body should arrive whole, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 404 to an unknown path", func(t *testing.T) {
+		if res, _ := send(t, "GET", "/missing", ""); res.StatusCode != 404 {
+			t.Logf("an unknown path should be answered 404, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 413 to a body over the limit", func(t *testing.T) {
+		if res, _ := send(t, "POST", "/hello/bob", strings.Repeat("a", 32)); res.StatusCode != 413 {
+			t.Logf("a body over the limit should be answered 413, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+}
@@ -2,13 +2,28 @@ package main
 
 import (
 	"net"
+	"sort"
+	"strings"
 )
 
 type node struct {
-	path       string
-	template   bool
-	childPaths map[string]*node
-	handler    func(props *reqProps, conn net.Conn)
+	path        string
+	route       string
+	template    bool
+	catchAll    bool
+	childPaths  map[string]*node
+	handler     func(props *reqProps, conn net.Conn)
+	methods     map[string]func(props *reqProps, conn net.Conn)
+	websocket   wsHandlerFunc
+	maxBody     int64
+	streamBody  bool
+	middlewares []middleware
+	// groupMiddlewares also run for the routes below the node
+	groupMiddlewares []middleware
+	// authenticated is set on the nodes whose routes are behind an authentication
+	authenticated bool
+	parent        *node
+	cors          *corsPolicy
 }
 
 type tree struct {
@@ -27,6 +42,7 @@ func (t *tree) addRoot(root string, h func(props *reqProps, conn net.Conn)) *nod
 
 	r := &node{
 		path:       root,
+		route:      "/" + root,
 		template:   false,
 		childPaths: make(map[string]*node),
 		handler:    h,
@@ -42,11 +58,15 @@ func (n *node) addChild(path string, template bool, h func(props *reqProps, conn
 		n.childPaths = make(map[string]*node)
 	}
 
+	// the route is the template the node was registered with, what the metrics are labelled with
 	newNode := &node{
 		path:       path,
+		route:      strings.TrimSuffix(n.route, "/") + "/" + path,
 		template:   template,
+		catchAll:   template && strings.HasSuffix(path, "...}"),
 		childPaths: nil,
 		handler:    h,
+		parent:     n,
 	}
 
 	if _, ok := n.childPaths[path]; !ok {
@@ -57,3 +77,14 @@ func (n *node) addChild(path string, template bool, h func(props *reqProps, conn
 
 	return newNode
 }
+
+// allowedMethods lists the methods with a handler in the format of the Allow header
+func (n *node) allowedMethods() string {
+	methods := make([]string, 0, len(n.methods))
+	for m := range n.methods {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
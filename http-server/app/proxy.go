@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProxyDialTimeout     = 10 * time.Second
+	defaultProxyResponseTimeout = 30 * time.Second
+)
+
+var errProxyPathEscapes = errors.New("the proxied path goes above the path of the upstream")
+
+// hopByHopHeaders only describe one connection, a proxy drops them instead of forwarding them
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// proxyConfig describes where the requests are forwarded, the response timeout is the longest wait
+// for the head of the upstream response
+type proxyConfig struct {
+	pool            *upstreamPool
+	dialTimeout     time.Duration
+	responseTimeout time.Duration
+}
+
+type reverseProxy struct {
+	s         *server
+	cfg       proxyConfig
+	transport *http.Transport
+}
+
+func newReverseProxy(s *server, cfg proxyConfig) *reverseProxy {
+	if cfg.dialTimeout <= 0 {
+		cfg.dialTimeout = defaultProxyDialTimeout
+	}
+	if cfg.responseTimeout <= 0 {
+		cfg.responseTimeout = defaultProxyResponseTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout}
+
+	return &reverseProxy{
+		s:   s,
+		cfg: cfg,
+		transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: cfg.responseTimeout,
+			// the client negotiated the encoding with the upstream, the body is forwarded untouched
+			DisableCompression:  true,
+			MaxIdleConnsPerHost: 16,
+		},
+	}
+}
+
+// registerProxy forwards the requests for the prefix and every path below it to the upstream, the
+// part of the path after the prefix is appended to the path of the upstream
+func (s *server) registerProxy(prefix string, cfg proxyConfig) error {
+	p := newReverseProxy(s, cfg)
+	prefix = strings.Trim(prefix, "/")
+
+	if prefix != "" {
+		prefixErr := s.registerHandler(prefix, func(props *reqProps, conn net.Conn) {
+			p.serve(props, conn, "")
+		})
+		if prefixErr != nil {
+			return prefixErr
+		}
+	}
+
+	rest := "{path...}"
+	if prefix != "" {
+		rest = prefix + "/" + rest
+	}
+
+	restErr := s.registerHandler(rest, func(props *reqProps, conn net.Conn) {
+		params := props.request.params
+		p.serve(props, conn, params[len(params)-1])
+	})
+	if restErr != nil {
+		return restErr
+	}
+
+	// the bodies go upstream as they arrive instead of being buffered first
+	s.streamBody(prefix)
+	s.streamBody(rest)
+
+	return nil
+}
+
+// serve forwards the request to a backend of the pool and streams the upstream response back, an
+// upstream that can not be reached is answered 502 and one too slow to answer 504
+func (p *reverseProxy) serve(props *reqProps, conn net.Conn, rest string) {
+	b := p.cfg.pool.pick(props)
+	if b == nil {
+		fmt.Println("No upstream of the pool ", p.cfg.pool.name, " is available")
+		p.s.writeResponse(502, map[string]string{"Content-Length": "0"}, "", conn)
+		return
+	}
+
+	out, err := p.outgoing(props, conn, b.url, rest)
+	if err != nil {
+		p.cfg.pool.release(b, false)
+		p.s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", conn)
+		return
+	}
+
+	res, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.cfg.pool.release(b, true)
+		fmt.Println("Error forwarding the request upstream : ", err.Error())
+		p.s.writeResponse(upstreamErrorStatus(err), map[string]string{"Content-Length": "0"}, "", conn)
+		return
+	}
+	defer res.Body.Close()
+	// the request stays active until the whole body was sent, a backend answering that it can not
+	// serve the request counts as a failure
+	defer p.cfg.pool.release(b, res.StatusCode == 502 || res.StatusCode == 503 || res.StatusCode == 504)
+
+	p.s.relayResponse(res, conn)
+}
+
+// relayResponse streams the upstream response to the client without its hop by hop headers
+func (s *server) relayResponse(res *http.Response, conn net.Conn) {
+	headers := make(map[string]string, len(res.Header))
+	for name, values := range res.Header {
+		separator := ", "
+		if name == "Set-Cookie" {
+			separator = "\n"
+		}
+		headers[name] = strings.Join(values, separator)
+	}
+	removeHopByHop(headers)
+
+	deleteHeader(headers, "Content-Length")
+	if res.ContentLength >= 0 {
+		headers["Content-Length"] = strconv.FormatInt(res.ContentLength, 10)
+	}
+
+	if s.writeStream(res.StatusCode, headers, res.Body, conn) == -1 {
+		fmt.Println("we could not answer the request")
+	}
+}
+
+// outgoing builds the request sent to the upstream for the path after the prefix, a path going
+// above the path of the upstream is refused
+func (p *reverseProxy) outgoing(props *reqProps, conn net.Conn, upstream *url.URL, rest string) (*http.Request, error) {
+	// the path of the request is still escaped as the client sent it
+	rawPath := strings.TrimSuffix(upstream.EscapedPath(), "/") + "/" + rest
+	unescaped, err := url.PathUnescape(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	// dot segments, escaped or not, are resolved before checking where the path ends up
+	base := strings.TrimSuffix(upstream.Path, "/")
+	joined := base + "/" + unescaped
+	cleaned := path.Clean(joined)
+	if strings.HasSuffix(joined, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != base && !strings.HasPrefix(cleaned, base+"/") {
+		return nil, errProxyPathEscapes
+	}
+
+	target := url.URL{
+		Scheme:   upstream.Scheme,
+		Host:     upstream.Host,
+		Path:     cleaned,
+		RawQuery: props.request.query,
+	}
+	// the escaping of the client is kept when cleaning changed nothing
+	if cleaned == joined {
+		target.RawPath = rawPath
+	}
+
+	return forwardedRequest(props, conn, &target)
+}
+
+// forwardedRequest builds the request sent to the target, with the Host of the target and the
+// forwarding headers telling it who the client is
+func forwardedRequest(props *reqProps, conn net.Conn, target *url.URL) (*http.Request, error) {
+	out, err := http.NewRequest(props.method, target.String(), props.bodyStream())
+	if err != nil {
+		return nil, err
+	}
+
+	// a body streamed from the client goes upstream with the length it announced, a decoded one
+	// has no length and goes chunked
+	if props.bodyReader != nil {
+		length, _ := strconv.ParseInt(props.header("Content-Length"), 10, 64)
+		switch {
+		case props.header("Content-Length") == "":
+			out.ContentLength = -1
+		case length <= 0:
+			out.ContentLength, out.Body = 0, http.NoBody
+		default:
+			out.ContentLength = length
+		}
+	}
+
+	headers := make(map[string]string, len(props.headers))
+	for name, value := range props.headers {
+		headers[name] = value
+	}
+	removeHopByHop(headers)
+	deleteHeader(headers, "Host")
+	deleteHeader(headers, "Content-Length")
+
+	for name, value := range headers {
+		out.Header.Set(name, value)
+	}
+	out.Host = target.Host
+
+	// without a User-Agent from the client the transport would add its own
+	if out.Header.Get("User-Agent") == "" {
+		out.Header["User-Agent"] = []string{""}
+	}
+
+	clientIP := conn.RemoteAddr().String()
+	if host, _, splitErr := net.SplitHostPort(clientIP); splitErr == nil {
+		clientIP = host
+	}
+	scheme := requestScheme(conn)
+	host := props.header("Host")
+
+	if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+		out.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	out.Header.Set("X-Forwarded-Proto", scheme)
+	if host != "" {
+		out.Header.Set("X-Forwarded-Host", host)
+	}
+
+	forwarded := "for=" + forwardedNode(clientIP) + ";proto=" + scheme
+	if host != "" {
+		forwarded += ";host=" + forwardedValue(host)
+	}
+	if prior := out.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	out.Header.Set("Forwarded", forwarded)
+
+	return out, nil
+}
+
+// removeHopByHop drops the hop by hop headers and the ones the Connection header lists
+func removeHopByHop(headers map[string]string) {
+	for _, name := range strings.Split(headerValue(headers, "Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			deleteHeader(headers, name)
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		deleteHeader(headers, name)
+	}
+}
+
+// requestScheme tells if the client reached the server over tls
+func requestScheme(conn net.Conn) string {
+	if tlsState(conn) != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// upstreamErrorStatus answers 504 when the upstream was too slow and 502 when it failed otherwise
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 504
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 504
+	}
+
+	return 502
+}
+
+// forwardedNode writes the ip in the Forwarded header, ipv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes the value unless it is a token
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", r) && !('0' <= r && r <= '9') && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') {
+			return strconv.Quote(v)
+		}
+	}
+
+	return v
+}
+
+// parseProxies reads the prefix=upstream values of the -proxy flag, the upstream is the url of a
+// single server or the name of a pool
+func parseProxies(values []string, pools map[string]*upstreamPool) (map[string]*upstreamPool, error) {
+	proxies := make(map[string]*upstreamPool, len(values))
+
+	for _, v := range values {
+		prefix, upstream, found := strings.Cut(v, "=")
+		if !found {
+			return nil, fmt.Errorf("proxy %s should be written prefix=url or prefix=pool", v)
+		}
+		prefix = strings.Trim(prefix, "/")
+
+		if pool, ok := pools[upstream]; ok {
+			proxies[prefix] = pool
+			continue
+		}
+
+		u, err := parseUpstreamURL(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s should have an upstream url or pool name : %w", v, err)
+		}
+
+		proxies[prefix] = newUpstreamPool(u.Host, []*url.URL{u}, poolConfig{})
+	}
+
+	return proxies, nil
+}
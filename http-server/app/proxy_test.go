@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverseProxy(t *testing.T) {
+	serve := func(t *testing.T, upstream string, responseTimeout time.Duration) string {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pool := newUpstreamPool("test", []*url.URL{u}, poolConfig{})
+		return listen(t, testServer(t, func(s *server) error {
+			return s.registerProxy("api", proxyConfig{pool: pool, responseTimeout: responseTimeout})
+		}), nil)
+	}
+
+	t.Run("Should forward the request with the forwarding headers and without the hop by hop ones", func(t *testing.T) {
+		received := make(chan *http.Request, 1)
+		bodies := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			received <- r
+			bodies <- string(b)
+
+			w.Header().Add("Set-Cookie", "a=1")
+			w.Header().Add("Set-Cookie", "b=2")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(201)
+			io.WriteString(w, "created")
+		}))
+		defer upstream.Close()
+
+		addr := serve(t, upstream.URL+"/base", 0)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "POST /api/items/a%20b?x=1 HTTP/1.1\r\nHost: example.com\r\nConnection: X-Secret\r\nX-Secret: 1\r\nKeep-Alive: timeout=5\r\nX-Forwarded-For: 10.0.0.1\r\nX-Custom: kept\r\nContent-Length: 5\r\n\r\nhello")
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+
+		r := <-received
+		if r.URL.EscapedPath() != "/base/items/a%20b" || r.URL.RawQuery != "x=1" {
+			t.Logf("the request should be forwarded to /base/items/a%%20b?x=1, got %s?%s", r.URL.EscapedPath(), r.URL.RawQuery)
+			t.Fail()
+		}
+
+		if b := <-bodies; b != "hello" || r.Method != "POST" {
+			t.Logf("the upstream should get the POST body, got %s %q", r.Method, b)
+			t.Fail()
+		}
+
+		if r.Host != strings.TrimPrefix(upstream.URL, "http://") {
+			t.Logf("the Host should be the upstream one, got %s", r.Host)
+			t.Fail()
+		}
+
+		if r.Header.Get("X-Secret") != "" || r.Header.Get("Keep-Alive") != "" || r.Header.Get("Connection") != "" {
+			t.Logf("hop by hop headers should not be forwarded, got %v", r.Header)
+			t.Fail()
+		}
+
+		if r.Header.Get("X-Custom") != "kept" {
+			t.Log("end to end headers should be forwarded")
+			t.Fail()
+		}
+
+		if r.Header.Get("X-Forwarded-For") != "10.0.0.1, 127.0.0.1" || r.Header.Get("X-Forwarded-Proto") != "http" || r.Header.Get("X-Forwarded-Host") != "example.com" {
+			t.Logf("the X-Forwarded headers should describe the client, got %v", r.Header)
+			t.Fail()
+		}
+
+		if r.Header.Get("Forwarded") != "for=127.0.0.1;proto=http;host=example.com" {
+			t.Logf("the Forwarded header should describe the client, got %s", r.Header.Get("Forwarded"))
+			t.Fail()
+		}
+
+		if res.StatusCode != 201 || string(body) != "created" || res.Header.Get("X-Upstream") != "yes" {
+			t.Logf("the upstream response should be sent back, got %d %q", res.StatusCode, body)
+			t.Fail()
+		}
+
+		if res.Header.Get("Keep-Alive") != "" {
+			t.Log("hop by hop headers of the upstream response should not be sent back")
+			t.Fail()
+		}
+
+		if cookies := res.Header.Values("Set-Cookie"); len(cookies) != 2 {
+			t.Logf("every Set-Cookie of the upstream should be sent back, got %v", cookies)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should forward the prefix itself to the upstream path", func(t *testing.T) {
+		paths := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+		}))
+		defer upstream.Close()
+
+		addr := serve(t, upstream.URL, 0)
+
+		res, err := http.Get("http://" + addr + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if p := <-paths; p != "/" || res.StatusCode != 200 {
+			t.Logf("the prefix should be forwarded to the upstream root, got %s %d", p, res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should stream the upstream response as it arrives", func(t *testing.T) {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "first")
+			w.(http.Flusher).Flush()
+			<-release
+			io.WriteString(w, "second")
+		}))
+		defer upstream.Close()
+		defer close(release)
+
+		addr := serve(t, upstream.URL, 0)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, "GET /api/stream HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first := make([]byte, len("first"))
+		if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first" {
+			t.Logf("the first part should arrive before the upstream is done, got %q %v", first, err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should keep the requests below the path of the upstream", func(t *testing.T) {
+		paths := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+		}))
+		defer upstream.Close()
+
+		addr := serve(t, upstream.URL+"/base", 0)
+
+		for _, target := range []string{"/api/%2e%2e/secret", "/api/..%2Fsecret", "/api/items/%2E%2E/%2e%2e/%2e%2e/secret"} {
+			res := slowClient(t, addr, 0, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			if !strings.HasPrefix(res, "HTTP/1.1 400") {
+				t.Logf("%s should be refused, got %q", target, res)
+				t.Fail()
+			}
+		}
+
+		res := slowClient(t, addr, 0, "GET /api/items/%2e%2e/orders HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if p := <-paths; p != "/base/orders" || !strings.HasPrefix(res, "HTTP/1.1 200") {
+			t.Logf("the dot segments inside the upstream path should be resolved, got %s %q", p, res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should stream the request body to the upstream as it arrives", func(t *testing.T) {
+		received := make(chan string, 2)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			first := make([]byte, len("first"))
+			io.ReadFull(r.Body, first)
+			received <- string(first)
+
+			rest, _ := io.ReadAll(r.Body)
+			received <- string(rest)
+		}))
+		defer upstream.Close()
+
+		addr := serve(t, upstream.URL, 0)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("POST /api/upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 12\r\n\r\nfirst"))
+
+		select {
+		case first := <-received:
+			if first != "first" {
+				t.Logf("the upstream should get the first bytes, got %q", first)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the upstream should get the body before the client sent all of it")
+		}
+
+		conn.Write([]byte(" second"))
+		if rest := <-received; rest != " second" {
+			t.Logf("the upstream should get the rest of the body, got %q", rest)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 502 when the upstream can not be reached", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := "http://" + l.Addr().String()
+		l.Close()
+
+		addr := serve(t, closed, 0)
+
+		res, err := http.Get("http://" + addr + "/api/down")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != 502 {
+			t.Logf("an unreachable upstream should be answered 502, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 504 when the upstream is too slow", func(t *testing.T) {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer upstream.Close()
+		defer close(release)
+
+		addr := serve(t, upstream.URL, 100*time.Millisecond)
+
+		res, err := http.Get("http://" + addr + "/api/slow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != 504 {
+			t.Logf("a slow upstream should be answered 504, got %d", res.StatusCode)
+			t.Fail()
+		}
+	})
+}
+
+func TestCatchAllRoute(t *testing.T) {
+	s := &server{paths: create()}
+	rootCreation(s)
+
+	s.registerHandler("static/{file}", func(props *reqProps, conn net.Conn) {})
+	s.registerHandler("static/{path...}", func(props *reqProps, conn net.Conn) {})
+
+	t.Run("Should prefer a single segment template to the catch all", func(t *testing.T) {
+		props := &reqProps{request: &reqPath{path: "static/a.css"}}
+		n := s.lookup(props)
+
+		if n == nil || n.route != "/static/{file}" || props.request.params[0] != "a.css" {
+			t.Log("a single segment should match the template")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should give the rest of the path to the catch all", func(t *testing.T) {
+		props := &reqProps{request: &reqPath{path: "static/css/site/a.css"}}
+		n := s.lookup(props)
+
+		if n == nil || n.route != "/static/{path...}" || props.request.params[0] != "css/site/a.css" {
+			t.Log("the catch all should take the rest of the path")
+			t.Fail()
+		}
+	})
+}
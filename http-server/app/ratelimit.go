@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitBuckets = 10000
+	rateLimitSweepInterval  = time.Minute
+)
+
+// rateLimitConfig describes the token bucket of every client, rate tokens are added each second
+// up to burst and a request takes one. Clients are told apart by their ip, the header adds a
+// bucket of its own so clients sharing it share its limit
+type rateLimitConfig struct {
+	rate       float64
+	burst      int
+	header     string
+	maxBuckets int
+}
+
+// rateDecision is the answer of the limiter to a request, reset is how long the bucket of the client
+// takes to be full again and retryAfter how long until it has a token when the request is refused
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a bucket per client. A bucket idle long enough to be full again is the same as
+// no bucket, so those are dropped when the limiter grows, then the least recently used ones, and
+// the memory stays bounded
+type rateLimiter struct {
+	cfg       rateLimitConfig
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(cfg rateLimitConfig) *rateLimiter {
+	if cfg.maxBuckets <= 0 {
+		cfg.maxBuckets = defaultRateLimitBuckets
+	}
+
+	return &rateLimiter{
+		cfg:       cfg,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// allow takes a token from every bucket of the client when they all have one, the decision is
+// the one of the emptiest bucket
+func (rl *rateLimiter) allow(keys ...string) rateDecision {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		b, ok := rl.buckets[key]
+		if !ok {
+			rl.makeRoom(now)
+			b = &tokenBucket{tokens: float64(rl.cfg.burst), last: now}
+			rl.buckets[key] = b
+		}
+
+		b.tokens = math.Min(float64(rl.cfg.burst), b.tokens+now.Sub(b.last).Seconds()*rl.cfg.rate)
+		b.last = now
+		buckets[i] = b
+	}
+
+	tokens := float64(rl.cfg.burst)
+	for _, b := range buckets {
+		tokens = math.Min(tokens, b.tokens)
+	}
+
+	d := rateDecision{allowed: tokens >= 1}
+	if d.allowed {
+		for _, b := range buckets {
+			b.tokens--
+		}
+		tokens--
+	} else {
+		d.retryAfter = rl.refillTime(1 - tokens)
+	}
+
+	d.remaining = int(tokens)
+	d.reset = rl.refillTime(float64(rl.cfg.burst) - tokens)
+
+	return d
+}
+
+func (rl *rateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.cfg.rate * float64(time.Second))
+}
+
+// sweep drops the buckets idle long enough to be full again
+func (rl *rateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+
+	refill := rl.refillTime(float64(rl.cfg.burst))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// makeRoom keeps the map under the maximum before a new bucket is added. The full buckets go
+// first, then the least recently used one: dropping a bucket the client is draining would give it
+// a full one back
+func (rl *rateLimiter) makeRoom(now time.Time) {
+	if len(rl.buckets) < rl.cfg.maxBuckets {
+		return
+	}
+	rl.sweep(now)
+
+	for len(rl.buckets) >= rl.cfg.maxBuckets {
+		var oldestKey string
+		var oldest time.Time
+		for key, b := range rl.buckets {
+			if oldestKey == "" || b.last.Before(oldest) {
+				oldestKey, oldest = key, b.last
+			}
+		}
+		delete(rl.buckets, oldestKey)
+	}
+}
+
+// clientKeys gives the buckets of the client: its ip, and the value of the header when there is
+// one. Sending a new header value does not give a client a fresh bucket since its ip keeps its own
+func (rl *rateLimiter) clientKeys(props *reqProps, conn net.Conn) []string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	keys := []string{"ip:" + addr}
+	if rl.cfg.header != "" {
+		if v := props.header(rl.cfg.header); v != "" {
+			keys = append(keys, "header:"+v)
+		}
+	}
+
+	return keys
+}
+
+// rateLimit refuses the requests of a client over its rate with 429, every response tells the
+// client where it stands with the RateLimit headers
+func (s *server) rateLimit(rl *rateLimiter) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			d := rl.allow(rl.clientKeys(props, conn)...)
+
+			headers := map[string]string{
+				"RateLimit-Limit":     strconv.Itoa(rl.cfg.burst),
+				"RateLimit-Remaining": strconv.Itoa(d.remaining),
+				"RateLimit-Reset":     strconv.Itoa(ceilSeconds(d.reset)),
+			}
+
+			if !d.allowed {
+				headers["Retry-After"] = strconv.Itoa(ceilSeconds(d.retryAfter))
+				s.writeResponse(429, headers, "", conn)
+				return
+			}
+
+			if rc, ok := conn.(*responseConn); ok {
+				rc.onHead(func(status int, responseHeaders map[string]string, size int64) {
+					for name, value := range headers {
+						setHeader(responseHeaders, name, value)
+					}
+				})
+			}
+
+			next(props, conn)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// parseRateLimits reads the route=rate:burst values of the -rate-limit flag
+func parseRateLimits(values []string) (map[string]rateLimitConfig, error) {
+	configs := make(map[string]rateLimitConfig, len(values))
+
+	for _, v := range values {
+		route, spec, found := strings.Cut(v, "=")
+		rateValue, burstValue, hasBurst := strings.Cut(spec, ":")
+		if !found || !hasBurst {
+			return nil, fmt.Errorf("rate limit %s should be written route=rate:burst", v)
+		}
+
+		rate, rateErr := strconv.ParseFloat(rateValue, 64)
+		burst, burstErr := strconv.Atoi(burstValue)
+		if rateErr != nil || burstErr != nil || !(rate > 0) || math.IsInf(rate, 0) || burst < 1 {
+			return nil, fmt.Errorf("rate limit %s should have a finite positive rate and burst", v)
+		}
+
+		configs[strings.Trim(route, "/")] = rateLimitConfig{rate: rate, burst: burst}
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+
+	t.Run("Should refill the bucket at the rate", func(t *testing.T) {
+		now := time.Now()
+		rl := newRateLimiter(rateLimitConfig{rate: 1, burst: 2})
+		rl.now = func() time.Time { return now }
+
+		for i := 0; i < 2; i++ {
+			if d := rl.allow("client"); !d.allowed || d.remaining != 1-i {
+				t.Logf("Request %d should be allowed with %d left, got %+v", i, 1-i, d)
+				t.Fail()
+			}
+		}
+
+		d := rl.allow("client")
+		if d.allowed || d.retryAfter != time.Second || d.reset != 2*time.Second {
+			t.Logf("Third request should wait a second, got %+v", d)
+			t.Fail()
+		}
+
+		now = now.Add(500 * time.Millisecond)
+		if rl.allow("client").allowed {
+			t.Log("Half a token should not be enough")
+			t.Fail()
+		}
+
+		now = now.Add(500 * time.Millisecond)
+		if !rl.allow("client").allowed {
+			t.Log("A token should be there after a second")
+			t.Fail()
+		}
+
+		if !rl.allow("other").allowed {
+			t.Log("Other clients should have their own bucket")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should keep the number of buckets bounded", func(t *testing.T) {
+		now := time.Now()
+		rl := newRateLimiter(rateLimitConfig{rate: 1, burst: 5, maxBuckets: 3})
+		rl.now = func() time.Time { return now }
+
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Millisecond)
+			rl.allow(strconv.Itoa(i))
+		}
+
+		if len(rl.buckets) > 3 {
+			t.Logf("There should be at most 3 buckets, there are %d", len(rl.buckets))
+			t.Fail()
+		}
+
+		// the least recently used bucket makes room, not the one being drained
+		now = now.Add(time.Millisecond)
+		rl.allow("7")
+		now = now.Add(time.Millisecond)
+		rl.allow("new")
+
+		if _, ok := rl.buckets["7"]; !ok {
+			t.Log("The bucket used last should be kept")
+			t.Fail()
+		}
+		if _, ok := rl.buckets["8"]; ok {
+			t.Log("The least recently used bucket should have been dropped")
+			t.Fail()
+		}
+
+		// full buckets are dropped at the next sweep
+		now = now.Add(rateLimitSweepInterval)
+		rl.allow("last")
+
+		if len(rl.buckets) != 1 {
+			t.Logf("Only the last bucket should be left, there are %d", len(rl.buckets))
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 429 on the limited route only", func(t *testing.T) {
+		s := routesServer(t)
+		s.useOn(uploadRoute, s.rateLimit(newRateLimiter(rateLimitConfig{rate: 0.01, burst: 1, header: "X-Api-Key"})))
+		addr := listen(t, s, nil)
+
+		upload := "POST /files HTTP/1.1\r\nHost: localhost\r\nX-Api-Key: %s\r\nContent-Length: 0\r\n\r\n"
+
+		res := slowClient(t, addr, 0, strings.Replace(upload, "%s", "first", 1))
+		if strings.HasPrefix(res, "HTTP/1.1 429") || !strings.Contains(res, "RateLimit-Limit:1") || !strings.Contains(res, "RateLimit-Remaining:0") {
+			t.Logf("The first request should go through with the RateLimit headers, got %q", res)
+			t.Fail()
+		}
+
+		res = slowClient(t, addr, 0, strings.Replace(upload, "%s", "first", 1))
+		if !strings.HasPrefix(res, "HTTP/1.1 429 Too Many Requests") || !strings.Contains(res, "Retry-After:100") {
+			t.Logf("The second request should be refused, got %q", res)
+			t.Fail()
+		}
+
+		res = slowClient(t, addr, 0, strings.Replace(upload, "%s", "second", 1))
+		if !strings.HasPrefix(res, "HTTP/1.1 429 Too Many Requests") {
+			t.Logf("Another api key should not give the same client a fresh bucket, got %q", res)
+			t.Fail()
+		}
+
+		res = slowClient(t, addr, 0, "GET /echo/free HTTP/1.1\r\nHost: localhost\r\nX-Api-Key: first\r\n\r\n")
+		if !strings.HasPrefix(res, "HTTP/1.1 200") || strings.Contains(res, "RateLimit") {
+			t.Logf("Other routes should not be limited, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should limit the clients sharing a header value together", func(t *testing.T) {
+		rl := newRateLimiter(rateLimitConfig{rate: 0.01, burst: 1})
+
+		if !rl.allow("ip:10.0.0.1", "header:shared").allowed {
+			t.Log("The first request should be allowed")
+			t.Fail()
+		}
+
+		if rl.allow("ip:10.0.0.2", "header:shared").allowed {
+			t.Log("Another ip with the same header value should share its bucket")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse malformed limits", func(t *testing.T) {
+		for _, v := range []string{"files", "files=1", "files=0:1", "files=a:b", "files=NaN:1", "files=+Inf:1", "files=-1:1"} {
+			if _, err := parseRateLimits([]string{v}); err == nil {
+				t.Logf("%s should be an error", v)
+				t.Fail()
+			}
+		}
+	})
+}
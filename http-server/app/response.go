@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// responseConn is the connection handed to the handlers, the responses written through the server
+// helpers go past it so middlewares can change the headers and encode the body before it reaches
+// the client
+type responseConn struct {
+	net.Conn
+	props       *reqProps
+	status      int
+	wroteHeader bool
+	chunked     bool
+	plain       bool
+	bodyBytes   int64
+	beforeHead  []func(status int, headers map[string]string, size int64)
+	encoders    []func(w io.Writer) io.WriteCloser
+	body        io.Writer
+	openWriters []io.WriteCloser
+}
+
+// headWriter is implemented by the connections that do not send the response as http/1.1 text,
+// like the streams of an http/2 connection
+type headWriter interface {
+	writeHead(status int, headers map[string]string) error
+	endStream() error
+}
+
+func newResponseConn(conn net.Conn, props *reqProps) *responseConn {
+	return &responseConn{
+		Conn:  conn,
+		props: props,
+	}
+}
+
+// onHead registers a function called with the head of the response before it is written, size is
+// the length of the body or -1 when it is streamed
+func (rc *responseConn) onHead(f func(status int, headers map[string]string, size int64)) {
+	rc.beforeHead = append(rc.beforeHead, f)
+}
+
+// encodeWith makes the body go through the writer before being sent, it has to be called from a
+// function registered with onHead
+func (rc *responseConn) encodeWith(encoder func(w io.Writer) io.WriteCloser) {
+	rc.encoders = append(rc.encoders, encoder)
+}
+
+func (rc *responseConn) runHeadHooks(status int, headers map[string]string, size int64) {
+	rc.status = status
+	for _, f := range rc.beforeHead {
+		f(status, headers, size)
+	}
+}
+
+// writeResponse sends a response whose whole body is known, encoded bodies are encoded in memory
+// so the Content-Length stays right
+func (rc *responseConn) writeResponse(status int, headers map[string]string, body string) (int, error) {
+	rc.runHeadHooks(status, headers, int64(len(body)))
+
+	if len(rc.encoders) > 0 {
+		var buffer bytes.Buffer
+		w := rc.encodeChain(&buffer)
+		if _, err := io.WriteString(w, body); err != nil {
+			return -1, err
+		}
+		if err := rc.closeWriters(); err != nil {
+			return -1, err
+		}
+		body = buffer.String()
+		setHeader(headers, "Content-Length", strconv.Itoa(len(body)))
+	}
+
+	rc.wroteHeader = true
+	rc.plain = true
+	rc.body = &countingWriter{w: rc.Conn, n: &rc.bodyBytes}
+
+	if hw, ok := rc.Conn.(headWriter); ok {
+		if err := hw.writeHead(status, headers); err != nil {
+			return -1, err
+		}
+		return io.WriteString(rc.body, body)
+	}
+
+	rc.bodyBytes += int64(len(body))
+
+	return rc.Conn.Write(buildHttpResponse(status, headers, body))
+}
+
+// writeHead sends the status line and headers of a response whose body is written afterwards, when
+// its length is unknown the body is sent with chunked transfer encoding
+func (rc *responseConn) writeHead(status int, headers map[string]string) error {
+	size := int64(-1)
+	if cl := headerValue(headers, "Content-Length"); cl != "" {
+		if parsed, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			size = parsed
+		}
+	}
+
+	rc.runHeadHooks(status, headers, size)
+
+	if len(rc.encoders) > 0 {
+		deleteHeader(headers, "Content-Length")
+	}
+
+	hw, framed := rc.Conn.(headWriter)
+
+	if !framed && headerValue(headers, "Content-Length") == "" && bodyAllowed(status) && rc.props.version != "HTTP/1.0" {
+		setHeader(headers, "Transfer-Encoding", "chunked")
+		rc.chunked = true
+	}
+
+	rc.wroteHeader = true
+	rc.plain = !rc.chunked && len(rc.encoders) == 0
+
+	if framed {
+		if err := hw.writeHead(status, headers); err != nil {
+			return err
+		}
+	} else if _, err := rc.Conn.Write(buildHttpResponse(status, headers, "")); err != nil {
+		return err
+	}
+
+	var w io.Writer = &countingWriter{w: rc.Conn, n: &rc.bodyBytes}
+	if rc.chunked {
+		w = &chunkedWriter{w: w}
+	}
+	rc.body = rc.encodeChain(w)
+
+	return nil
+}
+
+// Write sends body bytes once the head has been written, before that the bytes go untouched to the
+// connection for handlers that write the raw response themselves
+func (rc *responseConn) Write(b []byte) (int, error) {
+	if !rc.wroteHeader {
+		return rc.Conn.Write(b)
+	}
+	return rc.body.Write(b)
+}
+
+// ReadFrom keeps the kernel copy path of the underlying connection when the body is not encoded
+func (rc *responseConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := rc.Conn.(io.ReaderFrom); ok && rc.plain {
+		n, err := rf.ReadFrom(r)
+		rc.bodyBytes += n
+		return n, err
+	}
+	return io.Copy(rc.body, r)
+}
+
+// flush pushes the bytes buffered by the encoders to the client, needed by streamed responses
+func (rc *responseConn) flush() error {
+	for _, w := range rc.openWriters {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finish ends the response body, closing the encoders and writing the last chunk
+func (rc *responseConn) finish() error {
+	if err := rc.closeWriters(); err != nil {
+		return err
+	}
+
+	if rc.chunked {
+		rc.chunked = false
+		_, err := rc.Conn.Write([]byte("0" + HttpPartSeperator + HttpPartSeperator))
+		return err
+	}
+
+	if hw, ok := rc.Conn.(headWriter); ok {
+		return hw.endStream()
+	}
+
+	return nil
+}
+
+func (rc *responseConn) encodeChain(w io.Writer) io.Writer {
+	for i := len(rc.encoders) - 1; i >= 0; i-- {
+		wc := rc.encoders[i](w)
+		rc.openWriters = append([]io.WriteCloser{wc}, rc.openWriters...)
+		w = wc
+	}
+
+	return w
+}
+
+func (rc *responseConn) closeWriters() error {
+	writers := rc.openWriters
+	rc.openWriters = nil
+
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkedWriter frames every write as a chunk of the chunked transfer encoding
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (c *chunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if _, err := fmt.Fprintf(c.w, "%x%s", len(b), HttpPartSeperator); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(c.w, HttpPartSeperator); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	written, err := c.w.Write(b)
+	*c.n += int64(written)
+	return written, err
+}
+
+// bodyAllowed tells if a response with the status can carry a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// headerName gives the name the header was set with whatever its case, false when it is not set
+func headerName(headers map[string]string, name string) (string, bool) {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+
+	return "", false
+}
+
+// setHeader replaces the header whatever the case it was set with
+func setHeader(headers map[string]string, name string, value string) {
+	deleteHeader(headers, name)
+	headers[name] = value
+}
+
+func deleteHeader(headers map[string]string, name string) {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			delete(headers, k)
+		}
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,31 +20,162 @@ const (
 	HttpPartSeperator = "\r\n"
 )
 
+var errMalformedRequest = errors.New("the request is malformed")
+
 var codeToReason = map[int]string{
+	101: "Switching Protocols",
 	200: "OK",
 	201: "Created",
+	204: "No Content",
+	400: "Bad Request",
+	403: "Forbidden",
 	404: "Not Found",
+	405: "Method Not Allowed",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	426: "Upgrade Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
 }
 
 type reqProps struct {
 	method  string
+	version string
 	request *reqPath
 	headers map[string]string
 	body    []byte
+	// bodyReader streams the body from the connection on the routes reading it as it arrives,
+	// body is then empty
+	bodyReader io.Reader
+	id         string
+	route      string
+	target     string
+	// principal is who the authentication middleware found the request comes from
+	principal string
+	// session is set by the sessions middleware
+	session *session
 }
 
 type reqPath struct {
 	path   string
+	query  string
 	params []string
 }
 
 type server struct {
-	listener net.Listener
-	req      *reqProps
-	paths    *tree
+	listener    net.Listener
+	req         *reqProps
+	paths       *tree
+	directory   string
+	formMemory  int64
+	filesMu     sync.Mutex
+	middlewares []middleware
+	accessLog   *accessLog
+	metrics     *metrics
+	timeouts    timeouts
+	limits      limits
+
+	// lastMiddlewares run after the ones of the routes, right before the handlers
+	lastMiddlewares []middleware
+
+	forwardProxy *forwardProxy
+	hosts        virtualHosts
+
+	connLimits      connectionLimits
+	connectionsOnce sync.Once
+	slots           chan struct{}
+	queue           chan queuedConn
 }
 
 func main() {
+	directory := flag.String("directory", "", "directory where the files endpoint reads and writes")
+	formMemory := flag.Int64("form-memory", defaultFormMemory, "bytes of a multipart form kept in memory, bigger parts go to temporary files")
+	compressMinSize := flag.Int64("compress-min-size", 0, "smallest response body compressed")
+	compressTypes := flag.String("compress-types", strings.Join(defaultCompressibleTypes, ","), "comma separated media types compressed, entries ending with / match the whole type")
+	compressLevel := flag.Int("compress-level", 0, "compression level from 1 to 9, 0 for the default one")
+	decodeLimit := flag.Int64("decode-body-limit", 0, "decode gzip and deflate request bodies up to this decoded size, 0 leaves them untouched")
+	tlsAddr := flag.String("tls-addr", "", "address of the https listener, empty to serve only plain http")
+	var tlsCerts listFlag
+	flag.Var(&tlsCerts, "tls-cert", "certificate and key files as cert.pem:key.pem, can be repeated for SNI")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum tls version, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma separated tls 1.2 cipher suites, empty for the go defaults")
+	tlsALPN := flag.String("tls-alpn", "h2,http/1.1", "comma separated protocols offered with ALPN")
+	tlsDevCert := flag.String("tls-dev-cert", "", "directory where a self signed certificate is generated on the first start")
+	tlsDevHosts := flag.String("tls-dev-hosts", "", "comma separated hosts of the generated certificate, localhost by default")
+	accessLogPath := flag.String("access-log", "-", "file the access log is written to, - for stdout and empty to disable it")
+	accessLogFormat := flag.String("access-log-format", logFormatCommon, "format of the access log, one of common, combined or json")
+	exposeMetrics := flag.Bool("metrics", false, "expose prometheus metrics on /metrics")
+	idleTimeout := flag.Duration("idle-timeout", defaultIdleTimeout, "longest wait for a request on an open connection, 0 to wait forever")
+	headerTimeout := flag.Duration("read-header-timeout", defaultHeaderTimeout, "longest time to read a request head from its first byte, 0 to wait forever")
+	bodyTimeout := flag.Duration("read-body-timeout", defaultBodyTimeout, "longest time to read a request body after its head, 0 to wait forever")
+	maxRequestLine := flag.Int("max-request-line", defaultMaxRequestLine, "longest request line accepted, 0 for no limit")
+	maxHeaderCount := flag.Int("max-header-count", defaultMaxHeaderCount, "most request headers accepted, 0 for no limit")
+	maxHeaderBytes := flag.Int("max-header-bytes", defaultMaxHeaderBytes, "largest request headers accepted in bytes, 0 for no limit")
+	maxBody := flag.Int64("max-body", defaultMaxBody, "largest request body accepted in bytes, 0 for no limit")
+	maxConnections := flag.Int("max-connections", 0, "most connections served at once, others are answered 503, 0 for no limit")
+	workers := flag.Int("workers", 0, "connections are served by this many workers instead of a goroutine each, 0 for no workers")
+	acceptQueue := flag.Int("accept-queue", defaultAcceptQueue, "accepted connections waiting for a worker before the next ones are answered 503")
+	retryAfter := flag.Int("retry-after", defaultRetryAfter, "seconds sent in the Retry-After header of the 503 responses")
+	var rateLimits listFlag
+	flag.Var(&rateLimits, "rate-limit", "token bucket of a route as route=rate:burst, rate being the requests per second, can be repeated")
+	rateLimitKey := flag.String("rate-limit-key", "", "header whose values get a bucket of their own for the rate limits, like an api key, on top of the bucket of the client ip")
+	var routeBodyLimits listFlag
+	flag.Var(&routeBodyLimits, "route-body-limit", "body limit of a route as route=bytes overriding -max-body, -1 for no limit, can be repeated")
+	var proxies listFlag
+	flag.Var(&proxies, "proxy", "reverse proxy of a route prefix as prefix=http://upstream or prefix=pool, can be repeated")
+	var upstreamPools listFlag
+	flag.Var(&upstreamPools, "upstream", "upstream pool as name=strategy:url,url with the round-robin, least-connections or hash/Header strategy, can be repeated")
+	healthPath := flag.String("health-check-path", "", "path checked on every server of the upstream pools, empty to disable the health checks")
+	healthInterval := flag.Duration("health-check-interval", defaultHealthInterval, "time between two health checks of an upstream server")
+	healthTimeout := flag.Duration("health-check-timeout", defaultHealthTimeout, "longest wait for the answer to a health check")
+	maxFails := flag.Int("max-fails", defaultMaxFails, "failed requests in a row after which an upstream server is ejected from its pool")
+	failTimeout := flag.Duration("fail-timeout", defaultFailTimeout, "time an ejected upstream server takes no requests")
+	forwardProxyMode := flag.Bool("forward-proxy", false, "also act as a forward proxy for absolute-form requests and CONNECT tunnels")
+	var proxyAllow listFlag
+	flag.Var(&proxyAllow, "proxy-allow", "destination host:port the forward proxy may reach, * and *.domain match many, can be repeated, every public destination when unset. Internal addresses are only reached when their host is listed")
+	var proxyUsers listFlag
+	flag.Var(&proxyUsers, "proxy-user", "user:password allowed to use the forward proxy, can be repeated, no authentication when unset")
+	var virtualHosts listFlag
+	flag.Var(&virtualHosts, "vhost", "host whose requests all go to an upstream as host=http://upstream or host=pool, *.domain matches the subdomains, the other hosts are served by the routes, can be repeated")
+	var corsGroups listFlag
+	flag.Var(&corsGroups, "cors", "origins allowed to call a route and the routes below it as path=origin,origin, patterns like https://*.example.test and * are accepted, can be repeated")
+	var authRoutes listFlag
+	flag.Var(&authRoutes, "auth", "authentication of a route and the routes below it as route=scheme,scheme with the basic, bearer or hmac schemes, can be repeated")
+	htpasswd := flag.String("htpasswd", "", "htpasswd file of the basic scheme with {SHA}, {SHA256}, {SSHA256} or $apr1$ passwords")
+	bearerTokens := flag.String("bearer-tokens", "", "file of the bearer scheme with a principal:token line per token")
+	hmacKeys := flag.String("hmac-keys", "", "file of the hmac scheme with a keyId:secret line per key")
+	var urlSigningKeys listFlag
+	flag.Var(&urlSigningKeys, "url-signing-key", "key signing the file urls as id:secret, the first one signs and all check, can be repeated for rotation")
+	urlTTL := flag.Duration("url-ttl", defaultSignedURLTTL, "time a signed file url is valid when the ttl query parameter is not given")
+	urlMaxTTL := flag.Duration("url-max-ttl", defaultSignedURLMaxTTL, "longest ttl a signed file url can be asked for")
+	sessionStoreName := flag.String("session-store", "", "store of the sessions, memory or cookie, empty to disable the sessions")
+	var sessionKeys listFlag
+	flag.Var(&sessionKeys, "session-key", "key signing the cookie sessions as id:secret, the first one signs and all check, can be repeated for rotation")
+	sessionCookie := flag.String("session-cookie", defaultSessionCookie, "name of the session cookie")
+	sessionTTL := flag.Duration("session-ttl", defaultSessionTTL, "time a session lives without being used")
+	sessionSecure := flag.Bool("session-secure", false, "only send the session cookie over https")
+	sessionSameSite := flag.String("session-samesite", "Lax", "SameSite of the session cookie, Lax, Strict or None which needs -session-secure")
+	maxSessions := flag.Int("session-max", defaultMaxSessions, "most sessions the memory store keeps, new sessions are refused once it is full")
+	var csrfRoutes listFlag
+	flag.Var(&csrfRoutes, "csrf", "route whose unsafe requests, and the ones of the routes below it, need the csrf token of their session given by GET /csrf, can be repeated")
+	authRealm := flag.String("auth-realm", defaultAuthRealm, "realm sent in the authentication challenges")
+	corsMethods := flag.String("cors-methods", "", "comma separated methods allowed to cross origin requests, the ones of each route when empty")
+	corsHeaders := flag.String("cors-headers", "", "comma separated request headers allowed to cross origin requests, the ones asked for when empty")
+	corsExpose := flag.String("cors-expose-headers", "", "comma separated response headers the browser scripts can read")
+	corsCredentials := flag.Bool("cors-credentials", false, "allow cross origin requests with cookies and authorization, the cors groups then have to list their origins instead of *")
+	corsMaxAge := flag.Duration("cors-max-age", 0, "time the browsers may cache a preflight answer, 0 to not send it")
+	proxyTimeout := flag.Duration("proxy-timeout", defaultProxyResponseTimeout, "longest wait for the head of an upstream response before answering 504")
+	writeTimeout := flag.Duration("write-timeout", defaultWriteTimeout, "longest time to write a response, streamed responses extend it on every write, 0 to wait forever")
+	flag.Parse()
+
 	l, err := net.Listen("tcp", "0.0.0.0:4221")
 	if err != nil {
 		fmt.Println("Failed to bind to port 4221")
@@ -48,11 +183,55 @@ func main() {
 	}
 
 	s := &server{
-		listener: l,
-		paths:    create(),
+		listener:   l,
+		paths:      create(),
+		directory:  *directory,
+		formMemory: *formMemory,
+		timeouts: timeouts{
+			idle:   *idleTimeout,
+			header: *headerTimeout,
+			body:   *bodyTimeout,
+			write:  *writeTimeout,
+		},
+		limits: limits{
+			requestLine: *maxRequestLine,
+			headerCount: *maxHeaderCount,
+			headerBytes: *maxHeaderBytes,
+			body:        *maxBody,
+		},
+		connLimits: connectionLimits{
+			maxConnections: *maxConnections,
+			workers:        *workers,
+			queue:          *acceptQueue,
+			retryAfter:     *retryAfter,
+		},
 	}
 	// no wildcards considered
 
+	if *accessLogPath != "" {
+		accessLog, logErr := newAccessLog(*accessLogPath, *accessLogFormat)
+		if logErr != nil {
+			fmt.Println("Error opening the access log : ", logErr.Error())
+			os.Exit(1)
+		}
+		accessLog.reopenOnHangup()
+		s.accessLog = accessLog
+	}
+
+	if *exposeMetrics {
+		s.metrics = newMetrics()
+	}
+
+	s.use(compression(compressionConfig{
+		minSize:      *compressMinSize,
+		contentTypes: strings.Split(*compressTypes, ","),
+		level:        *compressLevel,
+	}))
+
+	if *decodeLimit > 0 {
+		s.useLast(s.decompression(*decodeLimit))
+	}
+
 	routesErr := registerRoutes(s)
 
 	if routesErr != nil {
@@ -60,13 +239,240 @@ func main() {
 		os.Exit(1)
 	}
 
+	pools, poolsErr := parseUpstreamPools(upstreamPools, poolConfig{
+		healthPath:     *healthPath,
+		healthInterval: *healthInterval,
+		healthTimeout:  *healthTimeout,
+		maxFails:       *maxFails,
+		failTimeout:    *failTimeout,
+	})
+	if poolsErr != nil {
+		fmt.Println("Error reading the upstream pools : ", poolsErr.Error())
+		os.Exit(1)
+	}
+	for _, pool := range pools {
+		go pool.checkHealth()
+	}
+
+	upstreams, proxiesErr := parseProxies(proxies, pools)
+	if proxiesErr != nil {
+		fmt.Println("Error reading the proxies : ", proxiesErr.Error())
+		os.Exit(1)
+	}
+	for prefix, pool := range upstreams {
+		proxyErr := s.registerProxy(prefix, proxyConfig{pool: pool, responseTimeout: *proxyTimeout})
+		if proxyErr != nil {
+			fmt.Println("Error registering the proxy : ", proxyErr.Error())
+			os.Exit(1)
+		}
+	}
+
+	hostUpstreams, hostsErr := parseVirtualHosts(virtualHosts, pools)
+	if hostsErr != nil {
+		fmt.Println("Error reading the virtual hosts : ", hostsErr.Error())
+		os.Exit(1)
+	}
+	for pattern, pool := range hostUpstreams {
+		cfg := proxyConfig{pool: pool, responseTimeout: *proxyTimeout}
+		hostErr := s.registerHost(pattern, func() error {
+			return s.registerProxy("", cfg)
+		})
+		if hostErr != nil {
+			fmt.Println("Error registering the virtual host : ", hostErr.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *forwardProxyMode {
+		users, usersErr := parseProxyUsers(proxyUsers)
+		if usersErr != nil {
+			fmt.Println("Error reading the proxy users : ", usersErr.Error())
+			os.Exit(1)
+		}
+		if len(proxyAllow) == 0 && len(users) == 0 {
+			fmt.Println("Error starting the forward proxy : ", "it needs -proxy-allow or -proxy-user, anyone could use it otherwise")
+			os.Exit(1)
+		}
+		s.forwardProxy = newForwardProxy(s, forwardProxyConfig{
+			allow:           proxyAllow,
+			credentials:     users,
+			responseTimeout: *proxyTimeout,
+		})
+	}
+
+	bodyLimits, limitsErr := parseBodyLimits(routeBodyLimits)
+	if limitsErr != nil {
+		fmt.Println("Error reading the route body limits : ", limitsErr.Error())
+		os.Exit(1)
+	}
+	for route, limit := range bodyLimits {
+		s.setBodyLimit(route, limit)
+	}
+
+	groups, corsErr := parseCorsGroups(corsGroups)
+	if corsErr != nil {
+		fmt.Println("Error reading the cors groups : ", corsErr.Error())
+		os.Exit(1)
+	}
+	for path, origins := range groups {
+		groupErr := s.cors(path, corsConfig{
+			origins:        origins,
+			methods:        splitList(*corsMethods),
+			headers:        splitList(*corsHeaders),
+			exposedHeaders: splitList(*corsExpose),
+			credentials:    *corsCredentials,
+			maxAge:         *corsMaxAge,
+		})
+		if groupErr != nil {
+			fmt.Println("Error reading the cors groups : ", groupErr.Error())
+			os.Exit(1)
+		}
+	}
+
+	rateConfigs, rateErr := parseRateLimits(rateLimits)
+	if rateErr != nil {
+		fmt.Println("Error reading the rate limits : ", rateErr.Error())
+		os.Exit(1)
+	}
+	for route, cfg := range rateConfigs {
+		cfg.header = *rateLimitKey
+		s.useOn(route, s.rateLimit(newRateLimiter(cfg)))
+	}
+
+	// the signed urls are checked before the authentication so a valid one needs no credentials
+	signingKeys, keysErr := parseSigningKeys(urlSigningKeys)
+	if keysErr != nil {
+		fmt.Println("Error reading the url signing keys : ", keysErr.Error())
+		os.Exit(1)
+	}
+	var signer *urlSigner
+	if len(signingKeys) > 0 {
+		signer = newURLSigner(signingKeys, *urlTTL, *urlMaxTTL)
+		if signErr := s.registerMethodHandler("POST", signedURLRoute, s.signedURL(signer)); signErr != nil {
+			fmt.Println("Error registering the signed urls : ", signErr.Error())
+			os.Exit(1)
+		}
+		s.useOn(filesRoute, s.signedFiles(signer))
+	}
+
+	auths, authErr := parseAuthRoutes(authRoutes)
+	if authErr != nil {
+		fmt.Println("Error reading the authenticated routes : ", authErr.Error())
+		os.Exit(1)
+	}
+	if len(auths) > 0 {
+		authenticators, authErr := loadAuthenticators(*authRealm, *htpasswd, *bearerTokens, *hmacKeys)
+		if authErr != nil {
+			fmt.Println("Error reading the credentials : ", authErr.Error())
+			os.Exit(1)
+		}
+		for route, schemes := range auths {
+			// a mistyped route would protect nothing
+			if !s.nodeFor(route).hasRoutes() {
+				fmt.Println("Error reading the authenticated routes : ", "there is no route at or below "+route)
+				os.Exit(1)
+			}
+
+			var chosen []authenticator
+			for _, scheme := range schemes {
+				if authenticators[scheme] == nil {
+					fmt.Println("Error reading the authenticated routes : ", "the "+scheme+" scheme of "+route+" has no credential file")
+					os.Exit(1)
+				}
+				chosen = append(chosen, authenticators[scheme])
+			}
+			s.protect(route, chosen...)
+		}
+	}
+
+	// anyone able to mint a signed url could download every file with it
+	if signer != nil && !s.nodeFor(signedURLRoute).protected() {
+		fmt.Println("Error registering the signed urls : ", "the signed urls can only be minted behind an authentication, set -auth "+filesRoute+"=scheme")
+		os.Exit(1)
+	}
+
+	if *sessionStoreName != "" {
+		keys, keysErr := parseSigningKeys(sessionKeys)
+		if keysErr != nil {
+			fmt.Println("Error reading the session keys : ", keysErr.Error())
+			os.Exit(1)
+		}
+		store, storeErr := newSessionStore(*sessionStoreName, keys, *maxSessions)
+		if storeErr != nil {
+			fmt.Println("Error creating the session store : ", storeErr.Error())
+			os.Exit(1)
+		}
+		sessions, sessionsErr := s.sessions(sessionConfig{
+			store:    store,
+			name:     *sessionCookie,
+			path:     "/",
+			secure:   *sessionSecure,
+			sameSite: *sessionSameSite,
+			ttl:      *sessionTTL,
+		})
+		if sessionsErr != nil {
+			fmt.Println("Error configuring the sessions : ", sessionsErr.Error())
+			os.Exit(1)
+		}
+		s.use(sessions)
+	}
+	if len(csrfRoutes) > 0 && *sessionStoreName == "" {
+		fmt.Println("Error reading the csrf routes : ", "the csrf tokens are kept in the sessions, set -session-store")
+		os.Exit(1)
+	}
+	if len(csrfRoutes) > 0 {
+		if csrfErr := s.registerCsrf(csrfRoutes); csrfErr != nil {
+			fmt.Println("Error reading the csrf routes : ", csrfErr.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *tlsAddr != "" {
+		pairs, pairsErr := parseCertificatePairs(tlsCerts)
+		if pairsErr != nil {
+			fmt.Println("Error reading the certificates : ", pairsErr.Error())
+			os.Exit(1)
+		}
+
+		config, tlsErr := buildTLSConfig(tlsOptions{
+			certificates: pairs,
+			minVersion:   *tlsMinVersion,
+			ciphers:      splitList(*tlsCiphers),
+			alpn:         splitList(*tlsALPN),
+			devCertDir:   *tlsDevCert,
+			devHosts:     splitList(*tlsDevHosts),
+		})
+		if tlsErr != nil {
+			fmt.Println("Error configuring tls : ", tlsErr.Error())
+			os.Exit(1)
+		}
+
+		tl, tlsListenErr := tls.Listen("tcp", *tlsAddr, config)
+		if tlsListenErr != nil {
+			fmt.Println("Failed to bind to ", *tlsAddr)
+			os.Exit(1)
+		}
+
+		go func() {
+			acceptErr := s.acceptConnections(tl)
+			fmt.Println("Error accepting tls connection: ", acceptErr.Error())
+			os.Exit(1)
+		}()
+	}
+
+	acceptErr := s.acceptConnections(l)
+	fmt.Println("Error accepting connection: ", acceptErr.Error())
+	os.Exit(1)
+}
+
+// acceptConnections serves every connection of the listener until accepting fails
+func (s *server) acceptConnections(l net.Listener) error {
 	for {
 		conn, connErr := l.Accept()
 		if connErr != nil {
-			fmt.Println("Error accepting connection: ", connErr.Error())
-			os.Exit(1)
+			return connErr
 		}
-		go handleConnectionToServer(s, conn)
+		s.serveConnection(conn)
 	}
 }
 
@@ -104,29 +510,12 @@ func registerRoutes(s *server) error {
 		}
 		body := props.request.params[0]
 
-		encodings := props.headers["Accept-Encoding"]
-
+		// compressing the body is left to the compression middleware
 		var headers = map[string]string{
 			"Content-Type":   "text/plain",
 			"Content-Length": strconv.Itoa(len(body)),
 		}
 
-		for _, encoding := range strings.Split(encodings, ",") {
-			if strings.TrimSpace(encoding) == "gzip" {
-				headers["Content-Encoding"] = "gzip"
-				var buffer bytes.Buffer
-				w := gzip.NewWriter(&buffer)
-				_, err := w.Write([]byte(body))
-				if err != nil {
-					fmt.Println("we could not compress the body")
-					return
-				}
-				w.Close()
-				body = buffer.String()
-				headers["Content-Length"] = strconv.Itoa(len(body))
-			}
-		}
-
 		b := s.writeResponse(200, headers, body, conn)
 
 		if b == -1 {
@@ -141,7 +530,7 @@ func registerRoutes(s *server) error {
 
 	handleErr3 := s.registerHandler("user-agent", func(props *reqProps, conn net.Conn) {
 
-		body := props.headers["User-Agent"]
+		body := props.header("User-Agent")
 
 		var headers = map[string]string{
 			"Content-Type":   "text/plain",
@@ -159,98 +548,70 @@ func registerRoutes(s *server) error {
 		return handleErr3
 	}
 
-	fileErr := s.registerHandler("files/{filename}", func(props *reqProps, conn net.Conn) {
-		filename := props.request.params[0]
-		directory := os.Args[2]
+	eventsErr := s.registerHandler("events", func(props *reqProps, conn net.Conn) {
+		s.serveEvents(props, conn, defaultSSEHeartbeat, func(stream *sseStream) {
+			// the count goes on from the last event the client got before reconnecting
+			count, _ := strconv.Atoi(stream.lastEventID)
 
-		if props.method == "GET" {
-			f, err := os.Open(directory + filename)
-
-			if err != nil {
-				fmt.Printf("File %s was not found: %s", filename, err.Error())
-				s.writeResponse(404, map[string]string{}, "", conn)
-			}
-
-			defer func(f *os.File) {
-				err := f.Close()
-				if err != nil {
-					var errHeaders = map[string]string{
-						"Content-Type": "text/plain",
-					}
-					s.writeResponse(500, errHeaders, "Internal Error", conn)
-				}
-			}(f)
-
-			stat, _ := f.Stat()
-			var headers = map[string]string{
-				"Content-type":   "application/octet-stream",
-				"Content-Length": strconv.FormatInt(stat.Size(), 10),
-			}
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
 
 			for {
-				bs := make([]byte, 1024)
-
-				r, e := f.Read(bs)
-
-				if e != nil {
-					var errHeaders = map[string]string{
-						"Content-Type": "text/plain",
+				select {
+				case <-stream.closed():
+					return
+				case now := <-ticker.C:
+					count++
+					if stream.send(sseEvent{id: strconv.Itoa(count), event: "tick", data: now.UTC().Format(time.RFC3339)}) != nil {
+						return
 					}
-					s.writeResponse(500, errHeaders, "Internal Error", conn)
-
-					break
-				}
-
-				if r == -1 {
-					break
-				}
-
-				b := s.writeResponse(200, headers, string(bs), conn)
-
-				if b == -1 {
-					fmt.Println("we could not answer the request")
-				}
-			}
-		} else if props.method == "POST" {
-			f, er := os.OpenFile(directory+"/"+filename, os.O_RDWR|os.O_CREATE, 0666)
-
-			if er != nil {
-				var errHeaders = map[string]string{
-					"Content-Type": "text/plain",
 				}
-				s.writeResponse(500, errHeaders, "Internal Error", conn)
-
-				return
 			}
+		})
+	})
 
-			defer func(f *os.File) {
-				err := f.Close()
-				if err != nil {
-					var errHeaders = map[string]string{
-						"Content-Type": "text/plain",
-					}
-					s.writeResponse(500, errHeaders, "Internal Error", conn)
-				}
-			}(f)
+	if eventsErr != nil {
+		fmt.Println("Handler has already been registered")
+		return eventsErr
+	}
 
-			s.writeResponse(201, map[string]string{}, "", conn)
+	rooms := &wsRooms{}
+	wsErr := s.registerWebSocket("ws/{room}", func(props *reqProps, ws *wsConn) {
+		room := props.request.params[0]
 
-			written, err := f.Write(props.body)
+		rooms.join(room, ws)
+		defer rooms.leave(room, ws)
 
+		for {
+			opcode, message, err := ws.readMessage()
 			if err != nil {
-				fmt.Println("Error while creating the file!!")
-			} else {
-				fmt.Printf("Written %d bytes", written)
+				return
 			}
-
+			rooms.broadcast(room, opcode, message)
 		}
 	})
 
+	if wsErr != nil {
+		fmt.Println("Handler has already been registered")
+		return wsErr
+	}
+
+	fileErr := s.registerFileRoutes()
+
 	if fileErr != nil {
 		fmt.Println("Handler has already been registered")
 		return fileErr
 	}
 
+	if s.metrics != nil {
+		metricsErr := s.registerMetrics()
+
+		if metricsErr != nil {
+			fmt.Println("Handler has already been registered")
+			return metricsErr
+		}
+	}
+
 	return nil
 }
 
@@ -262,32 +623,215 @@ func handleConnectionToServer(s *server, conn net.Conn) {
 		}
 	}(conn)
 
+	if s.metrics != nil {
+		s.metrics.openConnections.Add(1)
+		defer s.metrics.openConnections.Add(-1)
+	}
+
+	// with tls the protocol was already agreed on with ALPN during the handshake
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(deadline(s.timeouts.header))
+		hsErr := tc.Handshake()
+		conn.SetDeadline(time.Time{})
+
+		if hsErr != nil {
+			fmt.Println("Error during the tls handshake : ", hsErr.Error())
+			return
+		}
+
+		if tc.ConnectionState().NegotiatedProtocol == "h2" {
+			s.serveHTTP2(conn, conn, nil, nil)
+			return
+		}
+	}
+
 	requestBuffer, errR := s.readBytes(conn)
 
+	// the whole response has to be written before the write timeout, streaming handlers extend it
+	conn.SetWriteDeadline(deadline(s.timeouts.write))
+
+	// a client going away or failing the tls handshake only ends its own connection
 	if errR != nil {
 		fmt.Println("Error while reading the request : ", errR.Error())
-		os.Exit(1)
+		if errors.Is(errR, errRequestTimeout) {
+			s.writeResponse(408, map[string]string{"Connection": "close"}, "", conn)
+		}
+		// the rest of a request too large is not read, the connection can not be used anymore
+		if status := limitStatus(errR); status != 0 {
+			s.writeResponse(status, map[string]string{"Connection": "close"}, "", conn)
+		}
+		return
+	}
+
+	// a client with prior knowledge of http/2 starts with the connection preface instead of a request
+	if bytes.HasPrefix(requestBuffer, []byte(http2Preface[:18])) {
+		s.serveHTTP2(conn, io.MultiReader(bytes.NewReader(requestBuffer), conn), nil, nil)
+		return
 	}
 
 	props, reqErr := readRequest(requestBuffer)
 
 	if reqErr != nil {
 		fmt.Println("Error while processing the request : ", reqErr.Error())
-		os.Exit(1)
+		if s.metrics != nil {
+			s.metrics.parseErrors.Add(1)
+		}
+		s.writeResponse(400, make(map[string]string), "", conn)
+		return
+	}
+
+	// an http/1.1 request has to say which host it is for and a Host given with any version has to
+	// be valid, RFC 9112 section 3.2
+	if _, given := headerName(props.headers, "Host"); (given || props.version == "HTTP/1.1") && !validHost(props.header("Host")) {
+		s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", conn)
+		return
+	}
+
+	if s.forwardProxy != nil && s.forwardProxy.handles(props) {
+		rc := newResponseConn(conn, props)
+		start := s.beginRequest(props, rc)
+
+		// bytes the client sent right after a CONNECT are already for the tunnel
+		s.forwardProxy.serve(props, rc, io.MultiReader(bytes.NewReader(props.body), conn))
+
+		if fErr := rc.finish(); fErr != nil {
+			fmt.Println("Error while finishing the response : ", fErr.Error())
+		}
+		s.endRequest(props, rc, start)
+		return
+	}
+
+	// only the forward proxy has somewhere to tunnel to
+	if props.method == "CONNECT" {
+		s.writeResponse(501, map[string]string{"Content-Length": "0"}, "", conn)
+		return
+	}
+
+	if _, secure := conn.(*tls.Conn); !secure && isH2CUpgrade(props) {
+		s.upgradeToHTTP2(conn, conn, props)
+		return
+	}
+
+	if isWebSocketUpgrade(props) {
+		if n := s.lookup(props); n != nil && n.websocket != nil {
+			props.route = n.route
+			rc := newResponseConn(conn, props)
+			start := s.beginRequest(props, rc)
+
+			// bytes the client sent right after the request are already websocket frames
+			frames := io.MultiReader(bytes.NewReader(props.body), conn)
+
+			// the upgrade goes through the middlewares like any request, so a route needing
+			// authentication or rate limited refuses it before the handshake
+			upgrade := s.wrap(n, func(props *reqProps, conn net.Conn) {
+				s.upgradeWebSocket(conn, frames, props, n.websocket)
+			}, false)
+			upgrade(props, rc)
+
+			if fErr := rc.finish(); fErr != nil {
+				fmt.Println("Error while finishing the response : ", fErr.Error())
+			}
+			s.endRequest(props, rc, start)
+			return
+		}
+		props.request.params = nil
+	}
+
+	if s.streamsBody(props.header("Host"), props.target) {
+		s.openBodyStream(props, conn)
 	}
 
-	s.req = props
+	rc := newResponseConn(conn, props)
+	start := s.beginRequest(props, rc)
 
-	hErr := s.handle(conn)
+	if hErr := s.serve(props, rc); hErr != nil {
+		s.writeResponse(404, make(map[string]string), "", rc)
+	}
+
+	if fErr := rc.finish(); fErr != nil {
+		fmt.Println("Error while finishing the response : ", fErr.Error())
+	}
+
+	s.endRequest(props, rc, start)
+}
+
+// beginRequest starts the bookkeeping of the access log and the metrics for the request, it gives
+// the time the request started at
+func (s *server) beginRequest(props *reqProps, rc *responseConn) time.Time {
+	s.startAccessLog(props, rc)
 
-	if hErr != nil {
-		fmt.Println("error handling request: ", hErr.Error())
-		s.writeResponse(404, make(map[string]string), "", conn)
+	if s.metrics != nil {
+		s.metrics.inFlight.Add(1)
+	}
+
+	return time.Now()
+}
+
+// endRequest logs and counts the request once its response is finished
+func (s *server) endRequest(props *reqProps, rc *responseConn, start time.Time) {
+	s.logAccess(props, rc, start)
+
+	if s.metrics != nil {
+		s.metrics.inFlight.Add(-1)
+		s.metrics.observe(props, rc, time.Since(start))
 	}
 }
 
+// openBodyStream lets the handler read the rest of the body from the connection, the bytes that
+// came with the head are read first. The body timeout still bounds the time it takes
+func (s *server) openBodyStream(props *reqProps, conn net.Conn) {
+	length, err := strconv.ParseInt(props.header("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		length = 0
+	}
+
+	read := props.body
+	if int64(len(read)) > length {
+		read = read[:length]
+	}
+
+	conn.SetReadDeadline(deadline(s.timeouts.body))
+	props.body = nil
+	props.bodyReader = io.MultiReader(bytes.NewReader(read), io.LimitReader(conn, length-int64(len(read))))
+}
+
+// streamBody makes the route read its request bodies from the connection as they arrive instead of
+// once they were buffered, the body limit still applies
+func (s *server) streamBody(path string) {
+	s.nodeFor(path).streamBody = true
+}
+
+// streamsBody tells whether the route of the path of the host streams its request bodies
+func (s *server) streamsBody(host string, target string) bool {
+	n := s.targetNode(host, target)
+	return n != nil && n.streamBody
+}
+
+// targetNode finds the node of a request target before the request is parsed, the host of an
+// absolute-form target wins over the Host header like it does for the routing
+func (s *server) targetNode(host string, target string) *node {
+	if s.paths == nil || s.paths.root == nil {
+		return nil
+	}
+
+	if authority, rest := splitTarget(target); authority != "" {
+		host, target = authority, rest
+	}
+
+	path, _, _ := strings.Cut(strings.TrimPrefix(target, "/"), "?")
+	return s.lookup(&reqProps{request: &reqPath{path: path}, headers: map[string]string{"Host": host}})
+}
+
 func (s *server) writeResponse(status int, headers map[string]string, body string, conn net.Conn) int {
-	write, writeErr := conn.Write(buildHttpResponse(status, headers, body))
+	var write int
+	var writeErr error
+
+	if rc, ok := conn.(*responseConn); ok {
+		write, writeErr = rc.writeResponse(status, headers, body)
+	} else {
+		write, writeErr = conn.Write(buildHttpResponse(status, headers, body))
+	}
+
 	if writeErr != nil {
 		fmt.Println("Error sending response in connection: ", writeErr.Error())
 		return -1
@@ -295,6 +839,34 @@ func (s *server) writeResponse(status int, headers map[string]string, body strin
 	return write
 }
 
+// writeHead sends the status line and headers of a response whose body the handler writes to the
+// connection afterwards, without a Content-Length the body is sent in chunks
+func (s *server) writeHead(status int, headers map[string]string, conn net.Conn) error {
+	if rc, ok := conn.(*responseConn); ok {
+		return rc.writeHead(status, headers)
+	}
+
+	_, err := conn.Write(buildHttpResponse(status, headers, ""))
+	return err
+}
+
+// writeStream sends the status line and headers and then copies the body from the reader,
+// returns the amount of body bytes written or -1 when the response could not be sent
+func (s *server) writeStream(status int, headers map[string]string, body io.Reader, conn net.Conn) int64 {
+	writeErr := s.writeHead(status, headers, conn)
+	if writeErr != nil {
+		fmt.Println("Error sending response in connection: ", writeErr.Error())
+		return -1
+	}
+
+	written, copyErr := io.Copy(conn, body)
+	if copyErr != nil {
+		fmt.Println("Error sending response body in connection: ", copyErr.Error())
+		return -1
+	}
+	return written
+}
+
 func (s *server) registerHandler(path string, handle func(props *reqProps, conn net.Conn)) error {
 	//todo: we could validate the path validity and that would in facto return an error
 
@@ -303,6 +875,11 @@ func (s *server) registerHandler(path string, handle func(props *reqProps, conn
 	if len(pathParts) == 1 {
 		p := pathParts[0]
 		if p == "" {
+			// the root may already exist without a handler, created to hang a limit or a middleware on
+			if s.paths.root != nil && s.paths.root.handler == nil {
+				s.paths.root.handler = handle
+				return nil
+			}
 			s.paths.addRoot(path, handle)
 			return nil
 		}
@@ -337,63 +914,243 @@ func (s *server) registerHandler(path string, handle func(props *reqProps, conn
 	return nil
 }
 
+// registerMethodHandler associates the handler to a single http method of the path, requests
+// for methods without a handler are answered with 405 listing the registered ones
+func (s *server) registerMethodHandler(method string, path string, handle func(props *reqProps, conn net.Conn)) error {
+	n := s.nodeFor(path)
+
+	if n.methods == nil {
+		n.methods = make(map[string]func(props *reqProps, conn net.Conn))
+	}
+
+	if _, ok := n.methods[method]; ok {
+		return fmt.Errorf("the method %s of path %s has already a handler associated", method, path)
+	}
+
+	n.methods[method] = handle
+
+	return nil
+}
+
+// nodeFor walks the tree until the node of the path, creating the missing ones on the way
+func (s *server) nodeFor(path string) *node {
+	if path == "" {
+		if s.paths.root == nil {
+			s.paths.addRoot(path, nil)
+		}
+		return s.paths.root
+	}
+
+	currNode := s.paths.root
+	if currNode == nil {
+		panic("you cannot add child paths that have no root yet, please define a global root")
+	}
+
+	for _, part := range strings.Split(path, "/") {
+		if p, ok := currNode.childPaths[part]; ok {
+			currNode = p
+		} else {
+			currNode = currNode.addChild(part, part[0] == '{', nil)
+		}
+	}
+
+	return currNode
+}
+
 func (s *server) handle(conn net.Conn) error {
-	r := s.req.request
+	return s.serve(s.req, conn)
+}
 
-	root := s.paths.root
-	if root.path == r.path {
-		root.handler(s.req, conn)
+// serve finds the node of the request path and calls its handler wrapped by the server middlewares
+func (s *server) serve(props *reqProps, conn net.Conn) error {
+	n := s.lookup(props)
 
-		return nil
+	if n == nil {
+		return errors.New(fmt.Sprintf("no handler found for request %s", props.request))
+	}
+
+	return s.dispatch(n, props, conn)
+}
+
+// lookup walks the tree for the request path, the values matched by templates are added to the
+// request params
+func (s *server) lookup(props *reqProps) *node {
+	r := props.request
+
+	// the tree of the host of the request is chosen before walking it
+	root := s.treeFor(props.header("Host")).root
+	if root.path == r.path {
+		return root
 	}
 
 	currNode := root
 
 	pathParts := strings.Split(r.path, "/")
 
-	found := true
-	for _, part := range pathParts {
+	// the last {name...} segment passed takes the rest of the path when nothing more precise matches
+	var catchAll *node
+	var catchAllParams []string
+
+	for i, part := range pathParts {
+		for _, n := range currNode.childPaths {
+			if n.catchAll {
+				catchAll = n
+				catchAllParams = append(r.params[:len(r.params):len(r.params)], strings.Join(pathParts[i:], "/"))
+				break
+			}
+		}
+
 		if p, ok := currNode.childPaths[part]; ok {
 			currNode = p
-		} else {
-
-			for _, n := range currNode.childPaths {
-				if n.template {
-					found = true
-					r.params = append(r.params, part)
-					currNode = n
-					break
-				}
+			continue
+		}
 
-				found = false
+		found := false
+		for _, n := range currNode.childPaths {
+			if n.template && !n.catchAll {
+				found = true
+				r.params = append(r.params, part)
+				currNode = n
 				break
 			}
 		}
+
+		if !found {
+			if catchAll != nil {
+				r.params = catchAllParams
+				return catchAll
+			}
+			return nil
+		}
 	}
 
-	if !found {
-		return errors.New(fmt.Sprintf("no handler found for request %s", s.req.request))
+	if catchAll != nil && currNode.handler == nil && len(currNode.methods) == 0 && currNode.websocket == nil {
+		r.params = catchAllParams
+		return catchAll
 	}
 
-	currNode.handler(s.req, conn)
+	return currNode
+}
+
+// dispatch calls the handler of the node for the request method, falling back to the handler
+// registered for every method
+func (s *server) dispatch(n *node, props *reqProps, conn net.Conn) error {
+	var h handlerFunc
+
+	policy := n.corsPolicy()
+	_, hasOptions := n.methods["OPTIONS"]
+	preflight := policy != nil && !hasOptions && isPreflight(props)
+
+	if preflight {
+		h = func(props *reqProps, conn net.Conn) {
+			s.preflight(n, policy, props, conn)
+		}
+	} else if mh, ok := n.methods[props.method]; ok {
+		h = mh
+	} else if n.handler != nil {
+		h = n.handler
+	} else if len(n.methods) > 0 {
+		allowed := n.allowedMethods()
+		h = func(props *reqProps, conn net.Conn) {
+			s.writeResponse(405, map[string]string{"Allow": allowed}, "", conn)
+		}
+	} else {
+		return errors.New(fmt.Sprintf("no handler found for request %s", props.request))
+	}
+
+	props.route = n.route
+	s.wrap(n, h, preflight)(props, conn)
 
 	return nil
 }
 
+// wrap surrounds the handler of the node with the middlewares of the groups it is in and of the
+// route, its cors headers and the server middlewares
+func (s *server) wrap(n *node, h handlerFunc, preflight bool) handlerFunc {
+	// browsers send preflights without credentials, so they are answered before the middlewares
+	// of the route could refuse them
+	if !preflight {
+		for i := len(s.lastMiddlewares) - 1; i >= 0; i-- {
+			h = s.lastMiddlewares[i](h)
+		}
+
+		// the groups closest to the route run last
+		for c := n; c != nil; c = c.parent {
+			for i := len(c.groupMiddlewares) - 1; i >= 0; i-- {
+				h = c.groupMiddlewares[i](h)
+			}
+		}
+
+		for i := len(n.middlewares) - 1; i >= 0; i-- {
+			h = n.middlewares[i](h)
+		}
+
+		if policy := n.corsPolicy(); policy != nil {
+			h = corsHeaders(policy)(h)
+		}
+	}
+
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+
+	return h
+}
+
+// readBytes reads the request head and then as much of the body as the Content-Length announces,
+// a body can arrive in several reads so stopping at the first short read is not enough. A client
+// too slow once it started sending its request gets errRequestTimeout
 func (s *server) readBytes(conn net.Conn) ([]byte, error) {
-	requestBuffer := make([]byte, 1024)
+	requestBuffer := make([]byte, 4096)
 	var requestData []byte
+	expected := -1
+
+	conn.SetReadDeadline(deadline(s.timeouts.idle))
+	defer conn.SetReadDeadline(time.Time{})
 
 	for {
 		r, errR := conn.Read(requestBuffer)
 
 		if errR != nil {
+			if len(requestData) > 0 && isTimeout(errR) {
+				return nil, errRequestTimeout
+			}
 			return nil, errR
 		}
 
+		if len(requestData) == 0 && r > 0 {
+			conn.SetReadDeadline(deadline(s.timeouts.header))
+		}
+
 		requestData = append(requestData, requestBuffer[:r]...)
 
-		if r < len(requestBuffer) {
+		if expected == -1 {
+			if limitErr := s.limits.checkHead(requestData); limitErr != nil {
+				return nil, limitErr
+			}
+
+			endHeadersIdx := bytes.Index(requestData, []byte("\r\n\r\n"))
+			if endHeadersIdx == -1 {
+				continue
+			}
+
+			// a body over the limit is refused before any of it is read
+			head := requestData[:endHeadersIdx]
+			length := contentLength(head)
+			if limit := s.bodyLimit(headValue(head, "Host"), requestTarget(requestData)); limit > 0 && int64(length) > limit {
+				return nil, errBodyTooLarge
+			}
+
+			expected = endHeadersIdx + 4 + length
+			conn.SetReadDeadline(deadline(s.timeouts.body))
+
+			// the routes streaming their body read it themselves once the head is parsed
+			if s.streamsBody(headValue(head, "Host"), requestTarget(requestData)) {
+				break
+			}
+		}
+
+		if len(requestData) >= expected {
 			break
 		}
 	}
@@ -401,47 +1158,171 @@ func (s *server) readBytes(conn net.Conn) ([]byte, error) {
 	return requestData, nil
 }
 
+// requestTarget gives the target of the request line, empty when the line is malformed
+func requestTarget(data []byte) string {
+	line, _, _ := bytes.Cut(data, []byte(HttpPartSeperator))
+	parts := strings.Split(string(line), " ")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// contentLength reads the Content-Length header in the request head, 0 when there is none
+func contentLength(head []byte) int {
+	length, err := strconv.Atoi(headValue(head, "Content-Length"))
+	if err != nil || length < 0 {
+		return 0
+	}
+	return length
+}
+
+// headValue finds the header in the request head before it is parsed, empty when there is none
+func headValue(head []byte, header string) string {
+	for _, line := range strings.Split(string(head), HttpPartSeperator) {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), header) {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
 func readRequest(buffer []byte) (*reqProps, error) {
 	req := string(buffer)
 
-	fmt.Println(req)
-
 	firstSplit := strings.Index(req, "\r\n")
+	if firstSplit == -1 {
+		return nil, errMalformedRequest
+	}
 
 	requestLine := req[:firstSplit]
 
 	requestLineParts := strings.Split(requestLine, " ")
+	if len(requestLineParts) < 2 || requestLineParts[0] == "" {
+		return nil, errMalformedRequest
+	}
 	httpMethod := requestLineParts[0]
 
-	fmt.Println("Http Method: ", httpMethod)
-	path := strings.TrimPrefix(requestLineParts[1], "/")
+	// an absolute-form target names the host, the request is for the path on that host
+	authority, target := splitTarget(requestLineParts[1])
+
+	path, query, _ := strings.Cut(strings.TrimPrefix(target, "/"), "?")
 
 	remainingHttpReq := req[firstSplit:]
 
 	endHeadersIdx := strings.Index(remainingHttpReq, "\r\n\r\n")
+	if endHeadersIdx == -1 {
+		return nil, errMalformedRequest
+	}
 	headersPart := remainingHttpReq[:endHeadersIdx]
 
 	headersLine := strings.Split(strings.TrimPrefix(headersPart, "\r\n"), "\r\n")
 
 	headers := make(map[string]string, len(headersLine))
 	for _, s := range headersLine {
+		if s == "" {
+			continue
+		}
+
+		// no whitespace is allowed before the colon, RFC 9112 section 5.1
 		firstSepIdx := strings.Index(s, ":")
-		headers[s[:firstSepIdx]] = strings.TrimSpace(s[firstSepIdx+1:])
+		if firstSepIdx <= 0 || strings.ContainsAny(s[:firstSepIdx], " \t") {
+			return nil, errMalformedRequest
+		}
+		name, value := s[:firstSepIdx], strings.TrimSpace(s[firstSepIdx+1:])
+
+		// a repeated header is a list, but the Host and the Content-Length have to be given once or
+		// the routing and the framing would depend on which one is read, RFC 9112 sections 3.2 and 6.3
+		if previous, repeated := headerName(headers, name); repeated {
+			if strings.EqualFold(name, "Host") || strings.EqualFold(name, "Content-Length") {
+				return nil, errMalformedRequest
+			}
+			separator := ", "
+			if strings.EqualFold(name, "Cookie") {
+				separator = "; "
+			}
+			headers[previous] += separator + value
+			continue
+		}
+		headers[name] = value
+	}
+
+	// the host of an absolute-form target wins over the Host header
+	if authority != "" {
+		setHeader(headers, "Host", authority)
 	}
 
 	bodyLine := remainingHttpReq[endHeadersIdx+4:] // 4 here is the \r\n\r\n found at the end of headers
 
+	var version string
+	if len(requestLineParts) > 2 {
+		version = requestLineParts[2]
+	}
+
 	return &reqProps{
-		method: httpMethod,
+		method:  httpMethod,
+		version: version,
 		request: &reqPath{
 			path:   path,
+			query:  query,
 			params: nil,
 		},
 		headers: headers,
 		body:    []byte(bodyLine),
+		target:  requestLineParts[1],
 	}, nil
 }
 
+// splitTarget gives the host and the rest of an absolute-form target, the host is empty for the
+// other forms
+func splitTarget(target string) (string, string) {
+	if !isAbsoluteForm(target) {
+		return "", target
+	}
+
+	hostAndPath := target[strings.Index(target, "://")+3:]
+	end := strings.IndexAny(hostAndPath, "/?")
+	if end == -1 {
+		end = len(hostAndPath)
+	}
+
+	return hostAndPath[:end], hostAndPath[end:]
+}
+
+// isAbsoluteForm tells whether the request target starts with a scheme and a host, an origin-form
+// target like /login?next=https://x only has :// after its path began
+func isAbsoluteForm(target string) bool {
+	i := strings.Index(target, "://")
+	return i > 0 && !strings.ContainsAny(target[:i], "/?")
+}
+
+// header looks for the header ignoring the case of its name, as clients are free to send it in any case
+func (p *reqProps) header(name string) string {
+	return headerValue(p.headers, name)
+}
+
+// bodyStream gives a reader of the body, whether it was buffered or is streamed from the connection
+func (p *reqProps) bodyStream() io.Reader {
+	if p.bodyReader != nil {
+		return p.bodyReader
+	}
+	return bytes.NewReader(p.body)
+}
+
+// readBody buffers a streamed body for the ones needing all of it at once, the body is then read
+// from memory like on the other routes
+func (p *reqProps) readBody() ([]byte, error) {
+	if p.bodyReader == nil {
+		return p.body, nil
+	}
+
+	body, err := io.ReadAll(p.bodyReader)
+	p.body, p.bodyReader = body, nil
+	return body, err
+}
+
 func buildHttpResponse(status int, headers map[string]string, body string) []byte {
 	statusLine := fmt.Sprintf("%s %d %s%s", HttpVersion, status, codeToReason[status], HttpPartSeperator)
 
@@ -450,7 +1331,10 @@ func buildHttpResponse(status int, headers map[string]string, body string) []byt
 		headerPart = HttpPartSeperator
 	} else {
 		for k, header := range headers {
-			headerPart += k + ":" + header + HttpPartSeperator
+			// a header sent several times, like Set-Cookie, has its values separated by new lines
+			for _, v := range strings.Split(header, "\n") {
+				headerPart += k + ":" + v + HttpPartSeperator
+			}
 		}
 		headerPart += HttpPartSeperator
 	}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -193,6 +199,43 @@ func TestReadRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("Should be able to read a request with a query", func(t *testing.T) {
+		request := "GET /echo/abc?a=1&b=2 HTTP/1.1\r\nHost: localhost:4221\r\n\r\n"
+
+		props, err := readRequest([]byte(request))
+
+		if err != nil {
+			t.Log("There should be no error")
+			t.Fail()
+		}
+
+		if props.request.path != "echo/abc" || props.request.query != "a=1&b=2" {
+			t.Logf("Path and query should be split, got %s and %s", props.request.path, props.request.query)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should be able to read a request with an absolute-form target", func(t *testing.T) {
+		request := "GET http://example.com:8080/echo/abc?a=1 HTTP/1.1\r\nHost: other\r\n\r\n"
+
+		props, err := readRequest([]byte(request))
+
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+
+		if props.request.path != "echo/abc" || props.request.query != "a=1" {
+			t.Logf("Path and query should come from the target, got %s and %s", props.request.path, props.request.query)
+			t.Fail()
+		}
+
+		if props.header("Host") != "example.com:8080" || props.target != "http://example.com:8080/echo/abc?a=1" {
+			t.Logf("Host should be the one of the target, got %s", props.header("Host"))
+			t.Fail()
+		}
+	})
+
 	t.Run("Should be able to read a request with body", func(t *testing.T) {
 		request := "POST /user-agent HTTP/1.1\r\nHost: localhost:4221\r\nUser-Agent: foobar/1.2.3\r\nAccept: */*\r\n\r\n12345"
 
@@ -218,6 +261,162 @@ func TestReadRequest(t *testing.T) {
 	})
 }
 
+func TestWriteStream(t *testing.T) {
+
+	t.Run("Should be able to stream a file as the response body", func(t *testing.T) {
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		f := tempFile(t, content)
+
+		var received bytes.Buffer
+		client, done := peerConn(t, &received)
+
+		s := &server{paths: create()}
+		headers := map[string]string{
+			"Content-Length": strconv.Itoa(len(content)),
+		}
+
+		written := s.writeStream(200, headers, f, client)
+		client.Close()
+
+		if written != int64(len(content)) {
+			t.Logf("Should have written %d bytes, wrote %d", len(content), written)
+			t.Fail()
+		}
+
+		<-done
+		expected := append(buildHttpResponse(200, headers, ""), content...)
+
+		if !bytes.Equal(received.Bytes(), expected) {
+			t.Log("The response should be the headers followed by the whole file")
+			t.Fail()
+		}
+	})
+}
+
+// benchmarks the old download loop against streaming with io.Copy, a tcp connection is used so
+// the kernel sendfile path can kick in for the copy
+func BenchmarkFileResponse(b *testing.B) {
+	content := bytes.Repeat([]byte("a"), 4<<20)
+	f := tempFile(b, content)
+
+	s := &server{paths: create()}
+	headers := map[string]string{
+		"Content-type":   "application/octet-stream",
+		"Content-Length": strconv.Itoa(len(content)),
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		conn, _ := peerConn(b, io.Discard)
+		b.SetBytes(int64(len(content)))
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			f.Seek(0, io.SeekStart)
+			conn.Write(buildHttpResponse(200, headers, ""))
+
+			for {
+				bs := make([]byte, 1024)
+				r, e := f.Read(bs)
+				if e != nil {
+					break
+				}
+				conn.Write([]byte(string(bs[:r])))
+			}
+		}
+	})
+
+	b.Run("copy", func(b *testing.B) {
+		conn, _ := peerConn(b, io.Discard)
+		b.SetBytes(int64(len(content)))
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			f.Seek(0, io.SeekStart)
+			s.writeStream(200, headers, f, conn)
+		}
+	})
+}
+
+func tempFile(tb testing.TB, content []byte) *os.File {
+	path := filepath.Join(tb.TempDir(), "file")
+
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		tb.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		f.Close()
+	})
+
+	return f
+}
+
+// peerConn gives a tcp connection whose peer copies everything it reads into sink, the channel
+// is closed once the connection has been closed and the peer is done reading
+func peerConn(tb testing.TB, sink io.Writer) (net.Conn, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		peer, acceptErr := l.Accept()
+		l.Close()
+		if acceptErr != nil {
+			return
+		}
+		io.Copy(sink, peer)
+		peer.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn, done
+}
+
+func TestReadBytes(t *testing.T) {
+
+	t.Run("Should read the whole body even when it arrives in several parts", func(t *testing.T) {
+		client, peer := net.Pipe()
+		defer client.Close()
+
+		body := bytes.Repeat([]byte("b"), 10000)
+		go func() {
+			peer.Write([]byte("POST /files/a HTTP/1.1\r\ncontent-length: 10000\r\n\r\n"))
+			for i := 0; i < len(body); i += 1000 {
+				peer.Write(body[i : i+1000])
+			}
+		}()
+
+		s := &server{paths: create()}
+		data, err := s.readBytes(client)
+
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+
+		props, _ := readRequest(data)
+
+		if !bytes.Equal(props.body, body) {
+			t.Logf("Body should have %d bytes, has %d", len(body), len(props.body))
+			t.Fail()
+		}
+	})
+}
+
 func serverCleanup(s *server) {
 	s.paths = create()
 	rootCreation(s)
@@ -232,3 +431,47 @@ func rootCreation(s *server) {
 		panic("root should be able to be registered")
 	}
 }
+
+// testServer creates a server whose routes are added by register, the root is created without a
+// handler so register can give it one
+func testServer(t *testing.T, register func(s *server) error) *server {
+	s := &server{paths: create()}
+	s.nodeFor("")
+
+	if err := register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// routesServer creates a server with the routes of the application, its files in a temporary
+// directory
+func routesServer(t *testing.T) *server {
+	return testServer(t, func(s *server) error {
+		s.directory = t.TempDir()
+		s.formMemory = defaultFormMemory
+		s.use(compression(compressionConfig{}))
+
+		return registerRoutes(s)
+	})
+}
+
+// listen serves the server on a local port, behind tls when there is a config, until the test ends
+func listen(t *testing.T, s *server, config *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+
+	go s.acceptConnections(l)
+
+	return l.Addr().String()
+}
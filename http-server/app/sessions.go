@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionCookie = "session"
+	defaultSessionTTL    = 24 * time.Hour
+	defaultMaxSessions   = 100000
+	sessionSweepInterval = time.Minute
+
+	// browsers keep cookies up to 4096 bytes, name and attributes included
+	maxCookieSessionSize = 4000
+
+	csrfSessionKey = "_csrf"
+	csrfHeader     = "X-CSRF-Token"
+	csrfField      = "csrf_token"
+	csrfRoute      = "csrf"
+)
+
+var (
+	errSessionTooLarge  = errors.New("the session is too large for a cookie")
+	errSessionStoreFull = errors.New("the session store is full")
+	errUnknownStore     = errors.New("the session store should be memory or cookie")
+)
+
+// sessionStore keeps the values of the sessions between requests, the token it gives back on
+// save is what the session cookie holds
+type sessionStore interface {
+	load(token string) (values map[string]string, expires time.Time, ok bool)
+	// save is given the token the session was loaded with, empty for a new or renewed session
+	save(token string, values map[string]string, expires time.Time) (string, error)
+	remove(token string)
+}
+
+// session holds the values of the client across its requests, handlers find it on the props
+// when the sessions middleware runs before them
+type session struct {
+	mu        sync.Mutex
+	token     string
+	previous  string
+	values    map[string]string
+	expires   time.Time
+	hadCookie bool
+	changed   bool
+	destroyed bool
+}
+
+func (sess *session) get(key string) (string, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	v, ok := sess.values[key]
+	return v, ok
+}
+
+func (sess *session) set(key string, value string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.values[key] = value
+	sess.changed = true
+}
+
+func (sess *session) delete(key string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if _, ok := sess.values[key]; ok {
+		delete(sess.values, key)
+		sess.changed = true
+	}
+}
+
+// renew keeps the values under a new token, to be called when the user logs in so a token known
+// before cannot be used to ride the logged in session
+func (sess *session) renew() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.token != "" {
+		sess.previous = sess.token
+		sess.token = ""
+	}
+	sess.changed = true
+}
+
+// destroy drops the session from the store and deletes the cookie of the client
+func (sess *session) destroy() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.values = make(map[string]string)
+	sess.destroyed = true
+}
+
+type sessionConfig struct {
+	store    sessionStore
+	name     string
+	path     string
+	domain   string
+	secure   bool
+	sameSite string
+	ttl      time.Duration
+}
+
+// sessions loads the session of the cookie of the request before the handler and saves it when
+// the response head is written, the cookie is only sent when the session changed or has less
+// than half its ttl left. The cookie is HttpOnly so scripts of the page never see the token. A
+// cookie browsers would refuse is an error here rather than sessions that never come back
+func (s *server) sessions(cfg sessionConfig) (middleware, error) {
+	if cfg.ttl <= 0 {
+		return nil, errors.New("the sessions should live for a positive ttl")
+	}
+
+	probe := &cookie{
+		name:     cfg.name,
+		path:     cfg.path,
+		domain:   cfg.domain,
+		secure:   cfg.secure,
+		httpOnly: true,
+		sameSite: cfg.sameSite,
+	}
+	if _, err := probe.serialize(); err != nil {
+		return nil, err
+	}
+
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			sess := &session{values: make(map[string]string)}
+
+			if token, ok := props.cookie(cfg.name); ok {
+				sess.hadCookie = true
+				if values, expires, found := cfg.store.load(token); found {
+					sess.token, sess.values, sess.expires = token, values, expires
+				}
+			}
+			props.session = sess
+
+			if rc, ok := conn.(*responseConn); ok {
+				rc.onHead(func(status int, headers map[string]string, size int64) {
+					saveSession(cfg, sess, headers)
+				})
+			}
+
+			next(props, conn)
+		}
+	}, nil
+}
+
+func saveSession(cfg sessionConfig, sess *session, headers map[string]string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	c := &cookie{
+		name:     cfg.name,
+		path:     cfg.path,
+		domain:   cfg.domain,
+		secure:   cfg.secure,
+		httpOnly: true,
+		sameSite: cfg.sameSite,
+	}
+
+	if sess.previous != "" {
+		cfg.store.remove(sess.previous)
+		sess.previous = ""
+	}
+
+	now := time.Now()
+	switch {
+	case sess.destroyed:
+		if sess.token != "" {
+			cfg.store.remove(sess.token)
+		}
+		if !sess.hadCookie {
+			return
+		}
+		c.maxAge = -1
+	case sess.changed || (sess.token != "" && sess.expires.Sub(now) < cfg.ttl/2):
+		token, err := cfg.store.save(sess.token, sess.values, now.Add(cfg.ttl))
+		if err != nil {
+			fmt.Println("Error while saving the session : ", err.Error())
+			return
+		}
+		sess.token = token
+		c.value = token
+		c.maxAge = int(cfg.ttl.Seconds())
+	case sess.hadCookie && sess.token == "":
+		// the session of the cookie expired or is unknown, the browser can forget it
+		c.maxAge = -1
+	default:
+		return
+	}
+
+	if err := setCookie(headers, c); err != nil {
+		fmt.Println("Error while setting the session cookie : ", err.Error())
+	}
+}
+
+// memorySessionStore keeps the sessions in the process, they are lost on restart. The token is
+// a random id, expired sessions are swept from time to time as new ones are saved. Once it holds
+// max sessions the new ones are refused rather than dropping live ones
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]storedSession
+	max       int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type storedSession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func newMemorySessionStore(max int) *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]storedSession), max: max, now: time.Now}
+}
+
+func (m *memorySessionStore) load(token string) (map[string]string, time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.sessions[token]
+	if !ok || !m.now().Before(stored.expires) {
+		return nil, time.Time{}, false
+	}
+
+	return copyValues(stored.values), stored.expires, true
+}
+
+func (m *memorySessionStore) save(token string, values map[string]string, expires time.Time) (string, error) {
+	if token == "" {
+		id, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		token = id
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	_, known := m.sessions[token]
+	full := !known && m.max > 0 && len(m.sessions) >= m.max
+
+	if full || now.Sub(m.lastSweep) > sessionSweepInterval {
+		for t, stored := range m.sessions {
+			if !now.Before(stored.expires) {
+				delete(m.sessions, t)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	if !known && m.max > 0 && len(m.sessions) >= m.max {
+		return "", errSessionStoreFull
+	}
+
+	m.sessions[token] = storedSession{values: copyValues(values), expires: expires}
+	return token, nil
+}
+
+func (m *memorySessionStore) remove(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, token)
+}
+
+// cookieSessionStore keeps the whole session in the cookie signed with the first of its keys,
+// nothing is kept on the server. The values are signed and not encrypted, the client can read
+// them so secrets do not belong there, and a destroyed session stays valid until it expires for
+// whoever kept a copy of the cookie
+type cookieSessionStore struct {
+	keys []signingKey
+	now  func() time.Time
+}
+
+type cookieSession struct {
+	Values  map[string]string `json:"v"`
+	Expires int64             `json:"e"`
+}
+
+func newCookieSessionStore(keys []signingKey) *cookieSessionStore {
+	return &cookieSessionStore{keys: keys, now: time.Now}
+}
+
+func (c *cookieSessionStore) load(token string) (map[string]string, time.Time, bool) {
+	payload, rest, found := strings.Cut(token, ".")
+	kid, signature, foundSignature := strings.Cut(rest, ".")
+	if !found || !foundSignature {
+		return nil, time.Time{}, false
+	}
+
+	var key *signingKey
+	for i := range c.keys {
+		if c.keys[i].id == kid {
+			key = &c.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, time.Time{}, false
+	}
+
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum, cookieSignature(key, payload)) {
+		return nil, time.Time{}, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+
+	var stored cookieSession
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, time.Time{}, false
+	}
+
+	expires := time.Unix(stored.Expires, 0)
+	if !c.now().Before(expires) {
+		return nil, time.Time{}, false
+	}
+	if stored.Values == nil {
+		stored.Values = make(map[string]string)
+	}
+
+	return stored.Values, expires, true
+}
+
+func (c *cookieSessionStore) save(token string, values map[string]string, expires time.Time) (string, error) {
+	raw, err := json.Marshal(cookieSession{Values: values, Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	key := &c.keys[0]
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	token = payload + "." + key.id + "." + base64.RawURLEncoding.EncodeToString(cookieSignature(key, payload))
+
+	if len(token) > maxCookieSessionSize {
+		return "", errSessionTooLarge
+	}
+	return token, nil
+}
+
+// remove has nothing to do, the session only lives in the cookie
+func (c *cookieSessionStore) remove(token string) {}
+
+func cookieSignature(key *signingKey, payload string) []byte {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte("session\n" + payload))
+	return mac.Sum(nil)
+}
+
+// newSessionStore builds the store named by the -session-store flag, the memory store keeps at
+// most maxSessions sessions
+func newSessionStore(name string, keys []signingKey, maxSessions int) (sessionStore, error) {
+	switch name {
+	case "memory":
+		if maxSessions <= 0 {
+			return nil, errors.New("the memory session store should keep a positive number of sessions")
+		}
+		return newMemorySessionStore(maxSessions), nil
+	case "cookie":
+		if len(keys) == 0 {
+			return nil, errors.New("the cookie session store needs a -session-key")
+		}
+		for _, k := range keys {
+			if !validCookieValue(k.id) || strings.Contains(k.id, ".") {
+				return nil, fmt.Errorf("the session key id %s should not have dots or characters cookies can not hold", k.id)
+			}
+		}
+		return newCookieSessionStore(keys), nil
+	default:
+		return nil, errUnknownStore
+	}
+}
+
+// csrfToken gives the token the forms and scripts of the session send back with their unsafe
+// requests, it is made the first time it is asked for
+func csrfToken(props *reqProps) (string, error) {
+	if props.session == nil {
+		return "", errors.New("there is no session to keep the csrf token in")
+	}
+
+	if token, ok := props.session.get(csrfSessionKey); ok {
+		return token, nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	props.session.set(csrfSessionKey, token)
+	return token, nil
+}
+
+// registerCsrf asks for the csrf token of the session on the unsafe requests of the routes and of
+// the routes below them, the pages and scripts get the token of their session from GET /csrf. It
+// has to be called once the sessions middleware is used
+func (s *server) registerCsrf(routes []string) error {
+	for _, route := range routes {
+		route = strings.Trim(route, "/")
+		if !s.nodeFor(route).hasRoutes() {
+			return fmt.Errorf("there is no route at or below %s", route)
+		}
+		s.useBelow(route, s.csrf())
+	}
+
+	return s.registerMethodHandler("GET", csrfRoute, func(props *reqProps, conn net.Conn) {
+		token, err := csrfToken(props)
+		if err != nil {
+			fmt.Println("Error while making the csrf token : ", err.Error())
+			s.writeInternalError(conn)
+			return
+		}
+
+		body, _ := json.Marshal(map[string]string{"token": token})
+		var headers = map[string]string{
+			"Content-Type":   "application/json",
+			"Content-Length": strconv.Itoa(len(body)),
+			// the token belongs to the session of the cookie, a cache must not give it to another
+			"Cache-Control": "no-store",
+		}
+		s.writeResponse(200, headers, string(body), conn)
+	})
+}
+
+// csrf refuses the unsafe requests that do not carry the csrf token of their session in the
+// X-CSRF-Token header or the csrf_token form field, it has to run after the sessions middleware
+func (s *server) csrf() middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			switch props.method {
+			case "GET", "HEAD", "OPTIONS", "TRACE":
+				next(props, conn)
+				return
+			}
+
+			var expected string
+			if props.session != nil {
+				expected, _ = props.session.get(csrfSessionKey)
+			}
+
+			token := props.header(csrfHeader)
+			if token == "" {
+				token = s.csrfFormToken(props)
+			}
+
+			if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				body := "the csrf token is missing or wrong"
+				s.writeResponse(403, map[string]string{"Content-Type": "text/plain", "Content-Length": strconv.Itoa(len(body))}, body, conn)
+				return
+			}
+
+			next(props, conn)
+		}
+	}
+}
+
+// csrfFormToken reads the token of the form in the body, the query string is not looked at as it
+// ends up in logs and Referer headers. A streamed body is left to the handler, the token then has
+// to come in the header
+func (s *server) csrfFormToken(props *reqProps) string {
+	if props.header("Content-Type") == "" || props.bodyReader != nil {
+		return ""
+	}
+
+	f, err := parseForm(props, s.formMemory)
+	if err != nil {
+		return ""
+	}
+	defer f.removeAll()
+
+	if f.parts != nil {
+		if values := f.parts.Value[csrfField]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	// the values of the body come before the ones of the query
+	inQuery := 0
+	if query, err := url.ParseQuery(props.request.query); err == nil {
+		inQuery = len(query[csrfField])
+	}
+	if values := f.values[csrfField]; len(values) > inQuery {
+		return values[0]
+	}
+	return ""
+}
+
+// randomToken gives 32 random bytes, base64 encoded to fit in cookies and urls
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func copyValues(values map[string]string) map[string]string {
+	c := make(map[string]string, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
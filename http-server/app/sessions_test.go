@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionRoutes registers routes logging in and out over sessions of the store, and a route
+// protected from csrf
+func sessionRoutes(store sessionStore) func(s *server) error {
+	return func(s *server) error {
+		sessions, err := s.sessions(sessionConfig{store: store, name: "sid", path: "/", sameSite: "Lax", ttl: time.Hour})
+		if err != nil {
+			return err
+		}
+		s.use(sessions)
+
+		answer := func(conn net.Conn, body string) {
+			s.writeResponse(200, map[string]string{"Content-Length": strconv.Itoa(len(body))}, body, conn)
+		}
+
+		routes := map[string]func(props *reqProps, conn net.Conn){
+			"login": func(props *reqProps, conn net.Conn) {
+				props.session.renew()
+				props.session.set("user", props.request.query)
+				answer(conn, "")
+			},
+			"whoami": func(props *reqProps, conn net.Conn) {
+				user, _ := props.session.get("user")
+				answer(conn, user)
+			},
+			"logout": func(props *reqProps, conn net.Conn) {
+				props.session.destroy()
+				answer(conn, "")
+			},
+		}
+		for path, h := range routes {
+			if err := s.registerHandler(path, h); err != nil {
+				return err
+			}
+		}
+
+		if err := s.registerMethodHandler("POST", "transfer", func(props *reqProps, conn net.Conn) {
+			answer(conn, "done")
+		}); err != nil {
+			return err
+		}
+
+		// the same wiring as the -csrf flag
+		return s.registerCsrf([]string{"/transfer"})
+	}
+}
+
+func sessionClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func sessionGet(t *testing.T, client *http.Client, rawURL string) (*http.Response, string) {
+	res, err := client.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	return res, string(body)
+}
+
+func TestSessions(t *testing.T) {
+	stores := map[string]func() sessionStore{
+		"memory": func() sessionStore { return newMemorySessionStore(defaultMaxSessions) },
+		"cookie": func() sessionStore {
+			return newCookieSessionStore([]signingKey{{id: "k1", secret: []byte("the secret of the session cookies")}})
+		},
+	}
+
+	for name, store := range stores {
+		addr := listen(t, testServer(t, sessionRoutes(store())), nil)
+		base := "http://" + addr
+
+		t.Run("Should not set a cookie for a session that was not used with the "+name+" store", func(t *testing.T) {
+			res, _ := sessionGet(t, sessionClient(t), base+"/whoami")
+
+			if res.Header.Get("Set-Cookie") != "" {
+				t.Logf("an unused session should not be sent, got %q", res.Header.Get("Set-Cookie"))
+				t.Fail()
+			}
+		})
+
+		t.Run("Should keep the values across requests with the "+name+" store", func(t *testing.T) {
+			client := sessionClient(t)
+
+			res, _ := sessionGet(t, client, base+"/login?alice")
+			setCookie := res.Header.Get("Set-Cookie")
+			if !strings.HasPrefix(setCookie, "sid=") || !strings.Contains(setCookie, "; HttpOnly; SameSite=Lax") || !strings.Contains(setCookie, "Max-Age=3600") {
+				t.Logf("the session cookie is not the expected one, got %q", setCookie)
+				t.Fail()
+			}
+
+			if _, body := sessionGet(t, client, base+"/whoami"); body != "alice" {
+				t.Logf("the session should remember alice, got %q", body)
+				t.Fail()
+			}
+
+			if _, body := sessionGet(t, sessionClient(t), base+"/whoami"); body != "" {
+				t.Logf("another client should not share the session, got %q", body)
+				t.Fail()
+			}
+		})
+
+		t.Run("Should delete the cookie of a destroyed session with the "+name+" store", func(t *testing.T) {
+			client := sessionClient(t)
+			sessionGet(t, client, base+"/login?bob")
+
+			res, _ := sessionGet(t, client, base+"/logout")
+			if !strings.Contains(res.Header.Get("Set-Cookie"), "Max-Age=0") {
+				t.Logf("the cookie should be deleted, got %q", res.Header.Get("Set-Cookie"))
+				t.Fail()
+			}
+
+			if _, body := sessionGet(t, client, base+"/whoami"); body != "" {
+				t.Logf("the session should be gone, got %q", body)
+				t.Fail()
+			}
+		})
+
+		t.Run("Should ignore a forged cookie with the "+name+" store", func(t *testing.T) {
+			req, _ := http.NewRequest("GET", base+"/whoami", nil)
+			req.Header.Set("Cookie", "sid=eyJ2Ijp7InVzZXIiOiJhZG1pbiJ9LCJlIjo5OTk5OTk5OTk5fQ.k1.forged")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if string(body) != "" || !strings.Contains(res.Header.Get("Set-Cookie"), "Max-Age=0") {
+				t.Logf("the forged session should be dropped, got %q %q", body, res.Header.Get("Set-Cookie"))
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	t.Run("Should give a new token to a renewed session and forget the previous one", func(t *testing.T) {
+		store := newMemorySessionStore(defaultMaxSessions)
+		addr := listen(t, testServer(t, sessionRoutes(store)), nil)
+		client := sessionClient(t)
+
+		sessionGet(t, client, "http://"+addr+"/login?alice")
+		u, _ := url.Parse("http://" + addr)
+		first := client.Jar.Cookies(u)[0].Value
+
+		sessionGet(t, client, "http://"+addr+"/login?alice")
+		second := client.Jar.Cookies(u)[0].Value
+
+		if first == second {
+			t.Log("logging in should change the token")
+			t.Fail()
+		}
+
+		if _, _, ok := store.load(first); ok {
+			t.Log("the previous token should not be valid anymore")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should expire the sessions", func(t *testing.T) {
+		now := time.Now()
+		store := newMemorySessionStore(defaultMaxSessions)
+		store.now = func() time.Time { return now }
+
+		token, _ := store.save("", map[string]string{"user": "alice"}, now.Add(time.Minute))
+		now = now.Add(2 * time.Minute)
+
+		if _, _, ok := store.load(token); ok {
+			t.Log("the session should have expired")
+			t.Fail()
+		}
+
+		store.save("", map[string]string{}, now.Add(time.Minute))
+		if _, ok := store.sessions[token]; ok {
+			t.Log("the expired session should be swept")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse new sessions once full but keep saving the known ones", func(t *testing.T) {
+		now := time.Now()
+		store := newMemorySessionStore(2)
+		store.now = func() time.Time { return now }
+
+		first, _ := store.save("", map[string]string{"user": "alice"}, now.Add(time.Hour))
+		store.save("", map[string]string{"user": "bob"}, now.Add(time.Minute))
+
+		if _, err := store.save("", map[string]string{}, now.Add(time.Hour)); err != errSessionStoreFull {
+			t.Logf("a third session should be refused, got %v", err)
+			t.Fail()
+		}
+
+		if _, err := store.save(first, map[string]string{"user": "alice", "theme": "dark"}, now.Add(time.Hour)); err != nil {
+			t.Logf("a known session should still be saved, got %s", err.Error())
+			t.Fail()
+		}
+
+		// the expired session of bob makes room for a new one
+		now = now.Add(2 * time.Minute)
+		if _, err := store.save("", map[string]string{}, now.Add(time.Hour)); err != nil {
+			t.Logf("the expired session should have been swept for the new one, got %s", err.Error())
+			t.Fail()
+		}
+	})
+}
+
+func TestSessionConfig(t *testing.T) {
+	s := testServer(t, func(s *server) error { return nil })
+	store := newMemorySessionStore(defaultMaxSessions)
+
+	t.Run("Should refuse cookies the browsers would not send back", func(t *testing.T) {
+		for _, cfg := range []sessionConfig{
+			{store: store, name: "sid", path: "/", sameSite: "None", ttl: time.Hour},
+			{store: store, name: "sid", path: "/", sameSite: "Sometimes", ttl: time.Hour},
+			{store: store, name: "bad name", path: "/", sameSite: "Lax", ttl: time.Hour},
+			{store: store, name: "", path: "/", sameSite: "Lax", ttl: time.Hour},
+			{store: store, name: "sid", path: "/", sameSite: "Lax"},
+		} {
+			if _, err := s.sessions(cfg); err == nil {
+				t.Logf("the sessions %+v should be refused", cfg)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should accept SameSite None on secure cookies", func(t *testing.T) {
+		if _, err := s.sessions(sessionConfig{store: store, name: "sid", path: "/", secure: true, sameSite: "None", ttl: time.Hour}); err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a memory store without room", func(t *testing.T) {
+		if _, err := newSessionStore("memory", nil, 0); err == nil {
+			t.Log("There should be an error")
+			t.Fail()
+		}
+	})
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	oldKey := signingKey{id: "k1", secret: []byte("the secret of the session cookies")}
+	newKey := signingKey{id: "k2", secret: []byte("the next secret of the sessions..")}
+
+	t.Run("Should read the sessions signed with a rotated key", func(t *testing.T) {
+		token, _ := newCookieSessionStore([]signingKey{oldKey}).save("", map[string]string{"user": "alice"}, time.Now().Add(time.Hour))
+
+		values, _, ok := newCookieSessionStore([]signingKey{newKey, oldKey}).load(token)
+		if !ok || values["user"] != "alice" {
+			t.Logf("the session of the previous key should be read, got %v", values)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a session whose values were changed", func(t *testing.T) {
+		store := newCookieSessionStore([]signingKey{oldKey})
+		token, _ := store.save("", map[string]string{"user": "alice"}, time.Now().Add(time.Hour))
+		other, _ := store.save("", map[string]string{"user": "admin"}, time.Now().Add(time.Hour))
+
+		payload, _, _ := strings.Cut(other, ".")
+		_, signature, _ := strings.Cut(token, ".")
+
+		if _, _, ok := store.load(payload + "." + signature); ok {
+			t.Log("the values of admin with the signature of alice should be refused")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a session too large for a cookie", func(t *testing.T) {
+		store := newCookieSessionStore([]signingKey{oldKey})
+
+		if _, err := store.save("", map[string]string{"big": strings.Repeat("a", 5000)}, time.Now().Add(time.Hour)); err != errSessionTooLarge {
+			t.Logf("the session should be too large, got %v", err)
+			t.Fail()
+		}
+	})
+}
+
+func TestCsrf(t *testing.T) {
+	addr := listen(t, testServer(t, sessionRoutes(newMemorySessionStore(defaultMaxSessions))), nil)
+	base := "http://" + addr
+
+	client := sessionClient(t)
+	res, body := sessionGet(t, client, base+"/"+csrfRoute)
+
+	var given struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(body), &given); err != nil || given.Token == "" || res.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("the session should be given a token that is not cached, got %q %v", body, res.Header)
+	}
+	token := given.Token
+
+	if _, again := sessionGet(t, client, base+"/"+csrfRoute); again != body {
+		t.Logf("the session should keep its token, got %q then %q", body, again)
+		t.Fail()
+	}
+
+	post := func(t *testing.T, client *http.Client, contentType string, body string, header string) int {
+		req, _ := http.NewRequest("POST", base+"/transfer", strings.NewReader(body))
+		// the server answers one request per connection, a POST is not retried on a closed one
+		req.Close = true
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if header != "" {
+			req.Header.Set(csrfHeader, header)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("Should accept the token in the header", func(t *testing.T) {
+		if status := post(t, client, "", "", token); status != 200 {
+			t.Logf("the request with the token should go through, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should accept the token in the form", func(t *testing.T) {
+		if status := post(t, client, "application/x-www-form-urlencoded", "amount=10&csrf_token="+url.QueryEscape(token), ""); status != 200 {
+			t.Logf("the form with the token should go through, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a missing or wrong token", func(t *testing.T) {
+		if status := post(t, client, "application/x-www-form-urlencoded", "amount=10", ""); status != 403 {
+			t.Logf("the request without token should be refused, got %d", status)
+			t.Fail()
+		}
+
+		if status := post(t, client, "", "", token+"x"); status != 403 {
+			t.Logf("the request with a wrong token should be refused, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse the token of another session", func(t *testing.T) {
+		if status := post(t, sessionClient(t), "", "", token); status != 403 {
+			t.Logf("the token should only be valid for its session, got %d", status)
+			t.Fail()
+		}
+	})
+}
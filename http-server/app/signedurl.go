@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signedURLRoute = "files/{filename}/signed-url"
+
+	defaultSignedURLTTL    = time.Hour
+	defaultSignedURLMaxTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errSignatureExpired = errors.New("the url has expired")
+	errSignatureInvalid = errors.New("the url signature is not valid")
+)
+
+// signingKey is one of the keys of the signer, its id goes in the url so the key checking it is
+// found without trying them all
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// urlSigner signs the file urls with its first key and checks them with any of its keys. To
+// rotate the key a new one is put first and the previous one is kept until its urls have expired
+type urlSigner struct {
+	keys   []signingKey
+	ttl    time.Duration
+	maxTTL time.Duration
+	now    func() time.Time
+}
+
+func newURLSigner(keys []signingKey, ttl time.Duration, maxTTL time.Duration) *urlSigner {
+	return &urlSigner{keys: keys, ttl: ttl, maxTTL: maxTTL, now: time.Now}
+}
+
+// sign gives the query allowing to download the path until the expiry
+func (u *urlSigner) sign(path string, expires time.Time) string {
+	key := u.keys[0]
+	ts := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("expires", ts)
+	q.Set("kid", key.id)
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(urlSignature(key.secret, path, ts)))
+	return q.Encode()
+}
+
+// verify checks the signature of the query is the one of the path and that it has not expired,
+// the id of the key that signed it is given back
+func (u *urlSigner) verify(path string, query url.Values) (string, error) {
+	var key *signingKey
+	for i := range u.keys {
+		if u.keys[i].id == query.Get("kid") {
+			key = &u.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return "", errSignatureInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(signature, urlSignature(key.secret, path, query.Get("expires"))) {
+		return "", errSignatureInvalid
+	}
+
+	// the expiry is signed, it is only trusted once the signature is checked
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", errSignatureInvalid
+	}
+	if !u.now().Before(time.Unix(expires, 0)) {
+		return "", errSignatureExpired
+	}
+
+	return key.id, nil
+}
+
+func urlSignature(secret []byte, path string, expires string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + expires))
+	return mac.Sum(nil)
+}
+
+// signedURL mints the url of the file of the route, valid for the ttl query parameter or the
+// default ttl of the signer. The server refuses to start when the route is not behind an
+// authentication, like the one of the files route it is below
+func (s *server) signedURL(signer *urlSigner) func(props *reqProps, conn net.Conn) {
+	return func(props *reqProps, conn net.Conn) {
+		filename := props.request.params[0]
+		if filename == "" || filename == "." || filename == ".." {
+			s.writeResponse(400, map[string]string{"Content-Length": "0"}, "", conn)
+			return
+		}
+
+		ttl := signer.ttl
+		if raw := queryValue(props, "ttl"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed <= 0 || parsed > signer.maxTTL {
+				body := "ttl should be a duration up to " + signer.maxTTL.String()
+				s.writeResponse(400, map[string]string{"Content-Type": "text/plain", "Content-Length": strconv.Itoa(len(body))}, body, conn)
+				return
+			}
+			ttl = parsed
+		}
+
+		path := "/files/" + filename
+		body := requestScheme(conn) + "://" + props.header("Host") + path + "?" + signer.sign(path, signer.now().Add(ttl))
+		var headers = map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": strconv.Itoa(len(body)),
+			"Cache-Control":  "no-store",
+		}
+		s.writeResponse(200, headers, body, conn)
+	}
+}
+
+// signedFiles checks the signature of the file urls carrying one, a valid one lets the download
+// through without further authentication and a tampered or expired one is answered 403. Requests
+// without a signature are left to the middlewares after it
+func (s *server) signedFiles(signer *urlSigner) middleware {
+	return func(next handlerFunc) handlerFunc {
+		return func(props *reqProps, conn net.Conn) {
+			query, err := url.ParseQuery(props.request.query)
+			if err == nil && !query.Has("signature") && !query.Has("expires") && !query.Has("kid") {
+				next(props, conn)
+				return
+			}
+
+			if err != nil || (props.method != "GET" && props.method != "HEAD") {
+				s.writeResponse(403, map[string]string{"Content-Length": "0"}, "", conn)
+				return
+			}
+
+			kid, err := signer.verify("/"+props.request.path, query)
+			if err != nil {
+				body := err.Error()
+				s.writeResponse(403, map[string]string{"Content-Type": "text/plain", "Content-Length": strconv.Itoa(len(body))}, body, conn)
+				return
+			}
+
+			props.principal = "signed-url:" + kid
+			next(props, conn)
+		}
+	}
+}
+
+// queryValue gives the first value of the query parameter, empty when it is missing
+func queryValue(props *reqProps, name string) string {
+	values, err := url.ParseQuery(props.request.query)
+	if err != nil {
+		return ""
+	}
+	return values.Get(name)
+}
+
+// parseSigningKeys reads the id:secret values of the -url-signing-key flag, the first one signs
+func parseSigningKeys(values []string) ([]signingKey, error) {
+	keys := make([]signingKey, 0, len(values))
+	seen := make(map[string]bool, len(values))
+
+	for _, v := range values {
+		id, secret, found := strings.Cut(v, ":")
+		if !found || id == "" || len(secret) < 16 {
+			return nil, fmt.Errorf("signing key %s should be written id:secret with a secret of at least 16 bytes", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("signing key %s is given twice", id)
+		}
+		seen[id] = true
+
+		keys = append(keys, signingKey{id: id, secret: []byte(secret)})
+	}
+
+	return keys, nil
+}
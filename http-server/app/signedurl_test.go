@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fetch(t *testing.T, method string, rawURL string, withCredentials bool) (int, string) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withCredentials {
+		req.SetBasicAuth("alice", "secret")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	return res.StatusCode, string(body)
+}
+
+func TestSignedURLs(t *testing.T) {
+	signer := newURLSigner([]signingKey{{id: "k2", secret: []byte("a new secret of 32 bytes or so..")}}, time.Hour, 24*time.Hour)
+	addr := listen(t, testServer(t, func(s *server) error {
+		s.directory = t.TempDir()
+
+		if err := os.WriteFile(filepath.Join(s.directory, "report.txt"), []byte("quarterly numbers"), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(s.directory, "secret.txt"), []byte("not shared"), 0644); err != nil {
+			return err
+		}
+
+		if err := s.registerFileRoutes(); err != nil {
+			return err
+		}
+		if err := s.registerMethodHandler("POST", signedURLRoute, s.signedURL(signer)); err != nil {
+			return err
+		}
+
+		basic := &basicAuth{realm: "files", hashes: map[string]string{"alice": "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"}}
+		s.useOn(filesRoute, s.signedFiles(signer))
+		s.protect(filesRoute, basic)
+
+		return nil
+	}), nil)
+
+	status, signed := fetch(t, "POST", "http://"+addr+"/files/report.txt/signed-url?ttl=10m", true)
+	if status != 200 || !strings.HasPrefix(signed, "http://"+addr+"/files/report.txt?") {
+		t.Fatalf("the url should be minted, got %d %q", status, signed)
+	}
+
+	t.Run("Should download the file of a signed url without credentials", func(t *testing.T) {
+		if status, body := fetch(t, "GET", signed, false); status != 200 || body != "quarterly numbers" {
+			t.Logf("the signed url should give the file, got %d %q", status, body)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should keep asking for credentials without a signature", func(t *testing.T) {
+		if status, _ := fetch(t, "GET", "http://"+addr+"/files/report.txt", false); status != 401 {
+			t.Logf("an unsigned download should need credentials, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should not mint urls without credentials", func(t *testing.T) {
+		if status, _ := fetch(t, "POST", "http://"+addr+"/files/report.txt/signed-url", false); status != 401 {
+			t.Logf("minting should need credentials, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should put the minting route behind the authentication of the files", func(t *testing.T) {
+		s := testServer(t, func(s *server) error {
+			if err := s.registerFileRoutes(); err != nil {
+				return err
+			}
+			return s.registerMethodHandler("POST", signedURLRoute, s.signedURL(signer))
+		})
+
+		if s.nodeFor(signedURLRoute).protected() {
+			t.Log("the minting route should not be protected before the files are")
+			t.Fail()
+		}
+
+		s.protect(filesRoute, &basicAuth{realm: "files"})
+		if !s.nodeFor(signedURLRoute).protected() {
+			t.Log("the minting route should be protected with the files")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a ttl over the maximum", func(t *testing.T) {
+		if status, _ := fetch(t, "POST", "http://"+addr+"/files/report.txt/signed-url?ttl=48h", true); status != 400 {
+			t.Logf("a ttl of two days should be refused, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should frame the refusal of a file name that can not be signed", func(t *testing.T) {
+		credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		res := slowClient(t, addr, 0, "POST /files/../signed-url HTTP/1.1\r\nHost: localhost\r\nAuthorization: Basic "+credentials+"\r\n\r\n")
+
+		if !strings.HasPrefix(res, "HTTP/1.1 400") || !strings.Contains(res, "Content-Length:0\r\n") {
+			t.Logf("the refusal should be a 400 with an empty body, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 403 to a tampered url", func(t *testing.T) {
+		u, _ := url.Parse(signed)
+		q := u.Query()
+
+		otherFile := *u
+		otherFile.Path = "/files/secret.txt"
+
+		later := *u
+		lq := u.Query()
+		lq.Set("expires", "99999999999")
+		later.RawQuery = lq.Encode()
+
+		otherKey := *u
+		kq := u.Query()
+		kq.Set("kid", "k1")
+		otherKey.RawQuery = kq.Encode()
+
+		truncated := *u
+		tq := u.Query()
+		tq.Set("signature", q.Get("signature")[1:])
+		truncated.RawQuery = tq.Encode()
+
+		for name, tampered := range map[string]url.URL{"another file": otherFile, "a later expiry": later, "another key": otherKey, "a cut signature": truncated} {
+			if status, _ := fetch(t, "GET", tampered.String(), false); status != 403 {
+				t.Logf("the url with %s should be answered 403, got %d", name, status)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should answer 403 to a signed url used to write the file", func(t *testing.T) {
+		if status, _ := fetch(t, "DELETE", signed, false); status != 403 {
+			t.Logf("a signed url should only allow downloads, got %d", status)
+			t.Fail()
+		}
+	})
+}
+
+func TestURLSigner(t *testing.T) {
+	oldKey := signingKey{id: "k1", secret: []byte("the previous secret of the files")}
+	newKey := signingKey{id: "k2", secret: []byte("a new secret of 32 bytes or so..")}
+
+	now := time.Now()
+	before := newURLSigner([]signingKey{oldKey}, time.Hour, 24*time.Hour)
+	after := newURLSigner([]signingKey{newKey, oldKey}, time.Hour, 24*time.Hour)
+	before.now = func() time.Time { return now }
+	after.now = func() time.Time { return now }
+
+	t.Run("Should still accept the urls of a rotated key", func(t *testing.T) {
+		q, _ := url.ParseQuery(before.sign("/files/a.txt", now.Add(time.Minute)))
+
+		if kid, err := after.verify("/files/a.txt", q); err != nil || kid != "k1" {
+			t.Logf("the url of the previous key should be valid, got %q %v", kid, err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should sign with the first key", func(t *testing.T) {
+		q, _ := url.ParseQuery(after.sign("/files/a.txt", now.Add(time.Minute)))
+
+		if q.Get("kid") != "k2" {
+			t.Logf("the url should be signed by k2, got %q", q.Get("kid"))
+			t.Fail()
+		}
+
+		if _, err := before.verify("/files/a.txt", q); err != errSignatureInvalid {
+			t.Logf("a signer without the new key should refuse it, got %v", err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse an expired url", func(t *testing.T) {
+		q, _ := url.ParseQuery(after.sign("/files/a.txt", now.Add(-time.Second)))
+
+		if _, err := after.verify("/files/a.txt", q); err != errSignatureExpired {
+			t.Logf("the url should have expired, got %v", err)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse a signature made with the right id and a wrong secret", func(t *testing.T) {
+		q, _ := url.ParseQuery(after.sign("/files/a.txt", now.Add(time.Minute)))
+		q.Set("signature", base64.RawURLEncoding.EncodeToString(urlSignature([]byte("guessed"), "/files/a.txt", q.Get("expires"))))
+
+		if _, err := after.verify("/files/a.txt", q); err != errSignatureInvalid {
+			t.Logf("the forged signature should be refused, got %v", err)
+			t.Fail()
+		}
+	})
+}
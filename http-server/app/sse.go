@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSSEHeartbeat = 15 * time.Second
+
+var errEventStreamClosed = errors.New("the event stream is closed")
+
+// sseEvent is one event of a text/event-stream, empty fields are left out. An event without data
+// only moves the last event id of the client or changes its retry delay
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+	retry time.Duration
+}
+
+// sseStream is an open text/event-stream response, events can be sent from any goroutine until the
+// client goes away or the handler returns
+type sseStream struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	lastEventID  string
+	mu           sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// serveEvents answers the request with an event stream kept open while handle runs. The client is
+// sent a comment every heartbeat so proxies keep the connection and a gone client is noticed, zero
+// disables it
+func (s *server) serveEvents(props *reqProps, conn net.Conn, heartbeat time.Duration, handle func(stream *sseStream)) {
+	headers := map[string]string{
+		"Content-Type":  "text/event-stream",
+		"Cache-Control": "no-cache",
+	}
+
+	if err := s.writeHead(200, headers, conn); err != nil {
+		fmt.Println("Error sending response in connection: ", err.Error())
+		return
+	}
+
+	stream := &sseStream{
+		conn:         conn,
+		writeTimeout: s.timeouts.write,
+		lastEventID:  props.header("Last-Event-ID"),
+		done:         make(chan struct{}),
+	}
+
+	// http/2 streams are reset by the client instead, the writes fail then
+	if !framedConn(conn) {
+		go stream.watchClient()
+	}
+
+	if heartbeat > 0 {
+		go stream.keepAlive(heartbeat)
+	}
+
+	handle(stream)
+	stream.close()
+}
+
+// send writes the event and pushes it to the client right away
+func (st *sseStream) send(e sseEvent) error {
+	var b strings.Builder
+
+	if e.id != "" {
+		b.WriteString("id: " + sseField(e.id) + "\n")
+	}
+	if e.event != "" {
+		b.WriteString("event: " + sseField(e.event) + "\n")
+	}
+	if e.retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.retry.Milliseconds())
+	}
+	if e.data != "" {
+		data := strings.ReplaceAll(e.data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+
+		// every line of the data needs its own field, the client joins them back with newlines
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+
+	return st.write(b.String())
+}
+
+// closed gives a channel closed once the client went away or the stream was closed
+func (st *sseStream) closed() <-chan struct{} {
+	return st.done
+}
+
+// close stops the stream, nothing can be sent afterwards. It waits for a write in progress so the
+// response can be ended safely once it returns
+func (st *sseStream) close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.markClosed()
+}
+
+func (st *sseStream) markClosed() {
+	st.closeOnce.Do(func() {
+		close(st.done)
+	})
+}
+
+func (st *sseStream) write(text string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	select {
+	case <-st.done:
+		return errEventStreamClosed
+	default:
+	}
+
+	// the stream lasts longer than a response is given to be written, each write gets the timeout
+	st.conn.SetWriteDeadline(deadline(st.writeTimeout))
+
+	_, err := io.WriteString(st.conn, text)
+	if err == nil {
+		if rc, ok := st.conn.(*responseConn); ok {
+			err = rc.flush()
+		}
+	}
+
+	// a failed write means the client is gone
+	if err != nil {
+		st.markClosed()
+	}
+
+	return err
+}
+
+func (st *sseStream) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.done:
+			return
+		case <-ticker.C:
+			if st.write(": heartbeat\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchClient reads the connection until it fails, a client of an event stream sends nothing more
+// so the read only ends when it disconnects
+func (st *sseStream) watchClient() {
+	buffer := make([]byte, 512)
+
+	for {
+		if _, err := st.conn.Read(buffer); err != nil {
+			st.close()
+			return
+		}
+	}
+}
+
+// framedConn tells if the responses on the connection are framed by the protocol, like on http/2
+// streams, instead of being written as http/1.1 text
+func framedConn(conn net.Conn) bool {
+	if rc, ok := conn.(*responseConn); ok {
+		conn = rc.Conn
+	}
+
+	_, framed := conn.(headWriter)
+	return framed
+}
+
+// sseField removes the line breaks that would end the field early
+func sseField(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "", "\x00", "").Replace(value)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent gives the lines of the next event of the stream, without the blank line ending it
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	s := &server{paths: create()}
+	gone := make(chan struct{}, 1)
+
+	s.registerHandler("", func(props *reqProps, conn net.Conn) {
+		s.writeResponse(200, map[string]string{}, "", conn)
+	})
+	err := s.registerHandler("stream", func(props *reqProps, conn net.Conn) {
+		s.serveEvents(props, conn, 50*time.Millisecond, func(stream *sseStream) {
+			stream.send(sseEvent{id: stream.lastEventID + "1", event: "update", data: "first\nsecond", retry: 3 * time.Second})
+
+			<-stream.closed()
+			gone <- struct{}{}
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listen(t, s, nil)
+
+	t.Run("Should stream events resuming from the last event id", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 4\r\n\r\n"))
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Logf("There should be no error: %s", err.Error())
+			t.FailNow()
+		}
+
+		if res.Header.Get("Content-Type") != "text/event-stream" || res.Header.Get("Cache-Control") != "no-cache" {
+			t.Logf("Headers should be the ones of an event stream, got %v", res.Header)
+			t.Fail()
+		}
+
+		r := bufio.NewReader(res.Body)
+		event := strings.Join(readEvent(t, r), "|")
+		expected := "id: 41|event: update|retry: 3000|data: first|data: second"
+
+		if event != expected {
+			t.Logf("Event should be %q, was %q", expected, event)
+			t.Fail()
+		}
+
+		heartbeat := readEvent(t, r)
+		if len(heartbeat) != 1 || heartbeat[0] != ": heartbeat" {
+			t.Logf("A heartbeat comment should follow, got %q", heartbeat)
+			t.Fail()
+		}
+
+		conn.Close()
+		<-gone
+	})
+
+	t.Run("Should notice the client going away", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		readEvent(t, bufio.NewReader(conn))
+		conn.Close()
+
+		select {
+		case <-gone:
+		case <-time.After(2 * time.Second):
+			t.Log("The handler should have been told the client is gone")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should keep line breaks out of the fields", func(t *testing.T) {
+		if sseField("a\r\nb\x00") != "ab" {
+			t.Log("Line breaks should be removed")
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	defaultIdleTimeout   = 60 * time.Second
+	defaultHeaderTimeout = 10 * time.Second
+	defaultBodyTimeout   = 30 * time.Second
+	defaultWriteTimeout  = 30 * time.Second
+)
+
+var errRequestTimeout = errors.New("the client was too slow sending the request")
+
+// timeouts bound how long a client can keep a connection busy, a zero duration disables the timeout.
+// The header timeout counts from the first byte of the request so a client sending its head a byte
+// at a time is cut off all the same
+type timeouts struct {
+	idle   time.Duration
+	header time.Duration
+	body   time.Duration
+	write  time.Duration
+}
+
+// deadline gives the deadline of a timeout starting now, the zero time when it is disabled
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowClient connects and sends the parts of the request waiting pause between them, it gives what
+// the server answered before closing the connection
+func slowClient(t *testing.T, addr string, pause time.Duration, parts ...string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		for _, part := range parts {
+			if _, err := conn.Write([]byte(part)); err != nil {
+				return
+			}
+			time.Sleep(pause)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := io.ReadAll(conn)
+	if err != nil && !strings.Contains(err.Error(), "reset") {
+		t.Logf("The server should have closed the connection: %s", err.Error())
+		t.FailNow()
+	}
+
+	return string(res)
+}
+
+func TestTimeouts(t *testing.T) {
+
+	serve := func(t *testing.T, to timeouts) (*server, string) {
+		s := routesServer(t)
+		s.timeouts = to
+
+		return s, listen(t, s, nil)
+	}
+
+	t.Run("Should close idle connections without an answer", func(t *testing.T) {
+		_, addr := serve(t, timeouts{idle: 50 * time.Millisecond})
+
+		if res := slowClient(t, addr, 0); res != "" {
+			t.Logf("Nothing should be answered, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 408 to a client sending its head too slowly", func(t *testing.T) {
+		_, addr := serve(t, timeouts{idle: time.Second, header: 200 * time.Millisecond})
+
+		// every byte comes in time for a read timeout, the whole head does not
+		head := "GET /echo/slow HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		res := slowClient(t, addr, 30*time.Millisecond, strings.Split(head, "")...)
+
+		if !strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout") {
+			t.Logf("Should answer 408, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 408 to a body that does not come", func(t *testing.T) {
+		_, addr := serve(t, timeouts{body: 100 * time.Millisecond})
+
+		res := slowClient(t, addr, time.Second, "POST /files/slow HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+
+		if !strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout") {
+			t.Logf("Should answer 408, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should serve clients in time", func(t *testing.T) {
+		_, addr := serve(t, timeouts{idle: time.Second, header: time.Second, body: time.Second, write: time.Second})
+
+		res := slowClient(t, addr, 10*time.Millisecond, "GET /echo/", "fast HTTP/1.1\r\n", "Host: localhost\r\n\r\n")
+
+		if !strings.HasPrefix(res, "HTTP/1.1 200 OK") || !strings.HasSuffix(res, "fast") {
+			t.Logf("Should answer the request, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should stop writing to a client that does not read", func(t *testing.T) {
+		s, addr := serve(t, timeouts{write: 100 * time.Millisecond})
+		failed := make(chan error, 1)
+
+		s.registerHandler("flood", func(props *reqProps, conn net.Conn) {
+			s.writeHead(200, map[string]string{}, conn)
+
+			chunk := make([]byte, 64*1024)
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					failed <- err
+					return
+				}
+			}
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET /flood HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+		select {
+		case err := <-failed:
+			if !isTimeout(err) {
+				t.Logf("Write should have timed out, got %s", err.Error())
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("The handler should not be stuck writing")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should keep extending the deadline of event streams", func(t *testing.T) {
+		s, addr := serve(t, timeouts{write: 50 * time.Millisecond})
+
+		s.registerHandler("ticks", func(props *reqProps, conn net.Conn) {
+			s.serveEvents(props, conn, 0, func(stream *sseStream) {
+				for i := 0; i < 3; i++ {
+					time.Sleep(40 * time.Millisecond)
+					stream.send(sseEvent{data: "tick"})
+				}
+			})
+		})
+
+		res := slowClient(t, addr, 0, "GET /ticks HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+		if strings.Count(res, "data: tick") != 3 {
+			t.Logf("Every event should be sent past the write timeout, got %q", res)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should broadcast websocket messages past the write timeout", func(t *testing.T) {
+		_, addr := serve(t, timeouts{write: 50 * time.Millisecond})
+
+		c := dialWebSocket(t, addr, "ws/late")
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// the deadline set when the connection was upgraded is long gone
+		time.Sleep(150 * time.Millisecond)
+		c.send(true, wsText, []byte("still here"), true)
+
+		if op, payload := c.read(t); op != wsText || string(payload) != "still here" {
+			t.Logf("The message should be broadcast, got %d %q", op, payload)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should send GOAWAY on idle http2 connections", func(t *testing.T) {
+		_, addr := serve(t, timeouts{idle: 100 * time.Millisecond})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(http2Preface))
+		conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		r := bufio.NewReader(conn)
+		for {
+			f, err := readHTTP2Frame(r, http2MaxFrameSize)
+			if err != nil {
+				t.Logf("There should be a GOAWAY before the connection ends: %s", err.Error())
+				t.FailNow()
+			}
+			if f.typ == frameGoAway {
+				break
+			}
+		}
+	})
+
+	t.Run("Should answer 408 to http2 streams whose request does not come", func(t *testing.T) {
+		_, addr := serve(t, timeouts{header: 100 * time.Millisecond, body: 100 * time.Millisecond})
+
+		post := encodeHeaders([]headerField{
+			{name: ":method", value: "POST"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/echo/slow"},
+			{name: ":authority", value: "localhost"},
+		})
+
+		// the body of the first request never ends and the headers of the second one never do
+		for _, frame := range [][]byte{
+			appendHTTP2Frame(nil, frameHeaders, flagEndHeaders, 1, post),
+			appendHTTP2Frame(nil, frameHeaders, 0, 1, post),
+		} {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte(http2Preface))
+			conn.Write(appendHTTP2Frame(nil, frameSettings, 0, 0, nil))
+			conn.Write(frame)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			// the connection ends once the stream was answered
+			r := bufio.NewReader(conn)
+			var status string
+			goAway := false
+			for {
+				f, err := readHTTP2Frame(r, http2MaxFrameSize)
+				if err != nil {
+					break
+				}
+				if f.typ == frameHeaders && f.streamID == 1 {
+					fields, _ := newHpackDecoder(4096, 0).decode(f.payload)
+					status = fields[0].value
+				}
+				goAway = goAway || f.typ == frameGoAway
+			}
+
+			if status != "408" || !goAway {
+				t.Logf("the stream should be answered 408 and the connection sent away, got %q %v", status, goAway)
+				t.Fail()
+			}
+		}
+	})
+}
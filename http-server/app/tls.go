@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type tlsOptions struct {
+	// certificates are pairs of certificate and key files, the first one is used when no SNI matches
+	certificates []certificatePair
+	minVersion   string
+	ciphers      []string
+	alpn         []string
+	// devCertDir makes a self signed certificate in the directory on the first start when set
+	devCertDir string
+	devHosts   []string
+}
+
+type certificatePair struct {
+	certFile string
+	keyFile  string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig loads the certificates and turns the options into a tls config for the listener
+func buildTLSConfig(opts tlsOptions) (*tls.Config, error) {
+	pairs := opts.certificates
+
+	if opts.devCertDir != "" {
+		pair, err := ensureDevCertificate(opts.devCertDir, opts.devHosts)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if len(pairs) == 0 {
+		return nil, errors.New("tls needs at least one certificate")
+	}
+
+	store := &certStore{byName: make(map[string]*tls.Certificate)}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate %s: %w", pair.certFile, err)
+		}
+		store.add(&cert)
+	}
+
+	config := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     opts.alpn,
+	}
+
+	if opts.minVersion != "" {
+		version, ok := tlsVersions[opts.minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %s", opts.minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(opts.ciphers) > 0 {
+		suites, err := cipherSuites(opts.ciphers)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+
+	return config, nil
+}
+
+// cipherSuites finds the suites by their standard name, only tls 1.2 suites can be configured
+func cipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// certStore picks the certificate for the server name the client asked for with SNI
+type certStore struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func (c *certStore) add(cert *tls.Certificate) {
+	if c.fallback == nil {
+		c.fallback = cert
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	cert.Leaf = leaf
+
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := c.byName[name]; !ok {
+			c.byName[name] = cert
+		}
+	}
+}
+
+// getCertificate looks for the exact name, then a wildcard for its parent domain and then falls back
+// to the first certificate loaded
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, found := strings.Cut(name, "."); found {
+		if cert, ok := c.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	return c.fallback, nil
+}
+
+// ensureDevCertificate makes a self signed certificate for the hosts unless the directory has one already
+func ensureDevCertificate(dir string, hosts []string) (certificatePair, error) {
+	pair := certificatePair{
+		certFile: filepath.Join(dir, "dev-cert.pem"),
+		keyFile:  filepath.Join(dir, "dev-key.pem"),
+	}
+
+	_, certErr := os.Stat(pair.certFile)
+	_, keyErr := os.Stat(pair.keyFile)
+	if certErr == nil && keyErr == nil {
+		return pair, nil
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return pair, err
+	}
+
+	certPEM, keyPEM, err := selfSignedCertificate(hosts, time.Now())
+	if err != nil {
+		return pair, err
+	}
+
+	if err = os.WriteFile(pair.keyFile, keyPEM, 0600); err != nil {
+		return pair, err
+	}
+
+	fmt.Println("Generated a self signed certificate for development in ", pair.certFile)
+
+	return pair, os.WriteFile(pair.certFile, certPEM, 0644)
+}
+
+func selfSignedCertificate(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http-server development"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// parseCertificatePairs reads the cert.pem:key.pem values of the flag
+func parseCertificatePairs(values []string) ([]certificatePair, error) {
+	pairs := make([]certificatePair, 0, len(values))
+
+	for _, v := range values {
+		certFile, keyFile, found := strings.Cut(v, ":")
+		if !found || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("certificate %s should be in the format cert.pem:key.pem", v)
+		}
+		pairs = append(pairs, certificatePair{certFile: certFile, keyFile: keyFile})
+	}
+
+	return pairs, nil
+}
+
+// listFlag is a flag that can be given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// splitList splits a comma separated flag value, an empty value gives no elements
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return parts
+}
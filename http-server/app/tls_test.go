@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCertificate(t *testing.T, dir string, name string, hosts ...string) certificatePair {
+	certPEM, keyPEM, err := selfSignedCertificate(hosts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := certificatePair{
+		certFile: filepath.Join(dir, name+"-cert.pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	os.WriteFile(pair.certFile, certPEM, 0644)
+	os.WriteFile(pair.keyFile, keyPEM, 0600)
+
+	return pair
+}
+
+func TestTLS(t *testing.T) {
+
+	serve := func(t *testing.T, config *tls.Config) string {
+		return listen(t, testServer(t, func(s *server) error {
+			return s.registerHandler("", func(props *reqProps, conn net.Conn) {
+				s.writeResponse(200, map[string]string{"Content-Length": "2"}, "ok", conn)
+			})
+		}), config)
+	}
+
+	t.Run("Should generate a development certificate only once", func(t *testing.T) {
+		dir := t.TempDir()
+
+		pair, err := ensureDevCertificate(dir, nil)
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+		first, _ := os.ReadFile(pair.certFile)
+
+		ensureDevCertificate(dir, nil)
+		second, _ := os.ReadFile(pair.certFile)
+
+		if len(first) == 0 || string(first) != string(second) {
+			t.Log("The certificate should be kept between starts")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should serve https and pick the certificate with SNI", func(t *testing.T) {
+		dir := t.TempDir()
+
+		config, err := buildTLSConfig(tlsOptions{
+			certificates: []certificatePair{
+				writeCertificate(t, dir, "default", "default.test"),
+				writeCertificate(t, dir, "wildcard", "*.example.test"),
+			},
+			minVersion: "1.2",
+			alpn:       []string{"http/1.1"},
+		})
+		if err != nil {
+			t.Log("There should be no error")
+			t.FailNow()
+		}
+
+		addr := serve(t, config)
+
+		cases := map[string]string{
+			"api.example.test": "*.example.test",
+			"other.test":       "default.test",
+		}
+
+		for serverName, expected := range cases {
+			conn, dialErr := tls.Dial("tcp", addr, &tls.Config{
+				ServerName:         serverName,
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"http/1.1"},
+			})
+			if dialErr != nil {
+				t.Logf("There should be no error dialing: %s", dialErr.Error())
+				t.FailNow()
+			}
+
+			state := conn.ConnectionState()
+			if state.PeerCertificates[0].DNSNames[0] != expected {
+				t.Logf("Certificate for %s should be %s, was %s", serverName, expected, state.PeerCertificates[0].DNSNames[0])
+				t.Fail()
+			}
+
+			if state.NegotiatedProtocol != "http/1.1" {
+				t.Log("ALPN should have negotiated http/1.1")
+				t.Fail()
+			}
+
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + serverName + "\r\n\r\n"))
+			res, _ := io.ReadAll(conn)
+			conn.Close()
+
+			if !strings.HasPrefix(string(res), "HTTP/1.1 200 OK") || !strings.HasSuffix(string(res), "ok") {
+				t.Logf("Response should be a 200 over tls, was %q", res)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse clients below the minimum version", func(t *testing.T) {
+		dir := t.TempDir()
+
+		config, _ := buildTLSConfig(tlsOptions{
+			certificates: []certificatePair{writeCertificate(t, dir, "default", "localhost")},
+			minVersion:   "1.3",
+		})
+		addr := serve(t, config)
+
+		_, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		})
+
+		if err == nil {
+			t.Log("Handshake should fail below tls 1.3")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse unknown cipher suites and versions", func(t *testing.T) {
+		dir := t.TempDir()
+		pair := writeCertificate(t, dir, "default", "localhost")
+
+		if _, err := buildTLSConfig(tlsOptions{certificates: []certificatePair{pair}, ciphers: []string{"NOPE"}}); err == nil {
+			t.Log("Unknown cipher suite should be an error")
+			t.Fail()
+		}
+
+		if _, err := buildTLSConfig(tlsOptions{certificates: []certificatePair{pair}, minVersion: "2.0"}); err == nil {
+			t.Log("Unknown version should be an error")
+			t.Fail()
+		}
+	})
+}
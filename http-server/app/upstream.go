@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	strategyRoundRobin       = "round-robin"
+	strategyLeastConnections = "least-connections"
+	strategyHash             = "hash"
+
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultMaxFails       = 3
+	defaultFailTimeout    = 30 * time.Second
+
+	// hashReplicas is the number of points of every backend on the hash ring, more points spread
+	// the keys more evenly
+	hashReplicas = 100
+)
+
+// poolConfig describes how a pool picks its backends. The hash strategy sends the requests with the
+// same value of the hash header to the same backend. With a health path every backend is checked
+// each interval, and a backend failing maxFails requests in a row is left out for the fail timeout
+type poolConfig struct {
+	strategy       string
+	hashHeader     string
+	healthPath     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	maxFails       int
+	failTimeout    time.Duration
+}
+
+// backend is one server of a pool, healthy is what the last health check said
+type backend struct {
+	url    *url.URL
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// upstreamPool spreads the requests of a proxy over its backends
+type upstreamPool struct {
+	name     string
+	cfg      poolConfig
+	backends []*backend
+	ring     []ringPoint
+	next     atomic.Uint64
+	now      func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newUpstreamPool(name string, urls []*url.URL, cfg poolConfig) *upstreamPool {
+	if cfg.strategy == "" {
+		cfg.strategy = strategyRoundRobin
+	}
+	if cfg.healthInterval <= 0 {
+		cfg.healthInterval = defaultHealthInterval
+	}
+	if cfg.healthTimeout <= 0 {
+		cfg.healthTimeout = defaultHealthTimeout
+	}
+	if cfg.maxFails <= 0 {
+		cfg.maxFails = defaultMaxFails
+	}
+	if cfg.failTimeout <= 0 {
+		cfg.failTimeout = defaultFailTimeout
+	}
+
+	p := &upstreamPool{
+		name: name,
+		cfg:  cfg,
+		now:  time.Now,
+		stop: make(chan struct{}),
+	}
+
+	for _, u := range urls {
+		b := &backend{url: u, healthy: true}
+		p.backends = append(p.backends, b)
+
+		for i := 0; i < hashReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hash: crc32.ChecksumIEEE([]byte(u.String() + "#" + strconv.Itoa(i))), backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+
+	return p
+}
+
+// available tells if the backend can take requests, healthy and not ejected
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// pick chooses the backend answering the request, nil when none is available. The backend counts
+// the request as active until it is released
+func (p *upstreamPool) pick(props *reqProps) *backend {
+	now := p.now()
+
+	available := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.available(now) {
+			available = append(available, b)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	var picked *backend
+
+	switch p.cfg.strategy {
+	case strategyLeastConnections:
+		// starting from a different backend each time spreads the requests among the ties
+		start := int(p.next.Add(1) - 1)
+		for i := range available {
+			b := available[(start+i)%len(available)]
+			if picked == nil || b.active.Load() < picked.active.Load() {
+				picked = b
+			}
+		}
+	case strategyHash:
+		if key := props.header(p.cfg.hashHeader); key != "" {
+			picked = p.ringBackend(key, now)
+		}
+	}
+
+	if picked == nil {
+		picked = available[int((p.next.Add(1)-1)%uint64(len(available)))]
+	}
+
+	picked.active.Add(1)
+	return picked
+}
+
+// ringBackend walks the ring from the hash of the key to the first available backend, when a
+// backend goes away only its keys move to another one
+func (p *upstreamPool) ringBackend(key string, now time.Time) *backend {
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+
+	for i := range p.ring {
+		b := p.ring[(start+i)%len(p.ring)].backend
+		if b.available(now) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// release ends a request of the backend, a failed one counts toward the ejection of the backend
+// and a successful one clears the count
+func (p *upstreamPool) release(b *backend, failed bool) {
+	b.active.Add(-1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= p.cfg.maxFails {
+		fmt.Println("Ejecting the upstream ", b.url.String(), " of the pool ", p.name)
+		b.failures = 0
+		b.ejectedUntil = p.now().Add(p.cfg.failTimeout)
+	}
+}
+
+// checkHealth sends a GET for the health path to every backend each interval until the pool is
+// closed, a backend answering with an error status or not at all takes no requests until it
+// passes a check again
+func (p *upstreamPool) checkHealth() {
+	if p.cfg.healthPath == "" {
+		return
+	}
+
+	client := &http.Client{
+		Timeout: p.cfg.healthTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(p.cfg.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range p.backends {
+			p.checkBackend(client, b)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *upstreamPool) checkBackend(client *http.Client, b *backend) {
+	target := *b.url
+	target.Path = strings.TrimSuffix(b.url.Path, "/") + "/" + strings.TrimPrefix(p.cfg.healthPath, "/")
+	target.RawPath = ""
+
+	healthy := false
+	res, err := client.Get(target.String())
+	if err == nil {
+		healthy = res.StatusCode < 400
+		res.Body.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.healthy != healthy {
+		fmt.Println("Health check of the upstream ", b.url.String(), " of the pool ", p.name, " changed, healthy : ", healthy)
+	}
+	b.healthy = healthy
+}
+
+func (p *upstreamPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// parseUpstreamPools reads the name=strategy:url,url values of the -upstream flag, the strategy is
+// round-robin, least-connections or hash/Header
+func parseUpstreamPools(values []string, cfg poolConfig) (map[string]*upstreamPool, error) {
+	pools := make(map[string]*upstreamPool, len(values))
+
+	for _, v := range values {
+		name, spec, found := strings.Cut(v, "=")
+		strategy, list, hasStrategy := strings.Cut(spec, ":")
+		if !found || !hasStrategy || name == "" {
+			return nil, fmt.Errorf("upstream %s should be written name=strategy:url,url", v)
+		}
+
+		poolCfg := cfg
+		poolCfg.strategy = strategy
+		if header, ok := strings.CutPrefix(strategy, strategyHash+"/"); ok && header != "" {
+			poolCfg.strategy = strategyHash
+			poolCfg.hashHeader = header
+		}
+
+		switch poolCfg.strategy {
+		case strategyRoundRobin, strategyLeastConnections, strategyHash:
+		default:
+			return nil, fmt.Errorf("upstream %s should use round-robin, least-connections or hash/Header", v)
+		}
+		if poolCfg.strategy == strategyHash && poolCfg.hashHeader == "" {
+			return nil, fmt.Errorf("upstream %s should name the header hashed as hash/Header", v)
+		}
+
+		var urls []*url.URL
+		for _, raw := range strings.Split(list, ",") {
+			u, err := parseUpstreamURL(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, fmt.Errorf("upstream %s : %w", v, err)
+			}
+			urls = append(urls, u)
+		}
+
+		pools[name] = newUpstreamPool(name, urls, poolCfg)
+	}
+
+	return pools, nil
+}
+
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s should be an http or https url", raw)
+	}
+
+	return u, nil
+}
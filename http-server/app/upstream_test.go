@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPool(t *testing.T, cfg poolConfig, raw ...string) *upstreamPool {
+	var urls []*url.URL
+	for _, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	p := newUpstreamPool("test", urls, cfg)
+	t.Cleanup(p.close)
+
+	return p
+}
+
+func hashRequest(header string, value string) *reqProps {
+	return &reqProps{headers: map[string]string{header: value}}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	t.Run("Should take the backends in turn with round robin", func(t *testing.T) {
+		p := testPool(t, poolConfig{}, "http://a", "http://b", "http://c")
+
+		counts := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			b := p.pick(&reqProps{})
+			counts[b.url.Host]++
+			p.release(b, false)
+		}
+
+		if counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 2 {
+			t.Logf("every backend should get two requests, got %v", counts)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should pick the backend with the least active requests", func(t *testing.T) {
+		p := testPool(t, poolConfig{strategy: strategyLeastConnections}, "http://a", "http://b")
+
+		first := p.pick(&reqProps{})
+		for i := 0; i < 3; i++ {
+			b := p.pick(&reqProps{})
+			if b == first {
+				t.Log("the busy backend should not be picked while the other one is idle")
+				t.Fail()
+			}
+			p.release(b, false)
+		}
+		p.release(first, false)
+	})
+
+	t.Run("Should send the same key to the same backend", func(t *testing.T) {
+		p := testPool(t, poolConfig{strategy: strategyHash, hashHeader: "X-User"}, "http://a", "http://b", "http://c")
+
+		seen := make(map[string]bool)
+		for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+			first := p.pick(hashRequest("X-User", user))
+			p.release(first, false)
+			seen[first.url.Host] = true
+
+			for i := 0; i < 3; i++ {
+				b := p.pick(hashRequest("X-User", user))
+				p.release(b, false)
+				if b != first {
+					t.Logf("the requests of %s should all go to %s, got %s", user, first.url.Host, b.url.Host)
+					t.Fail()
+				}
+			}
+		}
+
+		if len(seen) < 2 {
+			t.Logf("the keys should be spread over the backends, got %v", seen)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should eject a backend after failures in a row and take it back after the fail timeout", func(t *testing.T) {
+		now := time.Now()
+		p := testPool(t, poolConfig{maxFails: 2, failTimeout: time.Minute}, "http://a", "http://b")
+		p.now = func() time.Time { return now }
+
+		bad := p.backends[0]
+		bad.active.Add(2)
+		p.release(bad, true)
+		p.release(bad, true)
+
+		for i := 0; i < 4; i++ {
+			b := p.pick(&reqProps{})
+			p.release(b, false)
+			if b == bad {
+				t.Log("the ejected backend should not be picked")
+				t.Fail()
+			}
+		}
+
+		now = now.Add(time.Minute)
+		picked := false
+		for i := 0; i < 2; i++ {
+			b := p.pick(&reqProps{})
+			p.release(b, false)
+			picked = picked || b == bad
+		}
+
+		if !picked {
+			t.Log("the backend should take requests again after the fail timeout")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer nil when no backend is available", func(t *testing.T) {
+		p := testPool(t, poolConfig{maxFails: 1}, "http://a")
+
+		b := p.pick(&reqProps{})
+		p.release(b, true)
+
+		if p.pick(&reqProps{}) != nil {
+			t.Log("no backend should be picked when they are all ejected")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should leave out the backends failing their health checks", func(t *testing.T) {
+		var failing atomic.Bool
+		unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && failing.Load() {
+				w.WriteHeader(503)
+			}
+		}))
+		defer unhealthy.Close()
+
+		healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer healthy.Close()
+
+		p := testPool(t, poolConfig{healthPath: "/health", healthInterval: 10 * time.Millisecond}, unhealthy.URL, healthy.URL)
+		failing.Store(true)
+		go p.checkHealth()
+
+		waitFor := func(available bool) bool {
+			for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+				if p.backends[0].available(time.Now()) == available {
+					return true
+				}
+			}
+			return false
+		}
+
+		if !waitFor(false) {
+			t.Log("the backend failing its health check should be left out")
+			t.FailNow()
+		}
+
+		for i := 0; i < 4; i++ {
+			b := p.pick(&reqProps{})
+			p.release(b, false)
+			if b == p.backends[0] {
+				t.Log("the unhealthy backend should not be picked")
+				t.Fail()
+			}
+		}
+
+		failing.Store(false)
+		if !waitFor(true) {
+			t.Log("the backend should be back once it passes its health check")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should spread the proxied requests over the pool", func(t *testing.T) {
+		backend := func(name string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, name)
+			}))
+		}
+		one, two := backend("one"), backend("two")
+		defer one.Close()
+		defer two.Close()
+
+		pool := testPool(t, poolConfig{}, one.URL, two.URL)
+		addr := listen(t, testServer(t, func(s *server) error {
+			return s.registerProxy("api", proxyConfig{pool: pool})
+		}), nil)
+
+		answers := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			res, err := http.Get("http://" + addr + "/api/name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			answers[string(b)]++
+		}
+
+		if answers["one"] != 2 || answers["two"] != 2 {
+			t.Logf("both backends should answer half of the requests, got %v", answers)
+			t.Fail()
+		}
+	})
+}
+
+func TestParseUpstreamPools(t *testing.T) {
+	t.Run("Should read the strategy and the servers of the pools", func(t *testing.T) {
+		pools, err := parseUpstreamPools([]string{
+			"api=least-connections:http://127.0.0.1:8081,http://127.0.0.1:8082",
+			"users=hash/X-User:http://127.0.0.1:9000",
+		}, poolConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if api := pools["api"]; api == nil || api.cfg.strategy != strategyLeastConnections || len(api.backends) != 2 {
+			t.Log("the api pool should have two servers picked by least connections")
+			t.Fail()
+		}
+
+		if users := pools["users"]; users == nil || users.cfg.strategy != strategyHash || users.cfg.hashHeader != "X-User" {
+			t.Log("the users pool should hash the X-User header")
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse unknown strategies and bad urls", func(t *testing.T) {
+		for _, v := range []string{"api=random:http://a", "api=hash:http://a", "api=round-robin:ftp://a", "api"} {
+			if _, err := parseUpstreamPools([]string{v}, poolConfig{}); err == nil {
+				t.Logf("%s should be refused", v)
+				t.Fail()
+			}
+		}
+	})
+}
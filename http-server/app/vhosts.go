@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// virtualHosts holds the route trees of the hosts served apart from the default one, a request for
+// a host that was not registered is served by the default tree
+type virtualHosts struct {
+	exact     map[string]*tree
+	wildcards []wildcardHost
+}
+
+// wildcardHost is a *.example.test host, matching every subdomain of example.test
+type wildcardHost struct {
+	suffix string
+	paths  *tree
+}
+
+// registerHost runs register with the tree of the host in place of the default one, so the routes,
+// middlewares and limits it sets are the ones of that host. The pattern is a host name or a
+// wildcard like *.example.test, a lone * is refused as the default tree already serves every host
+func (s *server) registerHost(pattern string, register func() error) error {
+	pattern = normalizeHost(pattern)
+	if name := strings.TrimPrefix(pattern, "*."); name == "" || strings.Contains(name, "*") || !validHost(name) {
+		return fmt.Errorf("host %s should be a host name or a wildcard like *.example.test", pattern)
+	}
+
+	defaultPaths := s.paths
+	s.paths = s.hostTree(pattern)
+	defer func() {
+		s.paths = defaultPaths
+	}()
+
+	if s.paths.root == nil {
+		s.paths.addRoot("", nil)
+	}
+
+	return register()
+}
+
+// hostTree gives the tree of the host pattern, creating it the first time
+func (s *server) hostTree(pattern string) *tree {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		for _, w := range s.hosts.wildcards {
+			if w.suffix == suffix {
+				return w.paths
+			}
+		}
+
+		t := create()
+		s.hosts.wildcards = append(s.hosts.wildcards, wildcardHost{suffix: suffix, paths: t})
+		// the most precise wildcard is tried first
+		sort.Slice(s.hosts.wildcards, func(i, j int) bool {
+			return len(s.hosts.wildcards[i].suffix) > len(s.hosts.wildcards[j].suffix)
+		})
+		return t
+	}
+
+	if s.hosts.exact == nil {
+		s.hosts.exact = make(map[string]*tree)
+	}
+
+	t, ok := s.hosts.exact[pattern]
+	if !ok {
+		t = create()
+		s.hosts.exact[pattern] = t
+	}
+	return t
+}
+
+// treeFor chooses the tree serving the host, its own one, the one of the most precise wildcard
+// matching it or the default one
+func (s *server) treeFor(host string) *tree {
+	if s.hosts.exact == nil && len(s.hosts.wildcards) == 0 {
+		return s.paths
+	}
+
+	host = normalizeHost(host)
+
+	if t, ok := s.hosts.exact[host]; ok {
+		return t
+	}
+
+	for _, w := range s.hosts.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return w.paths
+		}
+	}
+
+	return s.paths
+}
+
+// normalizeHost drops the port and the trailing dot of the host, names are compared in lower case
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// validHost checks the Host header is a host name or ip with an optional port, RFC 9110 section 7.2
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+
+	name := host
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end == -1 || net.ParseIP(host[1:end]) == nil {
+			return false
+		}
+		name, host = "", host[end+1:]
+		if host != "" && host[0] != ':' {
+			return false
+		}
+	} else if i := strings.LastIndex(host, ":"); i > 0 {
+		name, host = host[:i], host[i:]
+	} else if i == 0 {
+		// a port without a host name
+		return false
+	} else {
+		host = ""
+	}
+
+	// what is left of host is the port with its colon
+	for _, c := range strings.TrimPrefix(host, ":") {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("-._~%!$&'()*+,;=", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseVirtualHosts reads the host=url or host=pool values of the -vhost flag, every request for the
+// host goes to its upstream
+func parseVirtualHosts(values []string, pools map[string]*upstreamPool) (map[string]*upstreamPool, error) {
+	hosts := make(map[string]*upstreamPool, len(values))
+
+	for _, v := range values {
+		pattern, upstream, found := strings.Cut(v, "=")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("virtual host %s should be written host=url or host=pool", v)
+		}
+
+		if pool, ok := pools[upstream]; ok {
+			hosts[pattern] = pool
+			continue
+		}
+
+		u, err := parseUpstreamURL(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("virtual host %s should have an upstream url or pool name : %w", v, err)
+		}
+
+		hosts[pattern] = newUpstreamPool(u.Host, []*url.URL{u}, poolConfig{})
+	}
+
+	return hosts, nil
+}
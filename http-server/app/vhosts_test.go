@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func hostRequest(t *testing.T, addr string, raw string) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, raw)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+
+	return res.StatusCode, string(body)
+}
+
+func TestVirtualHosts(t *testing.T) {
+	addr := listen(t, testServer(t, func(s *server) error {
+		site := func(name string) func(props *reqProps, conn net.Conn) {
+			return func(props *reqProps, conn net.Conn) {
+				s.writeResponse(200, map[string]string{"Content-Length": strconv.Itoa(len(name))}, name, conn)
+			}
+		}
+
+		if err := s.registerHandler("", site("default")); err != nil {
+			return err
+		}
+		if err := s.registerHandler("page", site("default page")); err != nil {
+			return err
+		}
+
+		if err := s.registerHost("Blog.test", func() error {
+			if err := s.registerHandler("", site("blog")); err != nil {
+				return err
+			}
+			return s.registerHandler("page", site("blog page"))
+		}); err != nil {
+			return err
+		}
+
+		if err := s.registerHost("*.example.test", func() error {
+			return s.registerHandler("page", site("example page"))
+		}); err != nil {
+			return err
+		}
+
+		return s.registerHost("*.api.example.test", func() error {
+			return s.registerHandler("page", site("api page"))
+		})
+	}), nil)
+
+	cases := []struct {
+		name   string
+		host   string
+		path   string
+		status int
+		body   string
+	}{
+		{"Should serve a registered host with its own tree", "blog.test", "/page", 200, "blog page"},
+		{"Should ignore the port and the case of the host", "BLOG.test:4221", "/", 200, "blog"},
+		{"Should serve the subdomains of a wildcard host", "www.example.test", "/page", 200, "example page"},
+		{"Should serve the deeper subdomains of a wildcard host", "a.b.example.test", "/page", 200, "example page"},
+		{"Should prefer the most precise wildcard", "v1.api.example.test", "/page", 200, "api page"},
+		{"Should serve the other hosts with the default tree", "other.test", "/page", 200, "default page"},
+		{"Should not match the domain of a wildcard itself", "example.test", "/", 200, "default"},
+		{"Should not fall back to the default tree for a path missing on the host", "www.example.test", "/", 404, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status, body := hostRequest(t, addr, "GET "+c.path+" HTTP/1.1\r\nHost: "+c.host+"\r\n\r\n")
+
+			if status != c.status || body != c.body {
+				t.Logf("%s%s should be answered %d %q, got %d %q", c.host, c.path, c.status, c.body, status, body)
+				t.Fail()
+			}
+		})
+	}
+
+	t.Run("Should answer 400 to an http/1.1 request without a Host", func(t *testing.T) {
+		if status, _ := hostRequest(t, addr, "GET /page HTTP/1.1\r\n\r\n"); status != 400 {
+			t.Logf("a request without Host should be answered 400, got %d", status)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should answer 400 to a request with an invalid Host", func(t *testing.T) {
+		for _, version := range []string{"HTTP/1.1", "HTTP/1.0"} {
+			for _, host := range []string{"bad host", "a/b", "example.test:80a", "[::1", ":80"} {
+				if status, _ := hostRequest(t, addr, "GET /page "+version+"\r\nHost: "+host+"\r\n\r\n"); status != 400 {
+					t.Logf("the Host %q of an %s request should be answered 400, got %d", host, version, status)
+					t.Fail()
+				}
+			}
+		}
+	})
+
+	t.Run("Should answer 400 to a request with several Host", func(t *testing.T) {
+		for _, head := range []string{
+			"Host: blog.test\r\nHost: other.test",
+			"Host: blog.test\r\nhost: blog.test",
+			"Host : blog.test\r\nHost: other.test",
+			"Host: blog.test\r\nContent-Length: 0\r\nContent-Length: 5",
+		} {
+			if status, _ := hostRequest(t, addr, "GET /page HTTP/1.1\r\n"+head+"\r\n\r\n"); status != 400 {
+				t.Logf("the head %q should be answered 400, got %d", head, status)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should serve an http/1.0 request without a Host with the default tree", func(t *testing.T) {
+		if status, body := hostRequest(t, addr, "GET /page HTTP/1.0\r\n\r\n"); status != 200 || body != "default page" {
+			t.Logf("the request should be served by the default tree, got %d %q", status, body)
+			t.Fail()
+		}
+	})
+}
+
+func TestValidHost(t *testing.T) {
+	t.Run("Should accept host names and ips with an optional port", func(t *testing.T) {
+		for _, host := range []string{"example.test", "example.test:8080", "127.0.0.1", "[::1]:443", "[2001:db8::1]", "xn--bcher-kva.test"} {
+			if !validHost(host) {
+				t.Logf("%s should be valid", host)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should refuse empty and malformed hosts", func(t *testing.T) {
+		for _, host := range []string{"", "a b", "a/b", "a:b", "[::1", "[zz]", "[::1]x", "a@b", ":80"} {
+			if validHost(host) {
+				t.Logf("%q should be invalid", host)
+				t.Fail()
+			}
+		}
+	})
+}
+
+func TestRegisterHost(t *testing.T) {
+	t.Run("Should refuse the patterns that are not a host or a wildcard of a domain", func(t *testing.T) {
+		s := testServer(t, func(s *server) error { return nil })
+
+		for _, pattern := range []string{"", "*", "*.", "*example.test", "a.*.test", "bad host"} {
+			if err := s.registerHost(pattern, func() error { return nil }); err == nil {
+				t.Logf("the pattern %q should be refused", pattern)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should send every request of a virtual host to its upstream", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "upstream "+r.URL.Path)
+		}))
+		defer upstream.Close()
+
+		hosts, err := parseVirtualHosts([]string{"*.blog.test=" + upstream.URL}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := listen(t, testServer(t, func(s *server) error {
+			if err := s.registerHandler("page", func(props *reqProps, conn net.Conn) {
+				s.writeResponse(200, map[string]string{"Content-Length": "4"}, "page", conn)
+			}); err != nil {
+				return err
+			}
+			return s.registerHost("*.blog.test", func() error {
+				return s.registerProxy("", proxyConfig{pool: hosts["*.blog.test"]})
+			})
+		}), nil)
+
+		for host, expected := range map[string]string{"www.blog.test": "upstream /page", "other.test": "page"} {
+			if status, body := hostRequest(t, addr, "GET /page HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); status != 200 || body != expected {
+				t.Logf("%s should be answered %q, got %d %q", host, expected, status, body)
+				t.Fail()
+			}
+		}
+
+		if _, err := parseVirtualHosts([]string{"blog.test"}, nil); err == nil {
+			t.Log("a virtual host without upstream should be refused")
+			t.Fail()
+		}
+	})
+}
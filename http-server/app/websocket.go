@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseNoStatus        = 1005
+	wsCloseInvalidPayload  = 1007
+	wsCloseMessageTooBig   = 1009
+	wsCloseInternalError   = 1011
+	wsDefaultMaxMessage    = 1 << 20
+	wsMaxFramePayload      = 1 << 16
+	wsCloseHandshakeWindow = 5 * time.Second
+)
+
+type wsHandlerFunc func(props *reqProps, ws *wsConn)
+
+// wsCloseError is returned by readMessage once the connection is closed, code is the one the
+// client sent or the one we closed with when the client broke the protocol
+type wsCloseError struct {
+	code   uint16
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d: %s", e.code, e.reason)
+}
+
+// wsConn is a message oriented websocket connection, reads have to happen in a single goroutine
+// while writes can come from any of them
+type wsConn struct {
+	conn           net.Conn
+	r              *bufio.Reader
+	writeMu        sync.Mutex
+	closeSent      bool
+	maxMessageSize int64
+	writeTimeout   time.Duration
+}
+
+// registerWebSocket associates a websocket handler to the path, the handshake is done by the server
+// and the handler gets the connection once it is upgraded
+func (s *server) registerWebSocket(path string, handle wsHandlerFunc) error {
+	n := s.nodeFor(path)
+
+	if n.websocket != nil {
+		return fmt.Errorf("the path %s has already a websocket handler associated", path)
+	}
+
+	n.websocket = handle
+
+	return nil
+}
+
+func isWebSocketUpgrade(props *reqProps) bool {
+	return headerHasToken(props.header("Upgrade"), "websocket") && headerHasToken(props.header("Connection"), "upgrade")
+}
+
+// upgradeWebSocket does the opening handshake of rfc 6455 section 4.2 and hands the connection to the
+// handler, r reads the connection with whatever was read after the request in front
+func (s *server) upgradeWebSocket(conn net.Conn, r io.Reader, props *reqProps, handle wsHandlerFunc) {
+	if props.method != "GET" {
+		s.writeResponse(405, map[string]string{"Allow": "GET"}, "", conn)
+		return
+	}
+
+	if props.header("Sec-WebSocket-Version") != "13" {
+		s.writeResponse(426, map[string]string{"Sec-WebSocket-Version": "13"}, "", conn)
+		return
+	}
+
+	key := props.header("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		s.writeResponse(400, map[string]string{}, "", conn)
+		return
+	}
+
+	written := s.writeResponse(101, map[string]string{
+		"Upgrade":              "websocket",
+		"Connection":           "Upgrade",
+		"Sec-WebSocket-Accept": wsAcceptKey(key),
+	}, "", conn)
+	if written == -1 {
+		return
+	}
+
+	ws := &wsConn{
+		conn:           conn,
+		r:              bufio.NewReader(r),
+		maxMessageSize: wsDefaultMaxMessage,
+		writeTimeout:   s.timeouts.write,
+	}
+
+	handle(props, ws)
+
+	// a handler returning without closing ends the connection normally
+	ws.close(wsCloseNormal, "")
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// readMessage gives the next text or binary message, fragments are put back together and control
+// frames are answered on the way. Protocol errors close the connection with the matching code
+func (ws *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	fragmented := false
+
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				ws.close(closeErr.code, closeErr.reason)
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err = ws.writeFrame(true, wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			return 0, nil, ws.onClose(payload)
+		case wsText, wsBinary:
+			if fragmented {
+				return 0, nil, ws.fail(wsCloseProtocolError, "new message in the middle of a fragmented one")
+			}
+			opcode = op
+			message = nil
+		case wsContinuation:
+			if !fragmented {
+				return 0, nil, ws.fail(wsCloseProtocolError, "continuation without a message")
+			}
+		default:
+			return 0, nil, ws.fail(wsCloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(message)+len(payload)) > ws.maxMessageSize {
+			return 0, nil, ws.fail(wsCloseMessageTooBig, "message too big")
+		}
+
+		message = append(message, payload...)
+		fragmented = !fin
+
+		if fin {
+			if opcode == wsText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(wsCloseInvalidPayload, "text message is not valid utf-8")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks it, every frame of a client has to be masked
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{code: wsCloseProtocolError, reason: "reserved bits set"}
+	}
+
+	if !masked {
+		return false, 0, nil, &wsCloseError{code: wsCloseProtocolError, reason: "client frames have to be masked"}
+	}
+
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, &wsCloseError{code: wsCloseProtocolError, reason: "invalid control frame"}
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > uint64(ws.maxMessageSize) {
+		return false, 0, nil, &wsCloseError{code: wsCloseMessageTooBig, reason: "frame too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// onClose answers the close frame of the client with the same code as rfc 6455 section 5.5.1 asks
+func (ws *wsConn) onClose(payload []byte) error {
+	code := uint16(wsCloseNoStatus)
+	reason := ""
+
+	if len(payload) == 1 {
+		return ws.fail(wsCloseProtocolError, "close frame with a partial code")
+	}
+
+	if len(payload) >= 2 {
+		code = binary.BigEndian.Uint16(payload)
+		reason = string(payload[2:])
+
+		if !validCloseCode(code) {
+			return ws.fail(wsCloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return ws.fail(wsCloseInvalidPayload, "close reason is not valid utf-8")
+		}
+	}
+
+	if code == wsCloseNoStatus {
+		ws.sendClose(nil)
+	} else {
+		ws.sendClose(payload[:2])
+	}
+
+	return &wsCloseError{code: code, reason: reason}
+}
+
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the connection because the client broke the protocol
+func (ws *wsConn) fail(code uint16, reason string) error {
+	ws.close(code, reason)
+	return &wsCloseError{code: code, reason: reason}
+}
+
+// writeMessage sends a text or binary message, big messages are split in fragments
+func (ws *wsConn) writeMessage(opcode byte, data []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	if ws.closeSent {
+		return net.ErrClosed
+	}
+
+	// like writeFrame, the write timeout is counted from the message and not from the upgrade
+	ws.conn.SetWriteDeadline(deadline(ws.writeTimeout))
+
+	for {
+		fragment := data
+		if len(fragment) > wsMaxFramePayload {
+			fragment = data[:wsMaxFramePayload]
+		}
+		data = data[len(fragment):]
+
+		if err := ws.writeFrameLocked(len(data) == 0, opcode, fragment); err != nil {
+			return err
+		}
+
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = wsContinuation
+	}
+}
+
+func (ws *wsConn) ping(data []byte) error {
+	return ws.writeFrame(true, wsPing, data)
+}
+
+// close starts the closing handshake, the connection itself is closed by the server once the
+// handler returns
+func (ws *wsConn) close(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+
+	return ws.sendClose(payload)
+}
+
+func (ws *wsConn) sendClose(payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	if ws.closeSent {
+		return nil
+	}
+	ws.closeSent = true
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsCloseHandshakeWindow))
+
+	return ws.writeFrameLocked(true, wsClose, payload)
+}
+
+func (ws *wsConn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	if ws.closeSent {
+		return net.ErrClosed
+	}
+
+	// the connection lives longer than a response, every frame gets the write timeout
+	ws.conn.SetWriteDeadline(deadline(ws.writeTimeout))
+
+	return ws.writeFrameLocked(fin, opcode, payload)
+}
+
+// writeFrameLocked sends an unmasked frame, server frames are never masked
+func (ws *wsConn) writeFrameLocked(fin bool, opcode byte, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	var frame bytes.Buffer
+	frame.WriteByte(first)
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame.WriteByte(byte(length))
+	case length <= 0xffff:
+		frame.WriteByte(126)
+		frame.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	default:
+		frame.WriteByte(127)
+		frame.Write(binary.BigEndian.AppendUint64(nil, uint64(length)))
+	}
+
+	frame.Write(payload)
+
+	_, err := ws.conn.Write(frame.Bytes())
+	return err
+}
+
+// wsRooms keeps the connections of every room so a message can be sent to all of them
+type wsRooms struct {
+	mu    sync.Mutex
+	rooms map[string]map[*wsConn]bool
+}
+
+func (r *wsRooms) join(room string, ws *wsConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rooms == nil {
+		r.rooms = make(map[string]map[*wsConn]bool)
+	}
+	if r.rooms[room] == nil {
+		r.rooms[room] = make(map[*wsConn]bool)
+	}
+	r.rooms[room][ws] = true
+}
+
+func (r *wsRooms) leave(room string, ws *wsConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.rooms[room], ws)
+	if len(r.rooms[room]) == 0 {
+		delete(r.rooms, room)
+	}
+}
+
+func (r *wsRooms) broadcast(room string, opcode byte, data []byte) {
+	r.mu.Lock()
+	members := make([]*wsConn, 0, len(r.rooms[room]))
+	for ws := range r.rooms[room] {
+		members = append(members, ws)
+	}
+	r.mu.Unlock()
+
+	for _, ws := range members {
+		if err := ws.writeMessage(opcode, data); err != nil {
+			fmt.Println("Error sending websocket message : ", err.Error())
+		}
+	}
+}
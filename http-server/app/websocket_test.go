@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// wsClient is just enough of a client to talk to the server in the tests
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr string, path string) *wsClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	conn.Write([]byte("GET /" + path + " HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	statusLine, _ := r.ReadString('\n')
+	if !strings.HasPrefix(statusLine, "HTTP/1.1 101") {
+		t.Fatalf("Should switch protocols, got %q", statusLine)
+	}
+
+	accepted := false
+	for line, _ := r.ReadString('\n'); line != "\r\n" && line != ""; line, _ = r.ReadString('\n') {
+		if strings.TrimSpace(line) == "Sec-WebSocket-Accept:s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			accepted = true
+		}
+	}
+	if !accepted {
+		t.Fatal("The accept key should be the one of the rfc example")
+	}
+
+	return &wsClient{conn: conn, r: r}
+}
+
+func (c *wsClient) send(fin bool, opcode byte, payload []byte, masked bool) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first}
+	second := byte(0)
+	if masked {
+		second = 0x80
+	}
+
+	if len(payload) <= 125 {
+		frame = append(frame, second|byte(len(payload)))
+	} else {
+		frame = append(frame, second|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.conn.Write(frame)
+}
+
+func (c *wsClient) read(t *testing.T) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatalf("There should be a frame: %s", err.Error())
+	}
+
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	io.ReadFull(c.r, payload)
+
+	return head[0] & 0x0f, payload
+}
+
+func TestWebSocket(t *testing.T) {
+	s := routesServer(t)
+	addr := listen(t, s, nil)
+
+	t.Run("Should send a message to everyone in the room", func(t *testing.T) {
+		first := dialWebSocket(t, addr, "ws/lobby")
+		second := dialWebSocket(t, addr, "ws/lobby")
+
+		// a ping round trip makes sure both clients joined before the message is sent
+		first.send(true, wsPing, []byte("p"), true)
+		if op, _ := first.read(t); op != wsPong {
+			t.Fatal("Ping should be answered with a pong")
+		}
+		second.send(true, wsPing, []byte("p"), true)
+		second.read(t)
+
+		first.send(true, wsText, []byte("hello room"), true)
+
+		for _, c := range []*wsClient{first, second} {
+			op, payload := c.read(t)
+			if op != wsText || string(payload) != "hello room" {
+				t.Logf("Should receive the message, got %d %q", op, payload)
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("Should put fragmented messages back together", func(t *testing.T) {
+		c := dialWebSocket(t, addr, "ws/fragments")
+
+		c.send(false, wsBinary, []byte("frag"), true)
+		c.send(true, wsPing, []byte("between"), true)
+		c.send(false, wsContinuation, []byte("men"), true)
+		c.send(true, wsContinuation, []byte("ted"), true)
+
+		op, payload := c.read(t)
+		if op != wsPong || string(payload) != "between" {
+			t.Logf("Ping in the middle of the fragments should be answered, got %d %q", op, payload)
+			t.Fail()
+		}
+
+		op, payload = c.read(t)
+		if op != wsBinary || string(payload) != "fragmented" {
+			t.Logf("Should receive the whole message, got %d %q", op, payload)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should echo the close code", func(t *testing.T) {
+		c := dialWebSocket(t, addr, "ws/closing")
+
+		c.send(true, wsClose, binary.BigEndian.AppendUint16(nil, 1001), true)
+
+		op, payload := c.read(t)
+		if op != wsClose || binary.BigEndian.Uint16(payload) != 1001 {
+			t.Logf("Should answer the close with the same code, got %d %v", op, payload)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should close unmasked connections with a protocol error", func(t *testing.T) {
+		c := dialWebSocket(t, addr, "ws/unmasked")
+
+		c.send(true, wsText, []byte("not masked"), false)
+
+		op, payload := c.read(t)
+		if op != wsClose || binary.BigEndian.Uint16(payload) != wsCloseProtocolError {
+			t.Logf("Should close with 1002, got %d %v", op, payload)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should close on text messages that are not utf-8", func(t *testing.T) {
+		c := dialWebSocket(t, addr, "ws/utf8")
+
+		c.send(true, wsText, []byte{0xff, 0xfe}, true)
+
+		op, payload := c.read(t)
+		if op != wsClose || binary.BigEndian.Uint16(payload) != wsCloseInvalidPayload {
+			t.Logf("Should close with 1007, got %d %v", op, payload)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse unsupported versions", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+
+		conn.Write([]byte("GET /ws/lobby HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n"))
+
+		statusLine, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.HasPrefix(statusLine, "HTTP/1.1 426") {
+			t.Logf("Should answer 426, got %q", statusLine)
+			t.Fail()
+		}
+	})
+
+	t.Run("Should refuse the upgrade in the middlewares of the route", func(t *testing.T) {
+		guarded := routesServer(t)
+		guarded.useOn("ws/{room}", func(next handlerFunc) handlerFunc {
+			return func(props *reqProps, conn net.Conn) {
+				if props.header("Authorization") == "" {
+					guarded.writeResponse(401, map[string]string{"Content-Length": "0"}, "", conn)
+					return
+				}
+				next(props, conn)
+			}
+		})
+		guardedAddr := listen(t, guarded, nil)
+
+		conn, _ := net.Dial("tcp", guardedAddr)
+		defer conn.Close()
+
+		conn.Write([]byte("GET /ws/lobby HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+		statusLine, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.HasPrefix(statusLine, "HTTP/1.1 401") {
+			t.Logf("Should answer 401 without switching protocols, got %q", statusLine)
+			t.Fail()
+		}
+	})
+}